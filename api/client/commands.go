@@ -13,6 +13,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -26,6 +27,7 @@ import (
 	"github.com/dotcloud/docker/dockerversion"
 	"github.com/dotcloud/docker/engine"
 	"github.com/dotcloud/docker/nat"
+	"github.com/dotcloud/docker/opts"
 	"github.com/dotcloud/docker/pkg/signal"
 	"github.com/dotcloud/docker/pkg/term"
 	"github.com/dotcloud/docker/pkg/units"
@@ -61,6 +63,7 @@ func (cli *DockerCli) CmdHelp(args ...string) error {
 		{"kill", "Kill a running container"},
 		{"load", "Load an image from a tar archive"},
 		{"login", "Register or Login to the docker registry server"},
+		{"logout", "Log out from a docker registry server"},
 		{"logs", "Fetch the logs of a container"},
 		{"port", "Lookup the public-facing port which is NAT-ed to PRIVATE_PORT"},
 		{"ps", "List containers"},
@@ -111,6 +114,16 @@ func (cli *DockerCli) CmdBuild(args ...string) error {
 	noCache := cmd.Bool([]string{"#no-cache", "-no-cache"}, false, "Do not use cache when building the image")
 	rm := cmd.Bool([]string{"#rm", "-rm"}, true, "Remove intermediate containers after a successful build")
 	forceRm := cmd.Bool([]string{"-force-rm"}, false, "Always remove intermediate containers, even after unsuccessful builds")
+	target := cmd.String([]string{"-target"}, "", "Name of the build stage to stop at")
+	dockerfileName := cmd.String([]string{"f", "-file"}, "", "Path of the Dockerfile within the context (default 'Dockerfile')")
+	cacheFrom := opts.NewListOpts(nil)
+	cmd.Var(&cacheFrom, []string{"-cache-from"}, "Images to consider as cache sources, instead of the local images")
+	squash := cmd.Bool([]string{"-squash"}, false, "Squash the layers created by the build into a single layer")
+	progress := cmd.String([]string{"-progress"}, "plain", "Output of the build: plain, or json for a JSON message per line")
+	secrets := opts.NewListOpts(nil)
+	cmd.Var(&secrets, []string{"-secret"}, "Secret file to expose to RUN --secret, as id=<id>,src=<file>")
+	sshAgents := opts.NewListOpts(nil)
+	cmd.Var(&sshAgents, []string{"-ssh"}, "SSH agent socket to forward to RUN --ssh, as <id>[=<socket>] (default socket $SSH_AUTH_SOCK)")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -118,6 +131,9 @@ func (cli *DockerCli) CmdBuild(args ...string) error {
 		cmd.Usage()
 		return nil
 	}
+	if *progress != "plain" && *progress != "json" {
+		return fmt.Errorf("Invalid --progress %s, must be plain or json", *progress)
+	}
 
 	var (
 		context  archive.Archive
@@ -151,21 +167,35 @@ func (cli *DockerCli) CmdBuild(args ...string) error {
 			}
 			defer os.RemoveAll(root)
 
-			if output, err := exec.Command("git", "clone", "--recursive", remoteURL, root).CombinedOutput(); err != nil {
-				return fmt.Errorf("Error trying to use git: %s (%s)", err, output)
+			if root, err = utils.GitClone(remoteURL, root); err != nil {
+				return err
 			}
 		}
 		if _, err := os.Stat(root); err != nil {
 			return err
 		}
-		filename := path.Join(root, "Dockerfile")
+		dockerfile := "Dockerfile"
+		if *dockerfileName != "" {
+			dockerfile = *dockerfileName
+		}
+		filename := path.Join(root, dockerfile)
 		if _, err = os.Stat(filename); os.IsNotExist(err) {
-			return fmt.Errorf("no Dockerfile found in %s", cmd.Arg(0))
+			return fmt.Errorf("no %s found in %s", dockerfile, cmd.Arg(0))
 		}
 		if err = utils.ValidateContextDirectory(root); err != nil {
 			return fmt.Errorf("Error checking context is accessible: '%s'. Please check permissions and try again.", err)
 		}
-		context, err = archive.Tar(root, archive.Uncompressed)
+		excludes, err := utils.ReadDockerignore(root)
+		if err != nil {
+			return err
+		}
+		if excluded, _ := utils.Matches(dockerfile, excludes); excluded {
+			return fmt.Errorf("The Dockerfile must not be excluded by .dockerignore")
+		}
+		context, err = archive.TarFilter(root, &archive.TarOptions{
+			Compression: archive.Uncompressed,
+			Excludes:    excludes,
+		})
 	}
 	var body io.Reader
 	// Setup an upload progress bar
@@ -206,7 +236,44 @@ func (cli *DockerCli) CmdBuild(args ...string) error {
 		v.Set("forcerm", "1")
 	}
 
+	if *dockerfileName != "" {
+		v.Set("dockerfile", *dockerfileName)
+	}
+	if *target != "" {
+		v.Set("target", *target)
+	}
+
+	if *squash {
+		v.Set("squash", "1")
+	}
+
+	if cacheFrom.Len() > 0 {
+		buf, err := json.Marshal(cacheFrom.GetAll())
+		if err != nil {
+			return err
+		}
+		v.Set("cachefrom", string(buf))
+	}
+
+	if sshAgents.Len() > 0 {
+		agents, err := parseSSHAgents(sshAgents.GetAll())
+		if err != nil {
+			return err
+		}
+		buf, err := json.Marshal(agents)
+		if err != nil {
+			return err
+		}
+		v.Set("ssh", string(buf))
+	}
+
 	cli.LoadConfigFile()
+	// The credentials kept by the credential helpers are sent as well
+	for serverAddress := range cli.configFile.Helpers {
+		if _, err := cli.configFile.GetAuthConfig(serverAddress); err != nil {
+			return err
+		}
+	}
 
 	headers := http.Header(make(map[string][]string))
 	buf, err := json.Marshal(cli.configFile)
@@ -215,10 +282,28 @@ func (cli *DockerCli) CmdBuild(args ...string) error {
 	}
 	headers.Add("X-Registry-Config", base64.URLEncoding.EncodeToString(buf))
 
+	// Secrets are sent in a header rather than in the context, so that
+	// they don't end up in the checksum of the context
+	if secrets.Len() > 0 {
+		buildSecrets, err := readBuildSecrets(secrets.GetAll())
+		if err != nil {
+			return err
+		}
+		buf, err := json.Marshal(buildSecrets)
+		if err != nil {
+			return err
+		}
+		headers.Add("X-Build-Secrets", base64.URLEncoding.EncodeToString(buf))
+	}
+
 	if context != nil {
 		headers.Set("Content-Type", "application/tar")
 	}
-	err = cli.stream("POST", fmt.Sprintf("/build?%s", v.Encode()), body, cli.out, headers)
+	if *progress == "json" {
+		err = cli.streamJSON("POST", fmt.Sprintf("/build?%s", v.Encode()), body, headers)
+	} else {
+		err = cli.stream("POST", fmt.Sprintf("/build?%s", v.Encode()), body, cli.out, headers)
+	}
 	if jerr, ok := err.(*utils.JSONError); ok {
 		// If no error code is set, default to 1
 		if jerr.Code == 0 {
@@ -229,15 +314,76 @@ func (cli *DockerCli) CmdBuild(args ...string) error {
 	return err
 }
 
+// readBuildSecrets reads the files of the build secrets given as
+// id=<id>,src=<file>. The id defaults to the name of the file.
+func readBuildSecrets(specs []string) (map[string][]byte, error) {
+	secrets := make(map[string][]byte)
+	for _, spec := range specs {
+		var id, src string
+		for _, opt := range strings.Split(spec, ",") {
+			key, val, err := utils.ParseKeyValueOpt(opt)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid secret %s, must be id=<id>,src=<file>", spec)
+			}
+			switch key {
+			case "id":
+				id = val
+			case "src", "source":
+				src = val
+			default:
+				return nil, fmt.Errorf("Unknown option %s for secret %s", key, spec)
+			}
+		}
+		if src == "" {
+			return nil, fmt.Errorf("Invalid secret %s, src is required", spec)
+		}
+		if id == "" {
+			id = path.Base(src)
+		}
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			return nil, err
+		}
+		secrets[id] = data
+	}
+	return secrets, nil
+}
+
+// parseSSHAgents returns the absolute paths of the SSH agent sockets given as
+// <id>[=<socket>], by id. The socket defaults to $SSH_AUTH_SOCK.
+func parseSSHAgents(specs []string) (map[string]string, error) {
+	agents := make(map[string]string)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		id, socket := parts[0], os.Getenv("SSH_AUTH_SOCK")
+		if len(parts) == 2 {
+			socket = parts[1]
+		}
+		if id == "" {
+			return nil, fmt.Errorf("Invalid SSH agent %s, must be <id>[=<socket>]", spec)
+		}
+		if socket == "" {
+			return nil, fmt.Errorf("No socket for the SSH agent %s, and SSH_AUTH_SOCK is not set", id)
+		}
+		socket, err := filepath.Abs(socket)
+		if err != nil {
+			return nil, err
+		}
+		agents[id] = socket
+	}
+	return agents, nil
+}
+
 // 'docker login': login / register a user to registry service.
 func (cli *DockerCli) CmdLogin(args ...string) error {
 	cmd := cli.Subcmd("login", "[OPTIONS] [SERVER]", "Register or Login to a docker registry server, if no server is specified \""+registry.IndexServerAddress()+"\" is the default.")
 
-	var username, password, email string
+	var username, password, email, helper string
 
 	cmd.StringVar(&username, []string{"u", "-username"}, "", "Username")
 	cmd.StringVar(&password, []string{"p", "-password"}, "", "Password")
 	cmd.StringVar(&email, []string{"e", "-email"}, "", "Email")
+	cmd.StringVar(&helper, []string{"-helper"}, "", "Keep the credentials with the credential helper docker-credential-<helper> instead of the config file")
 	err := cmd.Parse(args)
 	if err != nil {
 		return nil
@@ -266,9 +412,14 @@ func (cli *DockerCli) CmdLogin(args ...string) error {
 	}
 
 	cli.LoadConfigFile()
+	if helper != "" {
+		cli.configFile.Helpers[serverAddress] = helper
+	}
 	authconfig, ok := cli.configFile.Configs[serverAddress]
 	if !ok {
 		authconfig = registry.AuthConfig{}
+	} else if authconfig, err = cli.configFile.GetAuthConfig(serverAddress); err != nil {
+		return err
 	}
 
 	if username == "" {
@@ -312,7 +463,9 @@ func (cli *DockerCli) CmdLogin(args ...string) error {
 
 	stream, statusCode, err := cli.call("POST", "/auth", cli.configFile.Configs[serverAddress], false)
 	if statusCode == 401 {
-		delete(cli.configFile.Configs, serverAddress)
+		if err := cli.configFile.EraseCredentials(serverAddress); err != nil {
+			return err
+		}
 		registry.SaveConfig(cli.configFile)
 		return err
 	}
@@ -325,6 +478,9 @@ func (cli *DockerCli) CmdLogin(args ...string) error {
 		cli.configFile, _ = registry.LoadConfig(os.Getenv("HOME"))
 		return err
 	}
+	if err := cli.configFile.StoreCredentials(serverAddress); err != nil {
+		return err
+	}
 	registry.SaveConfig(cli.configFile)
 	if out2.Get("Status") != "" {
 		fmt.Fprintf(cli.out, "%s\n", out2.Get("Status"))
@@ -332,6 +488,33 @@ func (cli *DockerCli) CmdLogin(args ...string) error {
 	return nil
 }
 
+// 'docker logout': remove the credentials of a registry server.
+func (cli *DockerCli) CmdLogout(args ...string) error {
+	cmd := cli.Subcmd("logout", "[SERVER]", "Log out from a docker registry server, if no server is specified \""+registry.IndexServerAddress()+"\" is the default.")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() > 1 {
+		cmd.Usage()
+		return nil
+	}
+	serverAddress := registry.IndexServerAddress()
+	if cmd.NArg() == 1 {
+		serverAddress = cmd.Arg(0)
+	}
+
+	cli.LoadConfigFile()
+	if _, ok := cli.configFile.Configs[serverAddress]; !ok {
+		fmt.Fprintf(cli.out, "Not logged in to %s\n", serverAddress)
+		return nil
+	}
+	fmt.Fprintf(cli.out, "Removing login credentials for %s\n", serverAddress)
+	if err := cli.configFile.EraseCredentials(serverAddress); err != nil {
+		return err
+	}
+	return registry.SaveConfig(cli.configFile)
+}
+
 // 'docker wait': block until a container stops
 func (cli *DockerCli) CmdWait(args ...string) error {
 	cmd := cli.Subcmd("wait", "CONTAINER [CONTAINER...]", "Block until a container stops, then print its exit code.")
@@ -458,7 +641,11 @@ func (cli *DockerCli) CmdInfo(args ...string) error {
 
 	if len(remoteInfo.GetList("IndexServerAddress")) != 0 {
 		cli.LoadConfigFile()
-		u := cli.configFile.Configs[remoteInfo.Get("IndexServerAddress")].Username
+		authConfig, err := cli.configFile.GetAuthConfig(remoteInfo.Get("IndexServerAddress"))
+		if err != nil {
+			return err
+		}
+		u := authConfig.Username
 		if len(u) > 0 {
 			fmt.Fprintf(cli.out, "Username: %v\n", u)
 			fmt.Fprintf(cli.out, "Registry: %v\n", remoteInfo.GetList("IndexServerAddress"))
@@ -1033,13 +1220,16 @@ func (cli *DockerCli) CmdPush(args ...string) error {
 		return err
 	}
 	// Resolve the Auth config relevant for this server
-	authConfig := cli.configFile.ResolveAuthConfig(hostname)
+	authConfig, err := cli.configFile.GetAuthConfig(hostname)
+	if err != nil {
+		return err
+	}
 	// If we're not using a custom registry, we know the restrictions
 	// applied to repository names and can warn the user in advance.
 	// Custom repositories can have different rules, and we must also
 	// allow pushing by image ID.
 	if len(strings.SplitN(name, "/", 2)) == 1 {
-		username := cli.configFile.Configs[registry.IndexServerAddress()].Username
+		username := authConfig.Username
 		if username == "" {
 			username = "<user>"
 		}
@@ -1068,7 +1258,10 @@ func (cli *DockerCli) CmdPush(args ...string) error {
 			if err := cli.CmdLogin(hostname); err != nil {
 				return err
 			}
-			authConfig := cli.configFile.ResolveAuthConfig(hostname)
+			authConfig, err := cli.configFile.GetAuthConfig(hostname)
+			if err != nil {
+				return err
+			}
 			return push(authConfig)
 		}
 		return err
@@ -1102,7 +1295,10 @@ func (cli *DockerCli) CmdPull(args ...string) error {
 	cli.LoadConfigFile()
 
 	// Resolve the Auth config relevant for this server
-	authConfig := cli.configFile.ResolveAuthConfig(hostname)
+	authConfig, err := cli.configFile.GetAuthConfig(hostname)
+	if err != nil {
+		return err
+	}
 	v := url.Values{}
 	v.Set("fromImage", remote)
 	v.Set("tag", *tag)
@@ -1127,7 +1323,10 @@ func (cli *DockerCli) CmdPull(args ...string) error {
 			if err := cli.CmdLogin(hostname); err != nil {
 				return err
 			}
-			authConfig := cli.configFile.ResolveAuthConfig(hostname)
+			authConfig, err := cli.configFile.GetAuthConfig(hostname)
+			if err != nil {
+				return err
+			}
 			return pull(authConfig)
 		}
 		return err
@@ -1140,6 +1339,7 @@ func (cli *DockerCli) CmdImages(args ...string) error {
 	cmd := cli.Subcmd("images", "[OPTIONS] [NAME]", "List images")
 	quiet := cmd.Bool([]string{"q", "-quiet"}, false, "Only show numeric IDs")
 	all := cmd.Bool([]string{"a", "-all"}, false, "Show all images (by default filter out the intermediate image layers)")
+	showDigests := cmd.Bool([]string{"-digests"}, false, "Show the digests of the images")
 	noTrunc := cmd.Bool([]string{"#notrunc", "-no-trunc"}, false, "Don't truncate output")
 	// FIXME: --viz and --tree are deprecated. Remove them in a future version.
 	flViz := cmd.Bool([]string{"#v", "#viz", "#-viz"}, false, "Output graph in graphviz format")
@@ -1239,11 +1439,30 @@ func (cli *DockerCli) CmdImages(args ...string) error {
 
 		w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
 		if !*quiet {
-			fmt.Fprintln(w, "REPOSITORY\tTAG\tIMAGE ID\tCREATED\tVIRTUAL SIZE")
+			if *showDigests {
+				fmt.Fprintln(w, "REPOSITORY\tTAG\tDIGEST\tIMAGE ID\tCREATED\tVIRTUAL SIZE")
+			} else {
+				fmt.Fprintln(w, "REPOSITORY\tTAG\tIMAGE ID\tCREATED\tVIRTUAL SIZE")
+			}
 		}
 
 		for _, out := range outs.Data {
-			for _, repotag := range out.GetList("RepoTags") {
+			var (
+				repoTags = out.GetList("RepoTags")
+				digests  = make(map[string]string)
+			)
+			for _, repoDigest := range out.GetList("RepoDigests") {
+				repo, digest := utils.ParseRepositoryTag(repoDigest)
+				digests[repo] = digest
+			}
+			// Images pulled by digest may have no tag
+			if *showDigests && len(digests) > 0 && len(repoTags) == 1 && repoTags[0] == "<none>:<none>" {
+				repoTags = nil
+				for repo := range digests {
+					repoTags = append(repoTags, repo+":<none>")
+				}
+			}
+			for _, repotag := range repoTags {
 
 				repo, tag := utils.ParseRepositoryTag(repotag)
 				outID := out.Get("Id")
@@ -1252,7 +1471,16 @@ func (cli *DockerCli) CmdImages(args ...string) error {
 				}
 
 				if !*quiet {
-					fmt.Fprintf(w, "%s\t%s\t%s\t%s ago\t%s\n", repo, tag, outID, units.HumanDuration(time.Now().UTC().Sub(time.Unix(out.GetInt64("Created"), 0))), units.HumanSize(out.GetInt64("VirtualSize")))
+					if *showDigests {
+						digest, exists := digests[repo]
+						if !exists {
+							digest = "<none>"
+						}
+						fmt.Fprintf(w, "%s\t%s\t%s\t", repo, tag, digest)
+					} else {
+						fmt.Fprintf(w, "%s\t%s\t", repo, tag)
+					}
+					fmt.Fprintf(w, "%s\t%s ago\t%s\n", outID, units.HumanDuration(time.Now().UTC().Sub(time.Unix(out.GetInt64("Created"), 0))), units.HumanSize(out.GetInt64("VirtualSize")))
 				} else {
 					fmt.Fprintln(w, outID)
 				}
@@ -1687,10 +1915,13 @@ func (cli *DockerCli) CmdAttach(args ...string) error {
 }
 
 func (cli *DockerCli) CmdSearch(args ...string) error {
-	cmd := cli.Subcmd("search", "TERM", "Search the docker index for images")
+	cmd := cli.Subcmd("search", "[OPTIONS] [REGISTRY/]TERM", "Search the docker index, or the registry given by hostname, for images")
 	noTrunc := cmd.Bool([]string{"#notrunc", "-no-trunc"}, false, "Don't truncate output")
 	trusted := cmd.Bool([]string{"t", "#trusted", "-trusted"}, false, "Only show trusted builds")
 	stars := cmd.Int([]string{"s", "#stars", "-stars"}, 0, "Only displays with at least xxx stars")
+	limit := cmd.Int([]string{"-limit"}, registry.DefaultSearchLimit, "Max number of search results, at most 100")
+	filters := opts.NewListOpts(nil)
+	cmd.Var(&filters, []string{"f", "-filter"}, "Filter the results, as is-official=true|false, is-automated=true|false or stars=<number>")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -1699,36 +1930,70 @@ func (cli *DockerCli) CmdSearch(args ...string) error {
 		return nil
 	}
 
+	searchFilters := map[string][]string{}
+	for _, filter := range filters.GetAll() {
+		parts := strings.SplitN(filter, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Invalid filter %q: expected name=value", filter)
+		}
+		searchFilters[parts[0]] = append(searchFilters[parts[0]], parts[1])
+	}
+	if *trusted {
+		searchFilters["is-automated"] = append(searchFilters["is-automated"], "true")
+	}
+	if *stars > 0 {
+		searchFilters["stars"] = append(searchFilters["stars"], strconv.Itoa(*stars))
+	}
+
 	v := url.Values{}
 	v.Set("term", cmd.Arg(0))
+	v.Set("limit", strconv.Itoa(*limit))
+	if len(searchFilters) > 0 {
+		buf, err := json.Marshal(searchFilters)
+		if err != nil {
+			return err
+		}
+		v.Set("filters", string(buf))
+	}
 
-	body, _, err := readBody(cli.call("GET", "/images/search?"+v.Encode(), nil, true))
-
+	// Resolve the Auth config relevant for the registry searched
+	hostname, _ := registry.SplitReposSearchTerm(cmd.Arg(0))
+	cli.LoadConfigFile()
+	authConfig, err := cli.configFile.GetAuthConfig(hostname)
 	if err != nil {
 		return err
 	}
-	outs := engine.NewTable("star_count", 0)
-	if _, err := outs.ReadListFrom(body); err != nil {
+	buf, err := json.Marshal(authConfig)
+	if err != nil {
+		return err
+	}
+	resp, err := cli.streamRequest("GET", "/images/search?"+v.Encode(), nil, map[string][]string{
+		"X-Registry-Auth": {base64.URLEncoding.EncodeToString(buf)},
+	})
+	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+	results := &registry.SearchResults{}
+	if err := json.NewDecoder(resp.Body).Decode(results); err != nil {
+		return err
+	}
+
 	w := tabwriter.NewWriter(cli.out, 10, 1, 3, ' ', 0)
 	fmt.Fprintf(w, "NAME\tDESCRIPTION\tSTARS\tOFFICIAL\tTRUSTED\n")
-	for _, out := range outs.Data {
-		if (*trusted && !out.GetBool("is_trusted")) || (*stars > out.GetInt("star_count")) {
-			continue
-		}
-		desc := strings.Replace(out.Get("description"), "\n", " ", -1)
+	for _, result := range results.Results {
+		desc := strings.Replace(result.Description, "\n", " ", -1)
 		desc = strings.Replace(desc, "\r", " ", -1)
 		if !*noTrunc && len(desc) > 45 {
 			desc = utils.Trunc(desc, 42) + "..."
 		}
-		fmt.Fprintf(w, "%s\t%s\t%d\t", out.Get("name"), desc, out.GetInt("star_count"))
-		if out.GetBool("is_official") {
+		fmt.Fprintf(w, "%s\t%s\t%d\t", result.Name, desc, result.StarCount)
+		if result.IsOfficial {
 			fmt.Fprint(w, "[OK]")
 
 		}
 		fmt.Fprint(w, "\t")
-		if out.GetBool("is_trusted") {
+		if result.IsTrusted {
 			fmt.Fprint(w, "[OK]")
 		}
 		fmt.Fprint(w, "\n")
@@ -1859,7 +2124,10 @@ func (cli *DockerCli) CmdRun(args ...string) error {
 		cli.LoadConfigFile()
 
 		// Resolve the Auth config relevant for this server
-		authConfig := cli.configFile.ResolveAuthConfig(hostname)
+		authConfig, err := cli.configFile.GetAuthConfig(hostname)
+		if err != nil {
+			return err
+		}
 		buf, err := json.Marshal(authConfig)
 		if err != nil {
 			return err
@@ -64,7 +64,10 @@ func (cli *DockerCli) call(method, path string, data interface{}, passAuthInfo b
 	if passAuthInfo {
 		cli.LoadConfigFile()
 		// Resolve the Auth config relevant for this server
-		authConfig := cli.configFile.ResolveAuthConfig(registry.IndexServerAddress())
+		authConfig, err := cli.configFile.GetAuthConfig(registry.IndexServerAddress())
+		if err != nil {
+			return nil, -1, err
+		}
 		getHeaders := func(authConfig registry.AuthConfig) (map[string][]string, error) {
 			buf, err := json.Marshal(authConfig)
 			if err != nil {
@@ -115,13 +118,49 @@ func (cli *DockerCli) stream(method, path string, in io.Reader, out io.Writer, h
 }
 
 func (cli *DockerCli) streamHelper(method, path string, setRawTerminal bool, in io.Reader, stdout, stderr io.Writer, headers map[string][]string) error {
+	resp, err := cli.streamRequest(method, path, in, headers)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if api.MatchesContentType(resp.Header.Get("Content-Type"), "application/json") {
+		return utils.DisplayJSONMessagesStream(resp.Body, stdout, cli.terminalFd, cli.isTerminal)
+	}
+	if stdout != nil || stderr != nil {
+		// When TTY is ON, use regular copy
+		if setRawTerminal {
+			_, err = io.Copy(stdout, resp.Body)
+		} else {
+			_, err = utils.StdCopy(stdout, stderr, resp.Body)
+		}
+		utils.Debugf("[stream] End of stdout")
+		return err
+	}
+	return nil
+}
+
+// streamJSON is like stream, but outputs the JSON messages of the response
+// as they are, one per line.
+func (cli *DockerCli) streamJSON(method, path string, in io.Reader, headers map[string][]string) error {
+	resp, err := cli.streamRequest(method, path, in, headers)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return utils.CopyJSONMessagesStream(resp.Body, cli.out)
+}
+
+// streamRequest sends a request whose response is streamed. Error statuses
+// are returned as errors.
+func (cli *DockerCli) streamRequest(method, path string, in io.Reader, headers map[string][]string) (*http.Response, error) {
 	if (method == "POST" || method == "PUT") && in == nil {
 		in = bytes.NewReader([]byte{})
 	}
 
 	req, err := http.NewRequest(method, fmt.Sprintf("http://v%s%s", api.APIVERSION, path), in)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	req.Header.Set("User-Agent", "Docker-Client/"+dockerversion.VERSION)
 	req.URL.Host = cli.addr
@@ -138,37 +177,23 @@ func (cli *DockerCli) streamHelper(method, path string, setRawTerminal bool, in
 	resp, err := cli.HTTPClient().Do(req)
 	if err != nil {
 		if strings.Contains(err.Error(), "connection refused") {
-			return fmt.Errorf("Cannot connect to the Docker daemon. Is 'docker -d' running on this host?")
+			return nil, fmt.Errorf("Cannot connect to the Docker daemon. Is 'docker -d' running on this host?")
 		}
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		defer resp.Body.Close()
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if len(body) == 0 {
-			return fmt.Errorf("Error :%s", http.StatusText(resp.StatusCode))
-		}
-		return fmt.Errorf("Error: %s", bytes.TrimSpace(body))
-	}
-
-	if api.MatchesContentType(resp.Header.Get("Content-Type"), "application/json") {
-		return utils.DisplayJSONMessagesStream(resp.Body, stdout, cli.terminalFd, cli.isTerminal)
-	}
-	if stdout != nil || stderr != nil {
-		// When TTY is ON, use regular copy
-		if setRawTerminal {
-			_, err = io.Copy(stdout, resp.Body)
-		} else {
-			_, err = utils.StdCopy(stdout, stderr, resp.Body)
+			return nil, fmt.Errorf("Error :%s", http.StatusText(resp.StatusCode))
 		}
-		utils.Debugf("[stream] End of stdout")
-		return err
+		return nil, fmt.Errorf("Error: %s", bytes.TrimSpace(body))
 	}
-	return nil
+	return resp, nil
 }
 
 func (cli *DockerCli) resizeTty(id string) {
@@ -497,8 +497,34 @@ func getImagesSearch(eng *engine.Engine, version version.Version, w http.Respons
 	var job = eng.Job("search", r.Form.Get("term"))
 	job.SetenvJson("metaHeaders", metaHeaders)
 	job.SetenvJson("authConfig", authConfig)
-	streamJSON(job, w, false)
+	if filters := r.Form.Get("filters"); filters != "" {
+		job.Setenv("filters", filters)
+	}
+	for _, key := range []string{"limit", "page"} {
+		if value := r.Form.Get(key); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("Invalid %s %q", key, value)
+			}
+			job.SetenvInt(key, n)
+		}
+	}
 
+	if version.LessThan("1.12") {
+		// All the results were sent as a list, without the pagination
+		job.SetenvBool("all", true)
+		out, err := job.Stdout.AddEnv()
+		if err != nil {
+			return err
+		}
+		if err := job.Run(); err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write([]byte(out.Get("results")))
+		return err
+	}
+	streamJSON(job, w, false)
 	return job.Run()
 }
 
@@ -901,6 +927,8 @@ func postBuild(eng *engine.Engine, version version.Version, w http.ResponseWrite
 	} else {
 		job.Stdout.Add(utils.NewWriteFlusher(w))
 	}
+	// Older clients would display build steps as empty lines
+	job.SetenvBool("buildsteps", version.GreaterThanOrEqualTo("1.12"))
 
 	if r.FormValue("forcerm") == "1" && version.GreaterThanOrEqualTo("1.12") {
 		job.Setenv("rm", "1")
@@ -915,9 +943,39 @@ func postBuild(eng *engine.Engine, version version.Version, w http.ResponseWrite
 	job.Setenv("q", r.FormValue("q"))
 	job.Setenv("nocache", r.FormValue("nocache"))
 	job.Setenv("forcerm", r.FormValue("forcerm"))
+	job.Setenv("target", r.FormValue("target"))
+	job.Setenv("dockerfile", r.FormValue("dockerfile"))
+	job.Setenv("squash", r.FormValue("squash"))
+	if cacheFrom := r.FormValue("cachefrom"); cacheFrom != "" {
+		var images []string
+		if err := json.Unmarshal([]byte(cacheFrom), &images); err != nil {
+			return err
+		}
+		job.SetenvList("cachefrom", images)
+	}
+	if ssh := r.FormValue("ssh"); ssh != "" {
+		// The daemon connects to the sockets of the agents itself
+		if !isLocalRequest(r) {
+			return fmt.Errorf("SSH agents can only be forwarded by the clients on the host of the daemon")
+		}
+		agents := make(map[string]string)
+		if err := json.Unmarshal([]byte(ssh), &agents); err != nil {
+			return err
+		}
+		job.SetenvJson("ssh", agents)
+	}
 	job.SetenvJson("authConfig", authConfig)
 	job.SetenvJson("configFile", configFile)
 
+	if secretsEncoded := r.Header.Get("X-Build-Secrets"); secretsEncoded != "" {
+		secrets := make(map[string][]byte)
+		secretsJson := base64.NewDecoder(base64.URLEncoding, strings.NewReader(secretsEncoded))
+		if err := json.NewDecoder(secretsJson).Decode(&secrets); err != nil {
+			return fmt.Errorf("Invalid X-Build-Secrets header: %s", err)
+		}
+		job.SetenvJson("secrets", secrets)
+	}
+
 	if err := job.Run(); err != nil {
 		if !job.Stdout.Used() {
 			return err
@@ -928,6 +986,18 @@ func postBuild(eng *engine.Engine, version version.Version, w http.ResponseWrite
 	return nil
 }
 
+// isLocalRequest returns whether r comes from the host of the daemon, through
+// its unix socket or the loopback interface.
+func isLocalRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// The requests through the unix socket have no address
+		return r.RemoteAddr == "" || r.RemoteAddr == "@"
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 func postContainersCopy(eng *engine.Engine, version version.Version, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if vars == nil {
 		return fmt.Errorf("Missing parameter")
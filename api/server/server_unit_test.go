@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/dotcloud/docker/api"
@@ -9,6 +10,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 )
 
@@ -114,6 +116,72 @@ func TestGetInfo(t *testing.T) {
 	}
 }
 
+func TestPostBuildSecrets(t *testing.T) {
+	eng := engine.New()
+	var secrets map[string][]byte
+	eng.Register("build", func(job *engine.Job) engine.Status {
+		if err := job.GetenvJson("secrets", &secrets); err != nil {
+			return job.Error(err)
+		}
+		return engine.StatusOK
+	})
+
+	buf, err := json.Marshal(map[string][]byte{"npmrc": []byte("token")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "/build", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Build-Secrets", base64.URLEncoding.EncodeToString(buf))
+	if err := ServeRequest(eng, api.APIVERSION, httptest.NewRecorder(), req); err != nil {
+		t.Fatal(err)
+	}
+	if string(secrets["npmrc"]) != "token" {
+		t.Fatalf("Expected the npmrc secret to be passed to the job, got %v", secrets)
+	}
+}
+
+func TestPostBuildSSH(t *testing.T) {
+	eng := engine.New()
+	var agents map[string]string
+	eng.Register("build", func(job *engine.Job) engine.Status {
+		if err := job.GetenvJson("ssh", &agents); err != nil {
+			return job.Error(err)
+		}
+		return engine.StatusOK
+	})
+
+	req, err := http.NewRequest("POST", "/build?ssh="+url.QueryEscape(`{"default":"/tmp/ssh-agent.sock"}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ServeRequest(eng, api.APIVERSION, httptest.NewRecorder(), req); err != nil {
+		t.Fatal(err)
+	}
+	if agents["default"] != "/tmp/ssh-agent.sock" {
+		t.Fatalf("Expected the default SSH agent to be passed to the job, got %v", agents)
+	}
+
+	// Only the local clients can forward their agents
+	for remoteAddr, expected := range map[string]int{"10.0.0.2:42042": http.StatusInternalServerError, "127.0.0.1:42042": http.StatusOK} {
+		agents = nil
+		req, err := http.NewRequest("POST", "/build?ssh="+url.QueryEscape(`{"default":"/tmp/ssh-agent.sock"}`), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = remoteAddr
+		r := httptest.NewRecorder()
+		if err := ServeRequest(eng, api.APIVERSION, r, req); err != nil {
+			t.Fatal(err)
+		}
+		if r.Code != expected {
+			t.Fatalf("Expected status %d forwarding an SSH agent from %s, got %d", expected, remoteAddr, r.Code)
+		}
+	}
+}
+
 func serveRequest(method, target string, body io.Reader, eng *engine.Engine, t *testing.T) *httptest.ResponseRecorder {
 	r := httptest.NewRecorder()
 	req, err := http.NewRequest(method, target, body)
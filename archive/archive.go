@@ -27,6 +27,7 @@ type (
 	Compression   int
 	TarOptions    struct {
 		Includes    []string
+		Excludes    []string
 		Compression Compression
 		NoLchown    bool
 	}
@@ -299,6 +300,7 @@ func escapeName(name string) string {
 // stream of bytes.
 //
 // Files are included according to `options.Includes`, default to including all files.
+// Files matching `options.Excludes`, as understood by utils.Matches, are left out.
 // Stream is compressed according to `options.Compression', default to Uncompressed.
 func TarFilter(srcPath string, options *TarOptions) (io.ReadCloser, error) {
 	pipeReader, pipeWriter := io.Pipe()
@@ -320,6 +322,15 @@ func TarFilter(srcPath string, options *TarOptions) (io.ReadCloser, error) {
 			options.Includes = []string{"."}
 		}
 
+		// Excluded directories can only be skipped as a whole if
+		// no pattern includes back some of their content
+		skipDirs := true
+		for _, exclude := range options.Excludes {
+			if strings.HasPrefix(exclude, "!") {
+				skipDirs = false
+			}
+		}
+
 		for _, include := range options.Includes {
 			filepath.Walk(filepath.Join(srcPath, include), func(filePath string, f os.FileInfo, err error) error {
 				if err != nil {
@@ -332,6 +343,16 @@ func TarFilter(srcPath string, options *TarOptions) (io.ReadCloser, error) {
 					return nil
 				}
 
+				if excluded, err := utils.Matches(relFilePath, options.Excludes); err != nil {
+					utils.Debugf("Error matching %s: %s\n", relFilePath, err)
+					return err
+				} else if excluded {
+					if f.IsDir() && skipDirs {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+
 				if err := addTarFile(filePath, relFilePath, tw); err != nil {
 					utils.Debugf("Can't add file %s to tar: %s\n", srcPath, err)
 				}
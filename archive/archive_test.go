@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"strings"
 	"testing"
 	"time"
 
@@ -128,6 +129,50 @@ func TestTarUntar(t *testing.T) {
 	}
 }
 
+func TestTarWithExcludes(t *testing.T) {
+	origin, err := ioutil.TempDir("", "docker-test-tar-excludes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(origin)
+	for _, name := range []string{"Dockerfile", "node_modules/foo/index.js", "debug.log", "logs/important.log"} {
+		if err := os.MkdirAll(path.Join(origin, path.Dir(name)), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(origin, name), []byte("hello world"), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for excludes, expected := range map[string][]string{
+		"node_modules,*.log":                   {"Dockerfile", "logs", "logs/important.log"},
+		"node_modules,logs,!logs/important.log": {"Dockerfile", "debug.log", "logs/important.log"},
+	} {
+		archive, err := TarFilter(origin, &TarOptions{Excludes: strings.Split(excludes, ",")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		tr := tar.NewReader(archive)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Name != "./" {
+				names = append(names, strings.TrimSuffix(hdr.Name, "/"))
+			}
+		}
+		archive.Close()
+		if strings.Join(names, ",") != strings.Join(expected, ",") {
+			t.Errorf("Expected %v with excludes %s, got %v", expected, excludes, names)
+		}
+	}
+}
+
 // Some tar archives such as http://haproxy.1wt.eu/download/1.5/src/devel/haproxy-1.5-dev21.tar.gz
 // use PAX Global Extended Headers.
 // Failing prevents the archives from being uncompressed during ADD
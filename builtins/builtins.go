@@ -5,6 +5,7 @@ import (
 
 	"github.com/dotcloud/docker/api"
 	apiserver "github.com/dotcloud/docker/api/server"
+	dockerdaemon "github.com/dotcloud/docker/daemon"
 	"github.com/dotcloud/docker/daemon/networkdriver/bridge"
 	"github.com/dotcloud/docker/dockerversion"
 	"github.com/dotcloud/docker/engine"
@@ -53,6 +54,9 @@ func daemon(eng *engine.Engine) error {
 	if err := eng.Register("initserver", server.InitServer); err != nil {
 		return err
 	}
+	if err := eng.Register("migrate_storage", dockerdaemon.MigrateStorage); err != nil {
+		return err
+	}
 	return eng.Register("init_networkdriver", bridge.InitDriver)
 }
 
@@ -754,6 +754,28 @@ func (container *Container) GetSize() (int64, int64) {
 	return sizeRw, sizeRootfs
 }
 
+type StorageUsage struct {
+	Used  int64
+	Limit int64
+}
+
+// GetStorageUsage returns the space used by the writable layer of a
+// container created with a size limit, or nil if it is unbounded.
+func (container *Container) GetStorageUsage() (*StorageUsage, error) {
+	if container.Config == nil || container.Config.StorageOpt["size"] == "" {
+		return nil, nil
+	}
+	sizer, ok := container.daemon.driver.(graphdriver.Sizer)
+	if !ok {
+		return nil, nil
+	}
+	used, limit, err := sizer.Usage(container.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &StorageUsage{Used: used, Limit: limit}, nil
+}
+
 func (container *Container) Copy(resource string) (io.ReadCloser, error) {
 	if err := container.Mount(); err != nil {
 		return nil, err
@@ -32,6 +32,7 @@ import (
 	"github.com/dotcloud/docker/pkg/networkfs/resolvconf"
 	"github.com/dotcloud/docker/pkg/selinux"
 	"github.com/dotcloud/docker/pkg/sysinfo"
+	"github.com/dotcloud/docker/pkg/units"
 	"github.com/dotcloud/docker/runconfig"
 	"github.com/dotcloud/docker/utils"
 )
@@ -406,10 +407,14 @@ func (daemon *Daemon) Create(config *runconfig.Config, name string) (*Container,
 	if warnings, err = daemon.mergeAndVerifyConfig(config, img); err != nil {
 		return nil, nil, err
 	}
+	size, err := daemon.verifyStorageOpt(config)
+	if err != nil {
+		return nil, nil, err
+	}
 	if container, err = daemon.newContainer(name, config, img); err != nil {
 		return nil, nil, err
 	}
-	if err := daemon.createRootfs(container, img); err != nil {
+	if err := daemon.createRootfs(container, img, size); err != nil {
 		return nil, nil, err
 	}
 	if err := container.ToDisk(); err != nil {
@@ -463,6 +468,32 @@ func (daemon *Daemon) mergeAndVerifyConfig(config *runconfig.Config, img *image.
 	return warnings, nil
 }
 
+// verifyStorageOpt checks that the storage driver can honor the storage
+// options of the container, and returns the requested size of its writable
+// layer, or 0 if it is unbounded.
+func (daemon *Daemon) verifyStorageOpt(config *runconfig.Config) (int64, error) {
+	var size int64
+	for k, v := range config.StorageOpt {
+		switch k {
+		case "size":
+			s, err := units.RAMInBytes(v)
+			if err != nil {
+				return 0, fmt.Errorf("Invalid storage size %s: %s", v, err)
+			}
+			if s <= 0 {
+				return 0, fmt.Errorf("Invalid storage size %s: must be positive", v)
+			}
+			if _, ok := daemon.driver.(graphdriver.Sizer); !ok {
+				return 0, fmt.Errorf("The %s storage driver does not support the size storage option", daemon.driver)
+			}
+			size = s
+		default:
+			return 0, fmt.Errorf("Unknown storage option %s", k)
+		}
+	}
+	return size, nil
+}
+
 func (daemon *Daemon) generateIdAndName(name string) (string, string, error) {
 	var (
 		err error
@@ -566,7 +597,7 @@ func (daemon *Daemon) newContainer(name string, config *runconfig.Config, img *i
 	return container, nil
 }
 
-func (daemon *Daemon) createRootfs(container *Container, img *image.Image) error {
+func (daemon *Daemon) createRootfs(container *Container, img *image.Image, size int64) error {
 	// Step 1: create the container directory.
 	// This doubles as a barrier to avoid race conditions.
 	if err := os.Mkdir(container.root, 0700); err != nil {
@@ -586,7 +617,12 @@ func (daemon *Daemon) createRootfs(container *Container, img *image.Image) error
 		return err
 	}
 
-	if err := daemon.driver.Create(container.ID, initID); err != nil {
+	if size > 0 {
+		// verifyStorageOpt already made sure the driver supports it
+		if err := daemon.driver.(graphdriver.Sizer).CreateWithSize(container.ID, initID, size); err != nil {
+			return err
+		}
+	} else if err := daemon.driver.Create(container.ID, initID); err != nil {
 		return err
 	}
 	return nil
@@ -742,7 +778,7 @@ func NewDaemonFromDirectory(config *daemonconfig.Config, eng *engine.Engine) (*D
 	graphdriver.DefaultDriver = config.GraphDriver
 
 	// Load storage driver
-	driver, err := graphdriver.New(config.Root)
+	driver, err := graphdriver.New(config.Root, config.GraphOptions)
 	if err != nil {
 		return nil, err
 	}
@@ -771,7 +807,7 @@ func NewDaemonFromDirectory(config *daemonconfig.Config, eng *engine.Engine) (*D
 
 	// We don't want to use a complex driver like aufs or devmapper
 	// for volumes, just a plain filesystem
-	volumesDriver, err := graphdriver.GetDriver("vfs", config.Root)
+	volumesDriver, err := graphdriver.GetDriver("vfs", config.Root, nil)
 	if err != nil {
 		return nil, err
 	}
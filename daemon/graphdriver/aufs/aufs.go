@@ -51,11 +51,14 @@ type Driver struct {
 
 // New returns a new AUFS driver.
 // An error is returned if AUFS is not supported.
-func Init(root string) (graphdriver.Driver, error) {
+func Init(root string, options []string) (graphdriver.Driver, error) {
 	// Try to load the aufs kernel module
 	if err := supportsAufs(); err != nil {
 		return nil, graphdriver.ErrNotSupported
 	}
+	if err := graphdriver.NoOptions("aufs", options); err != nil {
+		return nil, err
+	}
 	paths := []string{
 		"mnt",
 		"diff",
@@ -10,10 +10,15 @@ package btrfs
 import "C"
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"github.com/dotcloud/docker/daemon/graphdriver"
 	"os"
+	"os/exec"
 	"path"
+	"strconv"
+	"strings"
 	"syscall"
 	"unsafe"
 )
@@ -22,7 +27,7 @@ func init() {
 	graphdriver.Register("btrfs", Init)
 }
 
-func Init(home string) (graphdriver.Driver, error) {
+func Init(home string, options []string) (graphdriver.Driver, error) {
 	rootdir := path.Dir(home)
 
 	var buf syscall.Statfs_t
@@ -33,6 +38,9 @@ func Init(home string) (graphdriver.Driver, error) {
 	if buf.Type != 0x9123683E {
 		return nil, graphdriver.ErrNotSupported
 	}
+	if err := graphdriver.NoOptions("btrfs", options); err != nil {
+		return nil, err
+	}
 
 	return &Driver{
 		home: home,
@@ -176,6 +184,62 @@ func (d *Driver) Create(id string, parent string) error {
 	return nil
 }
 
+// CreateWithSize creates a new subvolume like Create, and bounds it with a
+// qgroup limit on the data it references.
+func (d *Driver) CreateWithSize(id, parent string, size int64) error {
+	if err := d.Create(id, parent); err != nil {
+		return err
+	}
+	if err := d.enableQuota(); err != nil {
+		d.Remove(id)
+		return err
+	}
+	if output, err := exec.Command("btrfs", "qgroup", "limit", strconv.FormatInt(size, 10), d.subvolumesDirId(id)).CombinedOutput(); err != nil {
+		d.Remove(id)
+		return fmt.Errorf("Failed to set btrfs qgroup limit: %s (%s)", err, output)
+	}
+	return nil
+}
+
+func (d *Driver) enableQuota() error {
+	if output, err := exec.Command("btrfs", "quota", "enable", d.subvolumesDir()).CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to enable btrfs quota: %s (%s)", err, output)
+	}
+	return nil
+}
+
+func (d *Driver) Usage(id string) (used, limit int64, err error) {
+	dir := d.subvolumesDirId(id)
+
+	output, err := exec.Command("btrfs", "inspect-internal", "rootid", dir).CombinedOutput()
+	if err != nil {
+		return 0, 0, fmt.Errorf("Failed to lookup btrfs subvolume id: %s (%s)", err, output)
+	}
+	qgroupId := "0/" + strings.TrimSpace(string(output))
+
+	if output, err = exec.Command("btrfs", "qgroup", "show", "-r", "--raw", dir).CombinedOutput(); err != nil {
+		return 0, 0, fmt.Errorf("Failed to read btrfs qgroups: %s (%s)", err, output)
+	}
+
+	// Each qgroup is listed as "<qgroupid> <rfer> <excl> <max_rfer>"
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] != qgroupId {
+			continue
+		}
+		if used, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return 0, 0, err
+		}
+		// An unbounded qgroup reports its limit as "none"
+		if limit, err = strconv.ParseInt(fields[3], 10, 64); err != nil {
+			limit = 0
+		}
+		return used, limit, nil
+	}
+	return 0, 0, fmt.Errorf("No btrfs qgroup found for %s", id)
+}
+
 func (d *Driver) Remove(id string) error {
 	dir := d.subvolumesDirId(id)
 	if _, err := os.Stat(dir); err != nil {
@@ -13,11 +13,13 @@ import (
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/dotcloud/docker/pkg/label"
+	"github.com/dotcloud/docker/pkg/units"
 	"github.com/dotcloud/docker/utils"
 )
 
@@ -25,6 +27,8 @@ var (
 	DefaultDataLoopbackSize     int64  = 100 * 1024 * 1024 * 1024
 	DefaultMetaDataLoopbackSize int64  = 2 * 1024 * 1024 * 1024
 	DefaultBaseFsSize           uint64 = 10 * 1024 * 1024 * 1024
+	DefaultThinpBlockSize       uint32 = 128 // 64K = 128 512b sectors
+	DefaultFilesystem                  = "ext4"
 )
 
 type DevInfo struct {
@@ -33,6 +37,7 @@ type DevInfo struct {
 	Size          uint64     `json:"size"`
 	TransactionId uint64     `json:"transaction_id"`
 	Initialized   bool       `json:"initialized"`
+	Filesystem    string     `json:"filesystem,omitempty"`
 	devices       *DeviceSet `json:"-"`
 
 	mountCount int    `json:"-"`
@@ -64,6 +69,14 @@ type DeviceSet struct {
 	TransactionId    uint64
 	NewTransactionId uint64
 	nextDeviceId     int
+
+	// Options
+	baseFsSize     uint64
+	filesystem     string
+	dataDevice     string
+	metadataDevice string
+	thinPoolDevice string
+	thinpBlockSize uint32
 }
 
 type DiskUsage struct {
@@ -105,6 +118,28 @@ func (info *DevInfo) DevName() string {
 	return getDevName(info.Name())
 }
 
+// fsType returns the type of the filesystem of the device. Devices
+// created before the filesystem was recorded are ext4.
+func (info *DevInfo) fsType() string {
+	if info.Filesystem == "" {
+		return "ext4"
+	}
+	return info.Filesystem
+}
+
+// mountOptions returns the options needed to mount the filesystem of
+// the device, on top of the given ones.
+func (info *DevInfo) mountOptions(options string) string {
+	if info.fsType() != "xfs" {
+		return options
+	}
+	// All the snapshots of the base device share its xfs uuid
+	if options == "" {
+		return "nouuid"
+	}
+	return options + ",nouuid"
+}
+
 func (devices *DeviceSet) loopbackDir() string {
 	return path.Join(devices.root, "devicemapper")
 }
@@ -126,6 +161,9 @@ func (devices *DeviceSet) oldMetadataFile() string {
 }
 
 func (devices *DeviceSet) getPoolName() string {
+	if devices.thinPoolDevice != "" {
+		return devices.thinPoolDevice
+	}
 	return devices.devicePrefix + "-pool"
 }
 
@@ -234,7 +272,7 @@ func (devices *DeviceSet) lookupDevice(hash string) (*DevInfo, error) {
 	return info, nil
 }
 
-func (devices *DeviceSet) registerDevice(id int, hash string, size uint64) (*DevInfo, error) {
+func (devices *DeviceSet) registerDevice(id int, hash string, size uint64, filesystem string) (*DevInfo, error) {
 	utils.Debugf("registerDevice(%v, %v)", id, hash)
 	info := &DevInfo{
 		Hash:          hash,
@@ -242,6 +280,7 @@ func (devices *DeviceSet) registerDevice(id int, hash string, size uint64) (*Dev
 		Size:          size,
 		TransactionId: devices.allocateTransactionId(),
 		Initialized:   false,
+		Filesystem:    filesystem,
 		devices:       devices,
 	}
 
@@ -273,9 +312,17 @@ func (devices *DeviceSet) activateDeviceIfNeeded(info *DevInfo) error {
 func (devices *DeviceSet) createFilesystem(info *DevInfo) error {
 	devname := info.DevName()
 
-	err := exec.Command("mkfs.ext4", "-E", "nodiscard,lazy_itable_init=0,lazy_journal_init=0", devname).Run()
-	if err != nil {
-		err = exec.Command("mkfs.ext4", "-E", "nodiscard,lazy_itable_init=0", devname).Run()
+	var err error
+	switch info.fsType() {
+	case "xfs":
+		err = exec.Command("mkfs.xfs", "-f", "-K", devname).Run()
+	case "ext4":
+		err = exec.Command("mkfs.ext4", "-E", "nodiscard,lazy_itable_init=0,lazy_journal_init=0", devname).Run()
+		if err != nil {
+			err = exec.Command("mkfs.ext4", "-E", "nodiscard,lazy_itable_init=0", devname).Run()
+		}
+	default:
+		err = fmt.Errorf("Unsupported filesystem type %s", info.fsType())
 	}
 	if err != nil {
 		utils.Debugf("\n--->Err: %s\n", err)
@@ -353,6 +400,14 @@ func (devices *DeviceSet) loadMetadata(hash string) *DevInfo {
 func (devices *DeviceSet) setupBaseImage() error {
 	oldInfo, _ := devices.lookupDevice("")
 	if oldInfo != nil && oldInfo.Initialized {
+		// The base device can't be changed once created, as all
+		// the images and containers are snapshots of it
+		if devices.filesystem != "" && devices.filesystem != oldInfo.fsType() {
+			return fmt.Errorf("Base device already has a %s filesystem, it can't be changed to %s", oldInfo.fsType(), devices.filesystem)
+		}
+		if devices.baseFsSize != 0 && devices.baseFsSize != oldInfo.Size {
+			return fmt.Errorf("Base device already has a size of %d bytes, it can't be changed to %d", oldInfo.Size, devices.baseFsSize)
+		}
 		return nil
 	}
 
@@ -377,8 +432,17 @@ func (devices *DeviceSet) setupBaseImage() error {
 	// Ids are 24bit, so wrap around
 	devices.nextDeviceId = (id + 1) & 0xffffff
 
-	utils.Debugf("Registering base device (id %v) with FS size %v", id, DefaultBaseFsSize)
-	info, err := devices.registerDevice(id, "", DefaultBaseFsSize)
+	size := devices.baseFsSize
+	if size == 0 {
+		size = DefaultBaseFsSize
+	}
+	filesystem := devices.filesystem
+	if filesystem == "" {
+		filesystem = DefaultFilesystem
+	}
+
+	utils.Debugf("Registering base device (id %v) with FS size %v", id, size)
+	info, err := devices.registerDevice(id, "", size, filesystem)
 	if err != nil {
 		_ = deleteDevice(devices.getPoolDevName(), id)
 		utils.Debugf("\n--->Err: %s\n", err)
@@ -438,6 +502,10 @@ func minor(device uint64) uint64 {
 }
 
 func (devices *DeviceSet) ResizePool(size int64) error {
+	if devices.dataDevice != "" || devices.thinPoolDevice != "" {
+		return fmt.Errorf("Can't resize a pool which isn't backed by loopback files")
+	}
+
 	dirname := devices.loopbackDir()
 	datafilename := path.Join(dirname, "data")
 	metadatafilename := path.Join(dirname, "metadata")
@@ -491,7 +559,7 @@ func (devices *DeviceSet) ResizePool(size int64) error {
 	}
 
 	// Reload with the new block sizes
-	if err := reloadPool(devices.getPoolName(), dataloopback, metadataloopback); err != nil {
+	if err := reloadPool(devices.getPoolName(), dataloopback, metadataloopback, devices.thinpBlockSize); err != nil {
 		return fmt.Errorf("Unable to reload pool: %s", err)
 	}
 
@@ -539,13 +607,35 @@ func (devices *DeviceSet) initDevmapper(doInit bool) error {
 	// so we add this badhack to make sure it closes itself
 	setCloseOnExec("/dev/mapper/control")
 
-	// Make sure the sparse images exist in <root>/devicemapper/data and
-	// <root>/devicemapper/metadata
-
 	createdLoopback := false
 
-	// If the pool doesn't exist, create it
-	if info.Exists == 0 {
+	if devices.thinPoolDevice != "" {
+		// The pool is managed by the admin, e.g. with lvm
+		if info.Exists == 0 {
+			return fmt.Errorf("Thin pool device %s doesn't exist", devices.thinPoolDevice)
+		}
+	} else if info.Exists == 0 && devices.dataDevice != "" {
+		utils.Debugf("Pool doesn't exist. Creating it on %s and %s.", devices.dataDevice, devices.metadataDevice)
+
+		dataFile, err := os.OpenFile(devices.dataDevice, os.O_RDWR, 0600)
+		if err != nil {
+			return err
+		}
+		defer dataFile.Close()
+
+		metadataFile, err := os.OpenFile(devices.metadataDevice, os.O_RDWR, 0600)
+		if err != nil {
+			return err
+		}
+		defer metadataFile.Close()
+
+		if err := createPool(devices.getPoolName(), dataFile, metadataFile, devices.thinpBlockSize); err != nil {
+			utils.Debugf("\n--->Err: %s\n", err)
+			return err
+		}
+	} else if info.Exists == 0 {
+		// Make sure the sparse images exist in <root>/devicemapper/data and
+		// <root>/devicemapper/metadata, and create the pool on top of them
 		utils.Debugf("Pool doesn't exist. Creating it.")
 
 		hasData := devices.hasImage("data")
@@ -585,7 +675,7 @@ func (devices *DeviceSet) initDevmapper(doInit bool) error {
 		}
 		defer metadataFile.Close()
 
-		if err := createPool(devices.getPoolName(), dataFile, metadataFile); err != nil {
+		if err := createPool(devices.getPoolName(), dataFile, metadataFile, devices.thinpBlockSize); err != nil {
 			utils.Debugf("\n--->Err: %s\n", err)
 			return err
 		}
@@ -611,12 +701,20 @@ func (devices *DeviceSet) initDevmapper(doInit bool) error {
 	return nil
 }
 
-func (devices *DeviceSet) AddDevice(hash, baseHash string) error {
+// AddDevice creates a new thin snapshot of baseHash. If size is non-zero,
+// the new device and its filesystem are grown to size bytes.
+func (devices *DeviceSet) AddDevice(hash, baseHash string, size uint64) error {
 	baseInfo, err := devices.lookupDevice(baseHash)
 	if err != nil {
 		return err
 	}
 
+	if size == 0 {
+		size = baseInfo.Size
+	} else if size < baseInfo.Size {
+		return fmt.Errorf("device %s can't be smaller than its base (%d < %d bytes)", hash, size, baseInfo.Size)
+	}
+
 	baseInfo.lock.Lock()
 	defer baseInfo.lock.Unlock()
 
@@ -637,11 +735,63 @@ func (devices *DeviceSet) AddDevice(hash, baseHash string) error {
 	// Ids are 24bit, so wrap around
 	devices.nextDeviceId = (deviceId + 1) & 0xffffff
 
-	if _, err := devices.registerDevice(deviceId, hash, baseInfo.Size); err != nil {
+	info, err := devices.registerDevice(deviceId, hash, size, baseInfo.Filesystem)
+	if err != nil {
 		deleteDevice(devices.getPoolDevName(), deviceId)
 		utils.Debugf("Error registering device: %s\n", err)
 		return err
 	}
+
+	if size > baseInfo.Size {
+		if err := devices.growFs(info); err != nil {
+			devices.deleteDevice(info)
+			return err
+		}
+	}
+	return nil
+}
+
+// growFs resizes the filesystem of an unmounted device to fill it.
+func (devices *DeviceSet) growFs(info *DevInfo) error {
+	if err := devices.activateDeviceIfNeeded(info); err != nil {
+		return fmt.Errorf("Error activating devmapper device for '%s': %s", info.Hash, err)
+	}
+
+	devname := info.DevName()
+
+	if info.fsType() == "xfs" {
+		return devices.growXfs(info)
+	}
+
+	// resize2fs refuses to touch a filesystem which wasn't checked since its last mount
+	if output, err := exec.Command("e2fsck", "-f", "-y", devname).CombinedOutput(); err != nil {
+		return fmt.Errorf("Error checking filesystem on %s: %s (%s)", devname, err, output)
+	}
+	if output, err := exec.Command("resize2fs", devname).CombinedOutput(); err != nil {
+		return fmt.Errorf("Error resizing filesystem on %s: %s (%s)", devname, err, output)
+	}
+	return nil
+}
+
+// growXfs resizes the xfs filesystem of a device, which can only be
+// done while it is mounted.
+func (devices *DeviceSet) growXfs(info *DevInfo) error {
+	devname := info.DevName()
+
+	tmpDir, err := ioutil.TempDir(devices.root, "growfs")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpDir)
+
+	if err := syscall.Mount(devname, tmpDir, "xfs", syscall.MS_MGC_VAL, info.mountOptions("")); err != nil {
+		return fmt.Errorf("Error mounting '%s' on '%s': %s", devname, tmpDir, err)
+	}
+	defer syscall.Unmount(tmpDir, 0)
+
+	if output, err := exec.Command("xfs_growfs", tmpDir).CombinedOutput(); err != nil {
+		return fmt.Errorf("Error resizing filesystem on %s: %s (%s)", devname, err, output)
+	}
 	return nil
 }
 
@@ -871,11 +1021,14 @@ func (devices *DeviceSet) Shutdown() error {
 		info.lock.Unlock()
 	}
 
-	devices.Lock()
-	if err := devices.deactivatePool(); err != nil {
-		utils.Debugf("Shutdown deactivate pool , error: %s\n", err)
+	// Leave a pool which isn't ours alone
+	if devices.thinPoolDevice == "" {
+		devices.Lock()
+		if err := devices.deactivatePool(); err != nil {
+			utils.Debugf("Shutdown deactivate pool , error: %s\n", err)
+		}
+		devices.Unlock()
 	}
-	devices.Unlock()
 
 	return nil
 }
@@ -907,11 +1060,11 @@ func (devices *DeviceSet) MountDevice(hash, path, mountLabel string) error {
 
 	var flags uintptr = syscall.MS_MGC_VAL
 
-	mountOptions := label.FormatMountLabel("discard", mountLabel)
-	err = syscall.Mount(info.DevName(), path, "ext4", flags, mountOptions)
+	mountOptions := label.FormatMountLabel(info.mountOptions("discard"), mountLabel)
+	err = syscall.Mount(info.DevName(), path, info.fsType(), flags, mountOptions)
 	if err != nil && err == syscall.EINVAL {
-		mountOptions = label.FormatMountLabel("", mountLabel)
-		err = syscall.Mount(info.DevName(), path, "ext4", flags, mountOptions)
+		mountOptions = label.FormatMountLabel(info.mountOptions(""), mountLabel)
+		err = syscall.Mount(info.DevName(), path, info.fsType(), flags, mountOptions)
 	}
 	if err != nil {
 		return fmt.Errorf("Error mounting '%s' on '%s': %s", info.DevName(), path, err)
@@ -1063,8 +1216,13 @@ func (devices *DeviceSet) Status() *Status {
 	status := &Status{}
 
 	status.PoolName = devices.getPoolName()
-	status.DataLoopback = path.Join(devices.loopbackDir(), "data")
-	status.MetadataLoopback = path.Join(devices.loopbackDir(), "metadata")
+	if devices.dataDevice != "" {
+		status.DataLoopback = devices.dataDevice
+		status.MetadataLoopback = devices.metadataDevice
+	} else if devices.thinPoolDevice == "" {
+		status.DataLoopback = path.Join(devices.loopbackDir(), "data")
+		status.MetadataLoopback = path.Join(devices.loopbackDir(), "metadata")
+	}
 
 	totalSizeInSectors, _, dataUsed, dataTotal, metadataUsed, metadataTotal, err := devices.poolStatus()
 	if err == nil {
@@ -1084,12 +1242,89 @@ func (devices *DeviceSet) Status() *Status {
 	return status
 }
 
-func NewDeviceSet(root string, doInit bool) (*DeviceSet, error) {
+// isBlockDevice returns an error if path isn't a block device.
+func isBlockDevice(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeDevice == 0 || fi.Mode()&os.ModeCharDevice != 0 {
+		return fmt.Errorf("%s is not a block device", path)
+	}
+	return nil
+}
+
+func (devices *DeviceSet) parseOptions(options []string) error {
+	for _, option := range options {
+		key, val, err := utils.ParseKeyValueOpt(option)
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(key) {
+		case "dm.basesize":
+			size, err := units.RAMInBytes(val)
+			if err != nil {
+				return err
+			}
+			if size <= 0 {
+				return fmt.Errorf("Invalid base device size: %s", val)
+			}
+			devices.baseFsSize = uint64(size)
+		case "dm.fs":
+			if val != "ext4" && val != "xfs" {
+				return fmt.Errorf("Unsupported filesystem %s, must be ext4 or xfs", val)
+			}
+			devices.filesystem = val
+		case "dm.datadev":
+			if err := isBlockDevice(val); err != nil {
+				return err
+			}
+			devices.dataDevice = val
+		case "dm.metadatadev":
+			if err := isBlockDevice(val); err != nil {
+				return err
+			}
+			devices.metadataDevice = val
+		case "dm.thinpooldev":
+			devices.thinPoolDevice = strings.TrimPrefix(val, "/dev/mapper/")
+			if devices.thinPoolDevice == "" {
+				return fmt.Errorf("Invalid thin pool device: %s", val)
+			}
+		case "dm.blocksize":
+			size, err := units.RAMInBytes(val)
+			if err != nil {
+				return err
+			}
+			// Thin pool block sizes are multiples of 64K, up to 1G
+			if size < 64*1024 || size > 1024*1024*1024 || size%(64*1024) != 0 {
+				return fmt.Errorf("Invalid block size %s, must be a multiple of 64K between 64K and 1G", val)
+			}
+			devices.thinpBlockSize = uint32(size / 512)
+		default:
+			return fmt.Errorf("Unknown option %s", key)
+		}
+	}
+
+	if (devices.dataDevice == "") != (devices.metadataDevice == "") {
+		return fmt.Errorf("dm.datadev and dm.metadatadev must be used together")
+	}
+	if devices.thinPoolDevice != "" && devices.dataDevice != "" {
+		return fmt.Errorf("dm.thinpooldev can't be used with dm.datadev and dm.metadatadev")
+	}
+	return nil
+}
+
+func NewDeviceSet(root string, doInit bool, options []string) (*DeviceSet, error) {
 	SetDevDir("/dev")
 
 	devices := &DeviceSet{
-		root:     root,
-		MetaData: MetaData{Devices: make(map[string]*DevInfo)},
+		root:           root,
+		MetaData:       MetaData{Devices: make(map[string]*DevInfo)},
+		thinpBlockSize: DefaultThinpBlockSize,
+	}
+
+	if err := devices.parseOptions(options); err != nil {
+		return nil, err
 	}
 
 	if err := devices.initDevmapper(doInit); err != nil {
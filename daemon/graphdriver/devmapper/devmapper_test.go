@@ -32,6 +32,45 @@ func TestDevmapperCreateSnap(t *testing.T) {
 	graphtest.DriverTestCreateSnap(t, "devicemapper")
 }
 
+func TestDevmapperCreateWithSize(t *testing.T) {
+	graphtest.DriverTestCreateWithSize(t, "devicemapper")
+}
+
 func TestDevmapperTeardown(t *testing.T) {
 	graphtest.PutDriver(t)
 }
+
+func TestDevmapperParseOptions(t *testing.T) {
+	devices := &DeviceSet{thinpBlockSize: DefaultThinpBlockSize}
+	if err := devices.parseOptions([]string{"dm.basesize=20G", "dm.fs=xfs", "dm.blocksize=512K", "dm.thinpooldev=/dev/mapper/docker-pool"}); err != nil {
+		t.Fatal(err)
+	}
+	if devices.baseFsSize != 20*1024*1024*1024 {
+		t.Fatalf("Expected base size of 20G, got %d", devices.baseFsSize)
+	}
+	if devices.filesystem != "xfs" {
+		t.Fatalf("Expected xfs, got %s", devices.filesystem)
+	}
+	if devices.thinpBlockSize != 1024 {
+		t.Fatalf("Expected a block size of 1024 sectors, got %d", devices.thinpBlockSize)
+	}
+	if devices.getPoolName() != "docker-pool" {
+		t.Fatalf("Expected pool docker-pool, got %s", devices.getPoolName())
+	}
+
+	for _, options := range [][]string{
+		{"dm.unknown=1"},
+		{"dm.basesize"},
+		{"dm.basesize=0"},
+		{"dm.fs=btrfs"},
+		{"dm.blocksize=32K"},
+		{"dm.blocksize=100K"},
+		{"dm.blocksize=2G"},
+		{"dm.datadev=/dev/null", "dm.metadatadev=/dev/null"},
+		{"dm.thinpooldev="},
+	} {
+		if err := (&DeviceSet{}).parseOptions(options); err == nil {
+			t.Fatalf("Expected an error for %v", options)
+		}
+	}
+}
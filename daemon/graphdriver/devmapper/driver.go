@@ -26,8 +26,8 @@ type Driver struct {
 	home string
 }
 
-func Init(home string) (graphdriver.Driver, error) {
-	deviceSet, err := NewDeviceSet(home, true)
+func Init(home string, options []string) (graphdriver.Driver, error) {
+	deviceSet, err := NewDeviceSet(home, true, options)
 	if err != nil {
 		return nil, err
 	}
@@ -47,13 +47,20 @@ func (d *Driver) Status() [][2]string {
 
 	status := [][2]string{
 		{"Pool Name", s.PoolName},
-		{"Data file", s.DataLoopback},
-		{"Metadata file", s.MetadataLoopback},
+	}
+	// A thin pool device set up by the admin has no data and metadata files
+	if s.DataLoopback != "" {
+		status = append(status,
+			[2]string{"Data file", s.DataLoopback},
+			[2]string{"Metadata file", s.MetadataLoopback},
+		)
+	}
+	status = append(status, [][2]string{
 		{"Data Space Used", fmt.Sprintf("%.1f Mb", float64(s.Data.Used)/(1024*1024))},
 		{"Data Space Total", fmt.Sprintf("%.1f Mb", float64(s.Data.Total)/(1024*1024))},
 		{"Metadata Space Used", fmt.Sprintf("%.1f Mb", float64(s.Metadata.Used)/(1024*1024))},
 		{"Metadata Space Total", fmt.Sprintf("%.1f Mb", float64(s.Metadata.Total)/(1024*1024))},
-	}
+	}...)
 	return status
 }
 
@@ -62,13 +69,28 @@ func (d *Driver) Cleanup() error {
 }
 
 func (d *Driver) Create(id, parent string) error {
-	if err := d.DeviceSet.AddDevice(id, parent); err != nil {
+	if err := d.DeviceSet.AddDevice(id, parent, 0); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+func (d *Driver) CreateWithSize(id, parent string, size int64) error {
+	if size <= 0 {
+		return fmt.Errorf("Invalid size %d for device %s", size, id)
+	}
+	return d.DeviceSet.AddDevice(id, parent, uint64(size))
+}
+
+func (d *Driver) Usage(id string) (used, limit int64, err error) {
+	status, err := d.DeviceSet.GetDeviceStatus(id)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int64(status.MappedSectors * 512), int64(status.Size), nil
+}
+
 func (d *Driver) Remove(id string) error {
 	if !d.DeviceSet.HasDevice(id) {
 		// Consider removing a non-existing device a no-op
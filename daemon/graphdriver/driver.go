@@ -4,11 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/utils"
 	"os"
 	"path"
 )
 
-type InitFunc func(root string) (Driver, error)
+type InitFunc func(root string, options []string) (Driver, error)
 
 type Driver interface {
 	String() string
@@ -32,6 +33,16 @@ type Differ interface {
 	DiffSize(id string) (bytes int64, err error)
 }
 
+// Sizer is implemented by drivers which can bound the size of a
+// container's writable layer.
+type Sizer interface {
+	// CreateWithSize is like Create, but limits the new layer to size bytes.
+	CreateWithSize(id, parent string, size int64) error
+	// Usage returns the number of bytes used by the layer, and its limit.
+	// A limit of 0 means the layer is not bounded.
+	Usage(id string) (used, limit int64, err error)
+}
+
 var (
 	DefaultDriver string
 	// All registred drivers
@@ -39,6 +50,7 @@ var (
 	// Slice of drivers that should be used in an order
 	priority = []string{
 		"aufs",
+		"overlay",
 		"btrfs",
 		"devicemapper",
 		"vfs",
@@ -60,23 +72,36 @@ func Register(name string, initFunc InitFunc) error {
 	return nil
 }
 
-func GetDriver(name, home string) (Driver, error) {
+func GetDriver(name, home string, options []string) (Driver, error) {
 	if initFunc, exists := drivers[name]; exists {
-		return initFunc(path.Join(home, name))
+		return initFunc(path.Join(home, name), options)
 	}
 	return nil, ErrNotSupported
 }
 
-func New(root string) (driver Driver, err error) {
+// NoOptions returns an error if storage options are given to the driver
+// name, which doesn't take any.
+func NoOptions(name string, options []string) error {
+	if len(options) == 0 {
+		return nil
+	}
+	key, _, err := utils.ParseKeyValueOpt(options[0])
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("Unknown option %s for the %s storage driver", key, name)
+}
+
+func New(root string, options []string) (driver Driver, err error) {
 	for _, name := range []string{os.Getenv("DOCKER_DRIVER"), DefaultDriver} {
 		if name != "" {
-			return GetDriver(name, root)
+			return GetDriver(name, root, options)
 		}
 	}
 
 	// Check for priority drivers first
 	for _, name := range priority {
-		driver, err = GetDriver(name, root)
+		driver, err = GetDriver(name, root, options)
 		if err != nil {
 			if err == ErrNotSupported {
 				continue
@@ -88,7 +113,7 @@ func New(root string) (driver Driver, err error) {
 
 	// Check all registered drivers if no priority driver is found
 	for _, initFunc := range drivers {
-		if driver, err = initFunc(root); err != nil {
+		if driver, err = initFunc(root, options); err != nil {
 			if err == ErrNotSupported {
 				continue
 			}
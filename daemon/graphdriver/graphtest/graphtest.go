@@ -29,7 +29,7 @@ func newDriver(t *testing.T, name string) *Driver {
 		t.Fatal(err)
 	}
 
-	d, err := graphdriver.GetDriver(name, root)
+	d, err := graphdriver.GetDriver(name, root, nil)
 	if err != nil {
 		if err == graphdriver.ErrNotSupported {
 			t.Skip("Driver %s not supported", name)
@@ -226,3 +226,41 @@ func DriverTestCreateSnap(t *testing.T, drivername string) {
 		t.Fatal(err)
 	}
 }
+
+func DriverTestCreateWithSize(t *testing.T, drivername string) {
+	driver := GetDriver(t, drivername)
+	defer PutDriver(t)
+
+	sizer, ok := driver.(*Driver).Driver.(graphdriver.Sizer)
+	if !ok {
+		t.Skipf("Driver %s doesn't support sized layers", drivername)
+	}
+
+	createBase(t, driver, "Base")
+
+	size := int64(400 * 1024 * 1024)
+	if err := sizer.CreateWithSize("Sized", "Base", size); err != nil {
+		t.Fatal(err)
+	}
+
+	verifyBase(t, driver, "Sized")
+
+	used, limit, err := sizer.Usage("Sized")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit != size {
+		t.Fatalf("Expected limit %d, got %d", size, limit)
+	}
+	if used <= 0 {
+		t.Fatalf("Expected some usage, got %d", used)
+	}
+
+	if err := driver.Remove("Sized"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := driver.Remove("Base"); err != nil {
+		t.Fatal(err)
+	}
+}
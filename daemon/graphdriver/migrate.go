@@ -0,0 +1,181 @@
+package graphdriver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/utils"
+)
+
+// MigrateLayer copies the layer id, whose parent is parent, from the
+// driver from to the driver to, which must already hold parent. The
+// content of the layer is then compared in both drivers. A layer which
+// already exists in to is only compared: as the layers migrated after it
+// may depend on it, it is never replaced.
+func MigrateLayer(from, to Driver, id, parent string) error {
+	if to.Exists(id) {
+		if err := verifyLayer(from, to, id); err != nil {
+			return fmt.Errorf("%s already holds a different copy of layer %s: %s", to, id, err)
+		}
+		return nil
+	}
+	if err := copyLayer(from, to, id, parent); err != nil {
+		if to.Exists(id) {
+			to.Remove(id)
+		}
+		return err
+	}
+	return verifyLayer(from, to, id)
+}
+
+func copyLayer(from, to Driver, id, parent string) error {
+	diff, err := layerDiff(from, id, parent)
+	if err != nil {
+		return err
+	}
+	defer diff.Close()
+
+	if err := to.Create(id, parent); err != nil {
+		return err
+	}
+	if differ, ok := to.(Differ); ok {
+		return differ.ApplyDiff(id, diff)
+	}
+
+	layerFs, err := to.Get(id, "")
+	if err != nil {
+		return err
+	}
+	defer to.Put(id)
+	return archive.ApplyLayer(layerFs, diff)
+}
+
+// layerDiff returns an archive of the changes made by the layer id to
+// its parent.
+func layerDiff(driver Driver, id, parent string) (_ archive.Archive, err error) {
+	if differ, ok := driver.(Differ); ok {
+		return differ.Diff(id)
+	}
+
+	layerFs, err := driver.Get(id, "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			driver.Put(id)
+		}
+	}()
+
+	var arch archive.Archive
+	if parent == "" {
+		arch, err = archive.Tar(layerFs, archive.Uncompressed)
+	} else {
+		var parentFs string
+		if parentFs, err = driver.Get(parent, ""); err != nil {
+			return nil, err
+		}
+		defer driver.Put(parent)
+
+		var changes []archive.Change
+		if changes, err = archive.ChangesDirs(layerFs, parentFs); err != nil {
+			return nil, err
+		}
+		arch, err = archive.ExportChanges(layerFs, changes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return utils.NewReadCloserWrapper(arch, func() error {
+		err := arch.Close()
+		driver.Put(id)
+		return err
+	}), nil
+}
+
+func verifyLayer(from, to Driver, id string) error {
+	fromSum, fromSize, err := layerChecksum(from, id)
+	if err != nil {
+		return err
+	}
+	toSum, toSize, err := layerChecksum(to, id)
+	if err != nil {
+		return err
+	}
+	if fromSize != toSize {
+		return fmt.Errorf("Layer %s has %d bytes in %s, but %d bytes in %s", id, fromSize, from, toSize, to)
+	}
+	if fromSum != toSum {
+		return fmt.Errorf("Layer %s has checksum %s in %s, but %s in %s", id, fromSum, from, toSum, to)
+	}
+	return nil
+}
+
+// layerChecksum returns a checksum of the content of the layer id, as seen
+// when it is mounted, along with the size of its files. Modification times
+// are left out, as not all drivers preserve those of directories.
+func layerChecksum(driver Driver, id string) (string, int64, error) {
+	dir, err := driver.Get(id, "")
+	if err != nil {
+		return "", -1, err
+	}
+	defer driver.Put(id)
+
+	var (
+		h    = sha256.New()
+		size int64
+	)
+	err = filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		// Filesystems on block devices, e.g. with devicemapper, have one
+		if name == "lost+found" && f.IsDir() {
+			return filepath.SkipDir
+		}
+
+		stat := f.Sys().(*syscall.Stat_t)
+		fmt.Fprintf(h, "%s %s %d:%d", name, f.Mode(), stat.Uid, stat.Gid)
+		switch {
+		case f.Mode().IsRegular():
+			fmt.Fprintf(h, " %d ", f.Size())
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(h, file)
+			file.Close()
+			if err != nil {
+				return err
+			}
+			size += f.Size()
+		case f.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, " %s", target)
+		case f.Mode()&os.ModeDevice != 0:
+			fmt.Fprintf(h, " %d", stat.Rdev)
+		}
+		fmt.Fprintln(h)
+		return nil
+	})
+	if err != nil {
+		return "", -1, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
@@ -0,0 +1,121 @@
+// +build linux
+
+package overlay
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/pkg/system"
+)
+
+// isWhiteout returns true if fi is an overlay whiteout, which hides the
+// file of the same name in the lower dir. Whiteouts are 0/0 char devices.
+func isWhiteout(fi os.FileInfo) bool {
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
+
+// isOpaque returns true if the directory at path hides the content of the
+// directory of the same name in the lower dir.
+func isOpaque(path string) (bool, error) {
+	opaque, err := system.Lgetxattr(path, "trusted.overlay.opaque")
+	if err != nil {
+		return false, err
+	}
+	return string(opaque) == "y", nil
+}
+
+// changes walks the upper dir of an overlay mount and returns the changes
+// it makes to the lower dir. Overlay whiteouts are reported as deletions,
+// just like aufs whiteouts are by archive.Changes, so the result can be
+// exported with archive.ExportChanges.
+func changes(lower, upper string) ([]archive.Change, error) {
+	var changes []archive.Change
+	err := filepath.Walk(upper, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Rebase path
+		path, err = filepath.Rel(upper, path)
+		if err != nil {
+			return err
+		}
+		path = filepath.Join("/", path)
+
+		// Skip root
+		if path == "/" {
+			return nil
+		}
+
+		if isWhiteout(f) {
+			changes = append(changes, archive.Change{Path: path, Kind: archive.ChangeDelete})
+			return nil
+		}
+
+		change := archive.Change{
+			Path: path,
+			Kind: archive.ChangeAdd,
+		}
+
+		lowerPath := filepath.Join(lower, path)
+		stat, err := os.Lstat(lowerPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			// The file existed in the lower dir, so that's a modification
+
+			// However, if it's a directory, maybe it was only copied up
+			// because something below it was modified.
+			if stat.IsDir() && f.IsDir() {
+				opaque, err := isOpaque(filepath.Join(upper, path))
+				if err != nil {
+					return err
+				}
+				if opaque {
+					deleted, err := hiddenEntries(lowerPath, filepath.Join(upper, path), path)
+					if err != nil {
+						return err
+					}
+					changes = append(changes, deleted...)
+				} else if f.Mode() == stat.Mode() && f.ModTime().Equal(stat.ModTime()) {
+					return nil
+				}
+			}
+			change.Kind = archive.ChangeModify
+		}
+		changes = append(changes, change)
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// hiddenEntries returns deletions for the entries of the lower dir which
+// are hidden by an opaque upper dir, and not replaced by it.
+func hiddenEntries(lowerDir, upperDir, path string) ([]archive.Change, error) {
+	fis, err := ioutil.ReadDir(lowerDir)
+	if err != nil {
+		return nil, err
+	}
+	var changes []archive.Change
+	for _, fi := range fis {
+		if _, err := os.Lstat(filepath.Join(upperDir, fi.Name())); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		changes = append(changes, archive.Change{Path: filepath.Join(path, fi.Name()), Kind: archive.ChangeDelete})
+	}
+	return changes, nil
+}
@@ -0,0 +1,436 @@
+// +build linux
+
+/*
+
+overlay driver directory structure
+
+.
+└── <id>
+    ├── root      // Content of a flat layer: a base layer, or one
+    │             // materialized by ApplyDiff on top of a flat parent
+    ├── parent    // Id of the parent layer, if any
+    ├── lower-id  // Id of the flat layer mounted as the lower dir
+    ├── upper     // Writable dir of the overlay mount
+    ├── work      // Work dir of the overlay mount
+    └── merged    // Mount point of the overlay
+
+Overlay mounts only have a single lower dir, so a layer on top of a
+non-flat layer (e.g. a container on top of its init layer) starts with a
+copy of the upper dir of its parent.
+
+*/
+
+package overlay
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/daemon/graphdriver"
+	"github.com/dotcloud/docker/pkg/label"
+	mountpk "github.com/dotcloud/docker/pkg/mount"
+	"github.com/dotcloud/docker/utils"
+)
+
+var (
+	ErrOverlayNotSupported = fmt.Errorf("Overlay was not found in /proc/filesystems")
+)
+
+func init() {
+	graphdriver.Register("overlay", Init)
+}
+
+type Driver struct {
+	home       string
+	sync.Mutex // Protects concurrent modification to active
+	active     map[string]int
+}
+
+func Init(home string, options []string) (graphdriver.Driver, error) {
+	if err := supportsOverlay(); err != nil {
+		return nil, graphdriver.ErrNotSupported
+	}
+	if err := graphdriver.NoOptions("overlay", options); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(home, 0700); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	d := &Driver{
+		home:   home,
+		active: make(map[string]int),
+	}
+	return d, nil
+}
+
+// Return a nil error if the kernel supports overlay
+func supportsOverlay() error {
+	// We can try to modprobe overlay first before looking at
+	// proc/filesystems for when overlay is supported
+	exec.Command("modprobe", "overlay").Run()
+
+	f, err := os.Open("/proc/filesystems")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// Lines look like "nodev\toverlay"; don't match the
+		// out-of-tree "overlayfs", which has a different format
+		if fields := strings.Fields(s.Text()); len(fields) > 0 && fields[len(fields)-1] == "overlay" {
+			return nil
+		}
+	}
+	return ErrOverlayNotSupported
+}
+
+func (d *Driver) String() string {
+	return "overlay"
+}
+
+func (d *Driver) Status() [][2]string {
+	ids, _ := ioutil.ReadDir(d.home)
+	return [][2]string{
+		{"Root Dir", d.home},
+		{"Dirs", fmt.Sprintf("%d", len(ids))},
+	}
+}
+
+func (d *Driver) Cleanup() error {
+	d.Lock()
+	defer d.Unlock()
+
+	for id := range d.active {
+		if err := d.unmount(id); err != nil {
+			utils.Errorf("Unmounting %s: %s", utils.TruncateID(id), err)
+		}
+	}
+	d.active = make(map[string]int)
+	return nil
+}
+
+func (d *Driver) dir(id string) string {
+	return path.Join(d.home, path.Base(id))
+}
+
+func (d *Driver) Exists(id string) bool {
+	_, err := os.Stat(d.dir(id))
+	return err == nil
+}
+
+// isFlat returns true if the layer is stored as a plain directory
+// rather than as an overlay mount.
+func (d *Driver) isFlat(id string) bool {
+	_, err := os.Stat(path.Join(d.dir(id), "root"))
+	return err == nil
+}
+
+func (d *Driver) readId(id, name string) (string, error) {
+	data, err := ioutil.ReadFile(path.Join(d.dir(id), name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (d *Driver) parent(id string) (string, error) {
+	return d.readId(id, "parent")
+}
+
+func (d *Driver) lowerId(id string) (string, error) {
+	return d.readId(id, "lower-id")
+}
+
+func copyDir(src, dst string, hardlink bool) error {
+	args := []string{"-aT"}
+	if hardlink {
+		args = append(args, "-l")
+	}
+	if output, err := exec.Command("cp", append(args, src, dst)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("Error overlay copying directory: %s (%s)", err, output)
+	}
+	return nil
+}
+
+func (d *Driver) Create(id, parent string) (err error) {
+	dir := d.dir(id)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	if parent == "" {
+		return os.Mkdir(path.Join(dir, "root"), 0755)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "parent"), []byte(parent), 0600); err != nil {
+		return err
+	}
+
+	upper := path.Join(dir, "upper")
+	lowerId := parent
+	if d.isFlat(parent) {
+		// The upper dir is the root of the overlay mount,
+		// so it must look like the root of the parent
+		st, err := os.Stat(path.Join(d.dir(parent), "root"))
+		if err != nil {
+			return err
+		}
+		if err := os.Mkdir(upper, st.Mode()); err != nil {
+			return err
+		}
+		stat := st.Sys().(*syscall.Stat_t)
+		if err := os.Chown(upper, int(stat.Uid), int(stat.Gid)); err != nil {
+			return err
+		}
+	} else {
+		if lowerId, err = d.lowerId(parent); err != nil {
+			return err
+		}
+		// Whiteouts and opaque dirs are plain files and xattrs
+		// in the upper dir, so a copy preserves them
+		if err := copyDir(path.Join(d.dir(parent), "upper"), upper, false); err != nil {
+			return err
+		}
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "lower-id"), []byte(lowerId), 0600); err != nil {
+		return err
+	}
+	if err := os.Mkdir(path.Join(dir, "work"), 0700); err != nil {
+		return err
+	}
+	return os.Mkdir(path.Join(dir, "merged"), 0700)
+}
+
+func (d *Driver) Remove(id string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.active[id] != 0 {
+		utils.Errorf("Warning: removing active id %s\n", id)
+		delete(d.active, id)
+	}
+
+	// Make sure the dir is umounted first
+	if err := d.unmount(id); err != nil {
+		return err
+	}
+	dir := d.dir(id)
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (d *Driver) Get(id, mountLabel string) (string, error) {
+	dir := d.dir(id)
+	if _, err := os.Stat(dir); err != nil {
+		return "", err
+	}
+
+	// Flat layers don't need to be mounted
+	if d.isFlat(id) {
+		return path.Join(dir, "root"), nil
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	merged := path.Join(dir, "merged")
+	count := d.active[id]
+	if count == 0 {
+		if err := d.mount(id, mountLabel); err != nil {
+			return "", err
+		}
+	}
+	d.active[id] = count + 1
+	return merged, nil
+}
+
+func (d *Driver) Put(id string) {
+	d.Lock()
+	defer d.Unlock()
+
+	if count := d.active[id]; count > 1 {
+		d.active[id] = count - 1
+		return
+	} else if count == 0 {
+		// Flat layers are never mounted
+		return
+	}
+	if err := d.unmount(id); err != nil {
+		utils.Errorf("Warning: error unmounting %s: %s", id, err)
+	}
+	delete(d.active, id)
+}
+
+func (d *Driver) mount(id, mountLabel string) error {
+	var (
+		dir    = d.dir(id)
+		target = path.Join(dir, "merged")
+	)
+	if mounted, err := mountpk.Mounted(target); err != nil || mounted {
+		return err
+	}
+
+	lowerId, err := d.lowerId(id)
+	if err != nil {
+		return err
+	}
+	var (
+		lower = path.Join(d.dir(lowerId), "root")
+		data  = label.FormatMountLabel(fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, path.Join(dir, "upper"), path.Join(dir, "work")), mountLabel)
+	)
+	if err := syscall.Mount("overlay", target, "overlay", 0, data); err != nil {
+		return fmt.Errorf("Error mounting overlay on %s: %s", target, err)
+	}
+	return nil
+}
+
+func (d *Driver) unmount(id string) error {
+	return mountpk.Unmount(path.Join(d.dir(id), "merged"))
+}
+
+// ApplyDiff applies a layer on top of a freshly created layer. When the
+// parent is flat, the new layer is flattened as well: it starts as a
+// hardlinked copy of its parent, so that image layers never stack more
+// than one overlay mount.
+func (d *Driver) ApplyDiff(id string, diff archive.ArchiveReader) error {
+	dir := d.dir(id)
+
+	if d.isFlat(id) {
+		return archive.ApplyLayer(path.Join(dir, "root"), diff)
+	}
+
+	parent, err := d.parent(id)
+	if err != nil {
+		return err
+	}
+	if !d.isFlat(parent) {
+		layerFs, err := d.Get(id, "")
+		if err != nil {
+			return err
+		}
+		defer d.Put(id)
+		return archive.ApplyLayer(layerFs, diff)
+	}
+
+	tmpRoot, err := ioutil.TempDir(dir, "tmproot")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpRoot)
+
+	// ApplyLayer replaces files instead of writing to them, so
+	// hardlinks shared with the parent are never modified
+	if err := copyDir(path.Join(d.dir(parent), "root"), tmpRoot, true); err != nil {
+		return err
+	}
+	if err := archive.ApplyLayer(tmpRoot, diff); err != nil {
+		return err
+	}
+
+	for _, name := range []string{"upper", "work", "merged", "lower-id"} {
+		if err := os.RemoveAll(path.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmpRoot, path.Join(dir, "root"))
+}
+
+func (d *Driver) Changes(id string) ([]archive.Change, error) {
+	parent, err := d.parent(id)
+	if err != nil {
+		return nil, err
+	}
+	if parent == "" {
+		if !d.isFlat(id) {
+			return nil, fmt.Errorf("Layer %s has no parent and no root", id)
+		}
+		return archive.Changes(nil, path.Join(d.dir(id), "root"))
+	}
+
+	// Fast path: the upper dir holds exactly the changes made on
+	// top of a flat parent
+	if !d.isFlat(id) && d.isFlat(parent) {
+		return changes(path.Join(d.dir(parent), "root"), path.Join(d.dir(id), "upper"))
+	}
+
+	layerFs, err := d.Get(id, "")
+	if err != nil {
+		return nil, err
+	}
+	defer d.Put(id)
+
+	parentFs, err := d.Get(parent, "")
+	if err != nil {
+		return nil, err
+	}
+	defer d.Put(parent)
+
+	return archive.ChangesDirs(layerFs, parentFs)
+}
+
+func (d *Driver) Diff(id string) (archive.Archive, error) {
+	parent, err := d.parent(id)
+	if err != nil {
+		return nil, err
+	}
+	if parent == "" && d.isFlat(id) {
+		return archive.Tar(path.Join(d.dir(id), "root"), archive.Uncompressed)
+	}
+
+	changes, err := d.Changes(id)
+	if err != nil {
+		return nil, err
+	}
+
+	layerFs, err := d.Get(id, "")
+	if err != nil {
+		return nil, err
+	}
+
+	archive, err := archive.ExportChanges(layerFs, changes)
+	if err != nil {
+		d.Put(id)
+		return nil, err
+	}
+	return utils.NewReadCloserWrapper(archive, func() error {
+		err := archive.Close()
+		d.Put(id)
+		return err
+	}), nil
+}
+
+func (d *Driver) DiffSize(id string) (int64, error) {
+	changes, err := d.Changes(id)
+	if err != nil {
+		return -1, err
+	}
+
+	layerFs, err := d.Get(id, "")
+	if err != nil {
+		return -1, err
+	}
+	defer d.Put(id)
+
+	return archive.ChangesSize(layerFs, changes), nil
+}
@@ -0,0 +1,152 @@
+// +build linux
+
+package overlay
+
+import (
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/daemon/graphdriver"
+	"github.com/dotcloud/docker/daemon/graphdriver/graphtest"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// This avoids creating a new driver for each test if all tests are run
+// Make sure to put new tests between TestOverlaySetup and TestOverlayTeardown
+func TestOverlaySetup(t *testing.T) {
+	graphtest.GetDriver(t, "overlay")
+}
+
+func TestOverlayCreateEmpty(t *testing.T) {
+	graphtest.DriverTestCreateEmpty(t, "overlay")
+}
+
+func TestOverlayCreateBase(t *testing.T) {
+	graphtest.DriverTestCreateBase(t, "overlay")
+}
+
+func TestOverlayCreateSnap(t *testing.T) {
+	graphtest.DriverTestCreateSnap(t, "overlay")
+}
+
+func TestOverlayChanges(t *testing.T) {
+	driver := graphtest.GetDriver(t, "overlay")
+	defer graphtest.PutDriver(t)
+	differ := driver.(*graphtest.Driver).Driver.(graphdriver.Differ)
+
+	if err := driver.Create("changes-base", ""); err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Remove("changes-base")
+	base, err := driver.Get("changes-base", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(base, "removed"), []byte("removed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	driver.Put("changes-base")
+
+	// The upper dir of a layer on top of a flat layer holds its changes,
+	// including an overlay whiteout for the removed file
+	if err := driver.Create("changes", "changes-base"); err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Remove("changes")
+
+	dir, err := driver.Get("changes", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path.Join(dir, "removed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "added"), []byte("added"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	driver.Put("changes")
+
+	changes, err := differ.Changes("changes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("Expected 2 changes, got %v", changes)
+	}
+	for _, change := range changes {
+		switch change.Path {
+		case "/added":
+			if change.Kind != archive.ChangeAdd {
+				t.Fatalf("Expected /added to be added, got %s", change.String())
+			}
+		case "/removed":
+			if change.Kind != archive.ChangeDelete {
+				t.Fatalf("Expected /removed to be deleted, got %s", change.String())
+			}
+		default:
+			t.Fatalf("Unexpected change %s", change.String())
+		}
+	}
+
+	// A layer on top of it starts with a copy of its upper dir, but
+	// only reports its own changes
+	if err := driver.Create("changes-child", "changes"); err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Remove("changes-child")
+
+	dir, err = driver.Get("changes-child", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, "removed")); !os.IsNotExist(err) {
+		t.Fatalf("Expected /removed to be deleted, got %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "child"), []byte("child"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	driver.Put("changes-child")
+
+	if changes, err = differ.Changes("changes-child"); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Path != "/child" || changes[0].Kind != archive.ChangeAdd {
+		t.Fatalf("Expected /child to be added, got %v", changes)
+	}
+
+	// The diff uses aufs style whiteouts, so it can be applied
+	// on top of the base by any driver
+	diff, err := differ.Diff("changes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer diff.Close()
+
+	if err := driver.Create("changes-applied", "changes-base"); err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Remove("changes-applied")
+	if err := differ.ApplyDiff("changes-applied", diff); err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := driver.Get("changes-applied", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Put("changes-applied")
+	if _, err := os.Stat(path.Join(applied, "removed")); !os.IsNotExist(err) {
+		t.Fatalf("Expected /removed to be deleted, got %v", err)
+	}
+	if _, err := os.Stat(path.Join(applied, "added")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(base, "removed")); err != nil {
+		t.Fatalf("Applying a diff modified the parent layer: %s", err)
+	}
+}
+
+func TestOverlayTeardown(t *testing.T) {
+	graphtest.PutDriver(t)
+}
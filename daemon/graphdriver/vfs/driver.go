@@ -3,16 +3,22 @@ package vfs
 import (
 	"fmt"
 	"github.com/dotcloud/docker/daemon/graphdriver"
+	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
 )
 
 func init() {
 	graphdriver.Register("vfs", Init)
 }
 
-func Init(home string) (graphdriver.Driver, error) {
+func Init(home string, options []string) (graphdriver.Driver, error) {
+	if err := graphdriver.NoOptions("vfs", options); err != nil {
+		return nil, err
+	}
 	d := &Driver{
 		home: home,
 	}
@@ -63,14 +69,51 @@ func (d *Driver) Create(id, parent string) error {
 	return nil
 }
 
+// CreateWithSize creates a new layer like Create. A plain directory can't
+// be bounded without filesystem quotas, so the limit is only recorded and
+// compared against the measured usage of the layer.
+func (d *Driver) CreateWithSize(id, parent string, size int64) error {
+	if err := d.Create(id, parent); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(d.quotaFile(id)), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.quotaFile(id), []byte(strconv.FormatInt(size, 10)), 0600)
+}
+
+func (d *Driver) Usage(id string) (used, limit int64, err error) {
+	if used, err = utils.TreeSize(d.dir(id)); err != nil {
+		return 0, 0, err
+	}
+	data, err := ioutil.ReadFile(d.quotaFile(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return used, 0, nil
+		}
+		return 0, 0, err
+	}
+	if limit, err = strconv.ParseInt(string(data), 10, 64); err != nil {
+		return 0, 0, err
+	}
+	return used, limit, nil
+}
+
 func (d *Driver) dir(id string) string {
 	return path.Join(d.home, "dir", path.Base(id))
 }
 
+func (d *Driver) quotaFile(id string) string {
+	return path.Join(d.home, "quota", path.Base(id))
+}
+
 func (d *Driver) Remove(id string) error {
 	if _, err := os.Stat(d.dir(id)); err != nil {
 		return err
 	}
+	if err := os.Remove(d.quotaFile(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return os.RemoveAll(d.dir(id))
 }
 
@@ -23,6 +23,16 @@ func TestVfsCreateSnap(t *testing.T) {
 	graphtest.DriverTestCreateSnap(t, "vfs")
 }
 
+func TestVfsCreateWithSize(t *testing.T) {
+	graphtest.DriverTestCreateWithSize(t, "vfs")
+}
+
 func TestVfsTeardown(t *testing.T) {
 	graphtest.PutDriver(t)
 }
+
+func TestVfsUnknownOption(t *testing.T) {
+	if _, err := Init("/tmp/docker-vfs-options", []string{"dm.basesize=20G"}); err == nil {
+		t.Fatal("Expected an error for a devicemapper option")
+	}
+}
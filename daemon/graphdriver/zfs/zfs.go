@@ -0,0 +1,271 @@
+// +build linux
+
+/*
+
+zfs driver dataset structure
+
+Layers are datasets below the dataset holding the driver home:
+
+<dataset>
+├── <dataset>/1       // Created with "zfs create" for layers without parent
+├── <dataset>/1@2     // Snapshot of 1, taken when 2 was created
+├── <dataset>/2       // Clone of 1@2
+└── ...
+
+Each layer is mounted at <home>/<id> on Get, and unmounted on Put.
+
+*/
+
+package zfs
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/dotcloud/docker/daemon/graphdriver"
+	"github.com/dotcloud/docker/pkg/label"
+	"github.com/dotcloud/docker/pkg/mount"
+	"github.com/dotcloud/docker/utils"
+)
+
+// ZFS_SUPER_MAGIC
+const zfsMagic = 0x2fc12fc1
+
+func init() {
+	graphdriver.Register("zfs", Init)
+}
+
+// Runner runs the zfs and zpool commands. It allows the driver to be
+// tested without a real pool.
+type Runner interface {
+	Run(name string, args ...string) ([]byte, error)
+}
+
+type execRunner struct{}
+
+func (execRunner) Run(name string, args ...string) ([]byte, error) {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s failed: %s (%s)", name, strings.Join(args, " "), err, bytes.TrimSpace(output))
+	}
+	return output, nil
+}
+
+type Driver struct {
+	home       string
+	dataset    string
+	runner     Runner
+	sync.Mutex // Protects concurrent modification to active
+	active     map[string]int
+}
+
+func Init(home string, options []string) (graphdriver.Driver, error) {
+	rootdir := path.Dir(home)
+
+	var buf syscall.Statfs_t
+	if err := syscall.Statfs(rootdir, &buf); err != nil {
+		return nil, err
+	}
+	if buf.Type != zfsMagic {
+		return nil, graphdriver.ErrNotSupported
+	}
+	if _, err := exec.LookPath("zfs"); err != nil {
+		return nil, graphdriver.ErrNotSupported
+	}
+	if err := graphdriver.NoOptions("zfs", options); err != nil {
+		return nil, err
+	}
+
+	dataset, err := lookupDataset(rootdir)
+	if err != nil {
+		return nil, err
+	}
+	return newDriver(home, dataset, execRunner{}), nil
+}
+
+func newDriver(home, dataset string, runner Runner) *Driver {
+	return &Driver{
+		home:    home,
+		dataset: dataset,
+		runner:  runner,
+		active:  make(map[string]int),
+	}
+}
+
+// lookupDataset returns the name of the dataset mounted on the deepest
+// mount point containing dir.
+func lookupDataset(dir string) (string, error) {
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		return "", err
+	}
+	var found *mount.MountInfo
+	for _, m := range mounts {
+		if m.Fstype != "zfs" {
+			continue
+		}
+		if dir != m.Mountpoint && !strings.HasPrefix(dir, strings.TrimSuffix(m.Mountpoint, "/")+"/") {
+			continue
+		}
+		if found == nil || len(m.Mountpoint) > len(found.Mountpoint) {
+			found = m
+		}
+	}
+	if found == nil {
+		return "", fmt.Errorf("Can't find the zfs dataset mounted on %s", dir)
+	}
+	return found.Source, nil
+}
+
+func (d *Driver) String() string {
+	return "zfs"
+}
+
+func (d *Driver) zfs(args ...string) ([]byte, error) {
+	return d.runner.Run("zfs", args...)
+}
+
+func (d *Driver) layer(id string) string {
+	return d.dataset + "/" + id
+}
+
+func (d *Driver) mountPath(id string) string {
+	return path.Join(d.home, id)
+}
+
+func (d *Driver) pool() string {
+	return strings.SplitN(d.dataset, "/", 2)[0]
+}
+
+func (d *Driver) Status() [][2]string {
+	status := [][2]string{
+		{"Zpool", d.pool()},
+		{"Parent Dataset", d.dataset},
+	}
+
+	output, err := d.runner.Run("zpool", "list", "-H", "-o", "size,allocated,free,health", d.pool())
+	if err != nil {
+		utils.Errorf("Warning: can't read status of zpool %s: %s", d.pool(), err)
+		return status
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) != 4 {
+		return status
+	}
+	return append(status,
+		[2]string{"Zpool Size", fields[0]},
+		[2]string{"Zpool Allocated", fields[1]},
+		[2]string{"Zpool Free", fields[2]},
+		[2]string{"Zpool Health", fields[3]},
+	)
+}
+
+func (d *Driver) Cleanup() error {
+	d.Lock()
+	defer d.Unlock()
+
+	for id := range d.active {
+		if _, err := d.zfs("unmount", d.layer(id)); err != nil {
+			utils.Errorf("Unmounting %s: %s", utils.TruncateID(id), err)
+		}
+	}
+	d.active = make(map[string]int)
+	return nil
+}
+
+func (d *Driver) Create(id, parent string) error {
+	var (
+		layer = d.layer(id)
+		opts  = []string{"-o", "mountpoint=" + d.mountPath(id), "-o", "canmount=noauto"}
+	)
+
+	if parent == "" {
+		_, err := d.zfs(append(append([]string{"create"}, opts...), layer)...)
+		return err
+	}
+
+	snapshot := d.layer(parent) + "@" + id
+	if _, err := d.zfs("snapshot", snapshot); err != nil {
+		return err
+	}
+	if _, err := d.zfs(append(append([]string{"clone"}, opts...), snapshot, layer)...); err != nil {
+		d.zfs("destroy", snapshot)
+		return err
+	}
+	return nil
+}
+
+func (d *Driver) Remove(id string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.active[id] != 0 {
+		utils.Errorf("Warning: removing active id %s\n", id)
+		delete(d.active, id)
+	}
+
+	layer := d.layer(id)
+
+	// The snapshot of the parent this layer was cloned from
+	// can only be destroyed after the clone
+	output, err := d.zfs("get", "-H", "-o", "value", "origin", layer)
+	if err != nil {
+		return err
+	}
+	origin := strings.TrimSpace(string(output))
+
+	if _, err := d.zfs("destroy", "-r", layer); err != nil {
+		return err
+	}
+	if origin != "" && origin != "-" {
+		if _, err := d.zfs("destroy", origin); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Driver) Get(id, mountLabel string) (string, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	count := d.active[id]
+	if count == 0 {
+		args := []string{"mount"}
+		if opts := label.FormatMountLabel("", mountLabel); opts != "" {
+			args = append(args, "-o", opts)
+		}
+		if _, err := d.zfs(append(args, d.layer(id))...); err != nil {
+			return "", err
+		}
+	}
+	d.active[id] = count + 1
+
+	return d.mountPath(id), nil
+}
+
+func (d *Driver) Put(id string) {
+	d.Lock()
+	defer d.Unlock()
+
+	if count := d.active[id]; count > 1 {
+		d.active[id] = count - 1
+		return
+	} else if count == 0 {
+		return
+	}
+	if _, err := d.zfs("unmount", d.layer(id)); err != nil {
+		utils.Errorf("Warning: error unmounting %s: %s", id, err)
+	}
+	delete(d.active, id)
+}
+
+func (d *Driver) Exists(id string) bool {
+	_, err := d.zfs("list", "-H", "-o", "name", d.layer(id))
+	return err == nil
+}
@@ -0,0 +1,184 @@
+// +build linux
+
+package zfs
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dotcloud/docker/daemon/graphdriver/graphtest"
+)
+
+// This avoids creating a new driver for each test if all tests are run
+// Make sure to put new tests between TestZfsSetup and TestZfsTeardown
+func TestZfsSetup(t *testing.T) {
+	graphtest.GetDriver(t, "zfs")
+}
+
+func TestZfsCreateEmpty(t *testing.T) {
+	graphtest.DriverTestCreateEmpty(t, "zfs")
+}
+
+func TestZfsCreateBase(t *testing.T) {
+	graphtest.DriverTestCreateBase(t, "zfs")
+}
+
+func TestZfsCreateSnap(t *testing.T) {
+	graphtest.DriverTestCreateSnap(t, "zfs")
+}
+
+func TestZfsTeardown(t *testing.T) {
+	graphtest.PutDriver(t)
+}
+
+// fakeRunner records the commands it runs, and answers them from a
+// canned set of outputs.
+type fakeRunner struct {
+	commands []string
+	outputs  map[string]string
+	failing  map[string]bool
+}
+
+func newFakeRunner() *fakeRunner {
+	return &fakeRunner{
+		outputs: make(map[string]string),
+		failing: make(map[string]bool),
+	}
+}
+
+func (r *fakeRunner) Run(name string, args ...string) ([]byte, error) {
+	command := strings.Join(append([]string{name}, args...), " ")
+	r.commands = append(r.commands, command)
+	if r.failing[command] {
+		return nil, fmt.Errorf("%s failed", command)
+	}
+	return []byte(r.outputs[command]), nil
+}
+
+func (r *fakeRunner) expect(t *testing.T, commands ...string) {
+	if len(r.commands) != len(commands) {
+		t.Fatalf("Expected commands %q, got %q", commands, r.commands)
+	}
+	for i, command := range commands {
+		if r.commands[i] != command {
+			t.Fatalf("Expected command %q, got %q", command, r.commands[i])
+		}
+	}
+	r.commands = nil
+}
+
+func TestZfsCreateRemove(t *testing.T) {
+	runner := newFakeRunner()
+	d := newDriver("/var/lib/docker/zfs", "tank/docker", runner)
+
+	if err := d.Create("base", ""); err != nil {
+		t.Fatal(err)
+	}
+	runner.expect(t, "zfs create -o mountpoint=/var/lib/docker/zfs/base -o canmount=noauto tank/docker/base")
+
+	if err := d.Create("child", "base"); err != nil {
+		t.Fatal(err)
+	}
+	runner.expect(t,
+		"zfs snapshot tank/docker/base@child",
+		"zfs clone -o mountpoint=/var/lib/docker/zfs/child -o canmount=noauto tank/docker/base@child tank/docker/child",
+	)
+
+	runner.outputs["zfs get -H -o value origin tank/docker/child"] = "tank/docker/base@child\n"
+	if err := d.Remove("child"); err != nil {
+		t.Fatal(err)
+	}
+	runner.expect(t,
+		"zfs get -H -o value origin tank/docker/child",
+		"zfs destroy -r tank/docker/child",
+		"zfs destroy tank/docker/base@child",
+	)
+
+	runner.outputs["zfs get -H -o value origin tank/docker/base"] = "-\n"
+	if err := d.Remove("base"); err != nil {
+		t.Fatal(err)
+	}
+	runner.expect(t,
+		"zfs get -H -o value origin tank/docker/base",
+		"zfs destroy -r tank/docker/base",
+	)
+}
+
+func TestZfsCreateFailedClone(t *testing.T) {
+	runner := newFakeRunner()
+	d := newDriver("/var/lib/docker/zfs", "tank/docker", runner)
+
+	runner.failing["zfs clone -o mountpoint=/var/lib/docker/zfs/child -o canmount=noauto tank/docker/base@child tank/docker/child"] = true
+	if err := d.Create("child", "base"); err == nil {
+		t.Fatal("Expected an error when the clone fails")
+	}
+	runner.expect(t,
+		"zfs snapshot tank/docker/base@child",
+		"zfs clone -o mountpoint=/var/lib/docker/zfs/child -o canmount=noauto tank/docker/base@child tank/docker/child",
+		"zfs destroy tank/docker/base@child",
+	)
+}
+
+func TestZfsGetPut(t *testing.T) {
+	runner := newFakeRunner()
+	d := newDriver("/var/lib/docker/zfs", "tank/docker", runner)
+
+	for i := 0; i < 2; i++ {
+		dir, err := d.Get("layer", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dir != "/var/lib/docker/zfs/layer" {
+			t.Fatalf("Unexpected mount point %s", dir)
+		}
+	}
+	// Only the first Get mounts the layer
+	runner.expect(t, "zfs mount tank/docker/layer")
+
+	d.Put("layer")
+	runner.expect(t)
+	d.Put("layer")
+	runner.expect(t, "zfs unmount tank/docker/layer")
+
+	// Put without Get is a no-op
+	d.Put("layer")
+	runner.expect(t)
+}
+
+func TestZfsExists(t *testing.T) {
+	runner := newFakeRunner()
+	d := newDriver("/var/lib/docker/zfs", "tank/docker", runner)
+
+	runner.failing["zfs list -H -o name tank/docker/missing"] = true
+	if d.Exists("missing") {
+		t.Fatal("Expected missing layer not to exist")
+	}
+	if !d.Exists("layer") {
+		t.Fatal("Expected layer to exist")
+	}
+}
+
+func TestZfsStatus(t *testing.T) {
+	runner := newFakeRunner()
+	d := newDriver("/var/lib/docker/zfs", "tank/docker", runner)
+
+	runner.outputs["zpool list -H -o size,allocated,free,health tank"] = "99.5G\t1.20G\t98.3G\tONLINE\n"
+	status := d.Status()
+	expected := [][2]string{
+		{"Zpool", "tank"},
+		{"Parent Dataset", "tank/docker"},
+		{"Zpool Size", "99.5G"},
+		{"Zpool Allocated", "1.20G"},
+		{"Zpool Free", "98.3G"},
+		{"Zpool Health", "ONLINE"},
+	}
+	if len(status) != len(expected) {
+		t.Fatalf("Expected status %v, got %v", expected, status)
+	}
+	for i := range expected {
+		if status[i] != expected[i] {
+			t.Fatalf("Expected status %v, got %v", expected[i], status[i])
+		}
+	}
+}
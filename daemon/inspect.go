@@ -13,10 +13,15 @@ func (daemon *Daemon) ContainerInspect(job *engine.Job) engine.Status {
 	}
 	name := job.Args[0]
 	if container := daemon.Get(name); container != nil {
+		usage, err := container.GetStorageUsage()
+		if err != nil {
+			return job.Error(err)
+		}
 		b, err := json.Marshal(&struct {
 			*Container
-			HostConfig *runconfig.HostConfig
-		}{container, container.HostConfig()})
+			HostConfig   *runconfig.HostConfig
+			StorageUsage *StorageUsage `json:",omitempty"`
+		}{container, container.HostConfig(), usage})
 		if err != nil {
 			return job.Error(err)
 		}
@@ -0,0 +1,167 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/dotcloud/docker/daemon/graphdriver"
+	"github.com/dotcloud/docker/daemonconfig"
+	"github.com/dotcloud/docker/engine"
+	"github.com/dotcloud/docker/graph"
+	"github.com/dotcloud/docker/utils"
+)
+
+// MigrateStorage copies the images and containers of the storage driver
+// job.Args[0] to the storage driver job.Args[1], so that the daemon can be
+// restarted with the latter without losing them. The daemon must not be
+// running. The data of the former driver is kept, and has to be removed
+// by hand once the migration was checked.
+func MigrateStorage(job *engine.Job) engine.Status {
+	if len(job.Args) != 2 {
+		return job.Errorf("Usage: %s FROM TO", job.Name)
+	}
+	config := daemonconfig.ConfigFromJob(job)
+	if config.Pidfile != "" {
+		if err := utils.CreatePidFile(config.Pidfile); err != nil {
+			return job.Error(err)
+		}
+		defer utils.RemovePidFile(config.Pidfile)
+	}
+	if err := migrateStorage(config, job.Args[0], job.Args[1], job.Stdout); err != nil {
+		return job.Error(err)
+	}
+	return engine.StatusOK
+}
+
+func migrateStorage(config *daemonconfig.Config, from, to string, out io.Writer) error {
+	if from == to {
+		return fmt.Errorf("Can't migrate the %s storage driver to itself", from)
+	}
+
+	src, err := graphdriver.GetDriver(from, config.Root, driverOptions(from, config.GraphOptions))
+	if err != nil {
+		return fmt.Errorf("Error loading the %s storage driver: %s", from, err)
+	}
+	defer src.Cleanup()
+
+	dst, err := graphdriver.GetDriver(to, config.Root, driverOptions(to, config.GraphOptions))
+	if err != nil {
+		return fmt.Errorf("Error loading the %s storage driver: %s", to, err)
+	}
+	defer dst.Cleanup()
+
+	srcGraph, err := graph.NewGraph(path.Join(config.Root, "graph"), src)
+	if err != nil {
+		return err
+	}
+	if err := srcGraph.MigrateTo(dst, out); err != nil {
+		return err
+	}
+
+	containers, err := migrateContainers(path.Join(config.Root, "containers"), src, dst, out)
+	if err != nil {
+		return err
+	}
+
+	// Everything was copied and verified, switch over to the new driver
+	dstGraph, err := graph.NewGraph(path.Join(config.Root, "graph"), dst)
+	if err != nil {
+		return err
+	}
+	if err := migrateRepositories(config.Root, srcGraph, dstGraph); err != nil {
+		return err
+	}
+	for _, container := range containers {
+		container.Driver = to
+		if err := container.ToDisk(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(out, "Migrated %s to %s, restart the daemon with --storage-driver=%s\n", from, to, to)
+	return nil
+}
+
+// graphOptionPrefixes are the prefixes of the --storage-opt options of
+// each storage driver.
+var graphOptionPrefixes = map[string]string{
+	"devicemapper": "dm.",
+}
+
+// driverOptions returns the options of options which apply to the storage
+// driver name, as both drivers of a migration are given the same options
+// while most drivers reject any option.
+func driverOptions(name string, options []string) []string {
+	prefix, exists := graphOptionPrefixes[name]
+	if !exists {
+		return nil
+	}
+	var filtered []string
+	for _, option := range options {
+		if strings.HasPrefix(option, prefix) {
+			filtered = append(filtered, option)
+		}
+	}
+	return filtered
+}
+
+// migrateContainers copies the init and writable layers of the containers
+// created with the driver src to the driver dst. It returns the migrated
+// containers.
+func migrateContainers(root string, src, dst graphdriver.Driver, out io.Writer) ([]*Container, error) {
+	dir, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var containers []*Container
+	for _, v := range dir {
+		container := &Container{root: path.Join(root, v.Name())}
+		if err := container.FromDisk(); err != nil {
+			utils.Errorf("Failed to load container %v: %v", v.Name(), err)
+			continue
+		}
+		// Same rule as when restoring the containers
+		if !(container.Driver == "" && src.String() == "aufs" || container.Driver == src.String()) {
+			continue
+		}
+
+		fmt.Fprintf(out, "Migrating container %s\n", utils.TruncateID(container.ID))
+		initID := fmt.Sprintf("%s-init", container.ID)
+		if err := graphdriver.MigrateLayer(src, dst, initID, container.Image); err != nil {
+			return nil, fmt.Errorf("Error migrating container %s: %s", container.ID, err)
+		}
+		if err := graphdriver.MigrateLayer(src, dst, container.ID, initID); err != nil {
+			return nil, fmt.Errorf("Error migrating container %s: %s", container.ID, err)
+		}
+		containers = append(containers, container)
+	}
+	return containers, nil
+}
+
+// migrateRepositories adds the tags of the images of srcGraph to those of
+// dstGraph. Tags which already exist for dstGraph are kept.
+func migrateRepositories(root string, srcGraph, dstGraph *graph.Graph) error {
+	srcStore, err := graph.NewTagStore(path.Join(root, "repositories-"+srcGraph.Driver().String()), srcGraph)
+	if err != nil {
+		return err
+	}
+	dstStore, err := graph.NewTagStore(path.Join(root, "repositories-"+dstGraph.Driver().String()), dstGraph)
+	if err != nil {
+		return err
+	}
+	for name, repository := range srcStore.Repositories {
+		if _, exists := dstStore.Repositories[name]; !exists {
+			dstStore.Repositories[name] = make(graph.Repository)
+		}
+		for tag, id := range repository {
+			if _, exists := dstStore.Repositories[name][tag]; !exists {
+				dstStore.Repositories[name][tag] = id
+			}
+		}
+	}
+	return dstStore.Save()
+}
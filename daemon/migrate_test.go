@@ -0,0 +1,18 @@
+package daemon
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDriverOptions(t *testing.T) {
+	options := []string{"dm.basesize=20G", "dm.fs=xfs"}
+	if filtered := driverOptions("devicemapper", options); !reflect.DeepEqual(filtered, options) {
+		t.Fatalf("Expected the devicemapper options %v, got %v", options, filtered)
+	}
+	for _, name := range []string{"aufs", "btrfs", "overlay", "vfs", "zfs"} {
+		if filtered := driverOptions(name, options); len(filtered) != 0 {
+			t.Fatalf("Expected no option for %s, got %v", name, filtered)
+		}
+	}
+}
@@ -7,8 +7,10 @@ import (
 )
 
 const (
-	defaultNetworkMtu    = 1500
-	DisableNetworkBridge = "none"
+	defaultNetworkMtu             = 1500
+	DisableNetworkBridge          = "none"
+	defaultMaxConcurrentDownloads = 3
+	defaultMaxConcurrentUploads   = 5
 )
 
 // FIXME: separate runtime configuration from http api configuration
@@ -25,10 +27,17 @@ type Config struct {
 	BridgeIP                    string
 	InterContainerCommunication bool
 	GraphDriver                 string
+	GraphOptions                []string
 	ExecDriver                  string
 	Mtu                         int
 	DisableNetwork              bool
 	EnableSelinuxSupport        bool
+	Mirrors                     []string
+	InsecureRegistries          []string
+	MaxConcurrentDownloads      int
+	MaxConcurrentUploads        int
+	Trust                       bool
+	TrustDir                    string
 	Context                     map[string][]string
 }
 
@@ -48,6 +57,8 @@ func ConfigFromJob(job *engine.Job) *Config {
 		GraphDriver:                 job.Getenv("GraphDriver"),
 		ExecDriver:                  job.Getenv("ExecDriver"),
 		EnableSelinuxSupport:        job.GetenvBool("EnableSelinuxSupport"),
+		Trust:                       job.GetenvBool("Trust"),
+		TrustDir:                    job.Getenv("TrustDir"),
 	}
 	if dns := job.GetenvList("Dns"); dns != nil {
 		config.Dns = dns
@@ -55,11 +66,30 @@ func ConfigFromJob(job *engine.Job) *Config {
 	if dnsSearch := job.GetenvList("DnsSearch"); dnsSearch != nil {
 		config.DnsSearch = dnsSearch
 	}
+	if graphOptions := job.GetenvList("GraphOptions"); graphOptions != nil {
+		config.GraphOptions = graphOptions
+	}
+	if mirrors := job.GetenvList("Mirrors"); mirrors != nil {
+		config.Mirrors = mirrors
+	}
+	if insecureRegistries := job.GetenvList("InsecureRegistries"); insecureRegistries != nil {
+		config.InsecureRegistries = insecureRegistries
+	}
 	if mtu := job.GetenvInt("Mtu"); mtu != 0 {
 		config.Mtu = mtu
 	} else {
 		config.Mtu = GetDefaultNetworkMtu()
 	}
+	if n := job.GetenvInt("MaxConcurrentDownloads"); n > 0 {
+		config.MaxConcurrentDownloads = n
+	} else {
+		config.MaxConcurrentDownloads = defaultMaxConcurrentDownloads
+	}
+	if n := job.GetenvInt("MaxConcurrentUploads"); n > 0 {
+		config.MaxConcurrentUploads = n
+	} else {
+		config.MaxConcurrentUploads = defaultMaxConcurrentUploads
+	}
 	config.DisableNetwork = config.BridgeIface == DisableNetworkBridge
 
 	return config
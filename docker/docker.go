@@ -17,6 +17,7 @@ import (
 	"github.com/dotcloud/docker/engine"
 	"github.com/dotcloud/docker/opts"
 	flag "github.com/dotcloud/docker/pkg/mflag"
+	"github.com/dotcloud/docker/registry"
 	"github.com/dotcloud/docker/sysinit"
 	"github.com/dotcloud/docker/utils"
 )
@@ -25,6 +26,7 @@ const (
 	defaultCaFile   = "ca.pem"
 	defaultKeyFile  = "key.pem"
 	defaultCertFile = "cert.pem"
+	defaultTrustDir = "trust"
 )
 
 var (
@@ -58,6 +60,10 @@ func main() {
 		flGraphDriver        = flag.String([]string{"s", "-storage-driver"}, "", "Force the docker runtime to use a specific storage driver")
 		flExecDriver         = flag.String([]string{"e", "-exec-driver"}, "native", "Force the docker runtime to use a specific exec driver")
 		flHosts              = opts.NewListOpts(api.ValidateHost)
+		flGraphOpts          opts.ListOpts
+		flRegistryMirrors    = opts.NewListOpts(registry.ValidateMirror)
+		flInsecureRegistries = opts.NewListOpts(registry.ValidateInsecureRegistry)
+		flMigrateStorage     = flag.String([]string{"-migrate-storage"}, "", "Copy the images and containers of a storage driver to another one, then exit\nuse from=<driver>,to=<driver> while the daemon is stopped")
 		flMtu                = flag.Int([]string{"#mtu", "-mtu"}, 0, "Set the containers network MTU\nif no value is provided: default to the default route MTU or 1500 if no default route is available")
 		flTls                = flag.Bool([]string{"-tls"}, false, "Use TLS; implied by tls-verify flags")
 		flTlsVerify          = flag.Bool([]string{"-tlsverify"}, false, "Use TLS and verify the remote (daemon: verify client, client: verify daemon)")
@@ -65,9 +71,15 @@ func main() {
 		flCert               = flag.String([]string{"-tlscert"}, dockerConfDir+defaultCertFile, "Path to TLS certificate file")
 		flKey                = flag.String([]string{"-tlskey"}, dockerConfDir+defaultKeyFile, "Path to TLS key file")
 		flSelinuxEnabled     = flag.Bool([]string{"-selinux-enabled"}, false, "Enable selinux support")
+		flMaxDownloads       = flag.Int([]string{"-max-concurrent-downloads"}, 3, "Set the maximum number of layers downloaded at the same time by the pulls")
+		flMaxUploads         = flag.Int([]string{"-max-concurrent-uploads"}, 5, "Set the maximum number of layers uploaded at the same time by the pushes")
+		flTrust              = flag.Bool([]string{"-trust"}, false, "Sign the pushed tags, and only pull and run the images signed by a trusted key\nthe keys are kept in "+dockerConfDir+defaultTrustDir)
 	)
 	flag.Var(&flDns, []string{"#dns", "-dns"}, "Force docker to use specific DNS servers")
 	flag.Var(&flDnsSearch, []string{"-dns-search"}, "Force Docker to use specific DNS search domains")
+	flag.Var(&flGraphOpts, []string{"-storage-opt"}, "Set storage driver options")
+	flag.Var(&flRegistryMirrors, []string{"-registry-mirror"}, "Specify a preferred Docker registry mirror for the pulls from the index")
+	flag.Var(&flInsecureRegistries, []string{"-insecure-registry"}, "Allow plain http or unverified https with a registry, given by hostname or CIDR network\nthe registries on the loopback interface are always allowed")
 	flag.Var(&flHosts, []string{"H", "-host"}, "The socket(s) to bind to in daemon mode\nspecified using one or more tcp://host:port, unix:///path/to/socket, fd://* or fd://socketfd.")
 
 	flag.Parse()
@@ -138,6 +150,23 @@ func main() {
 		if err := builtins.Register(eng); err != nil {
 			log.Fatal(err)
 		}
+
+		if *flMigrateStorage != "" {
+			from, to, err := parseMigrateStorage(*flMigrateStorage)
+			if err != nil {
+				log.Fatal(err)
+			}
+			job := eng.Job("migrate_storage", from, to)
+			job.Setenv("Pidfile", *pidfile)
+			job.Setenv("Root", realRoot)
+			job.SetenvList("GraphOptions", flGraphOpts.GetAll())
+			job.Stdout.Add(os.Stdout)
+			if err := job.Run(); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
 		// load the daemon in the background so we can immediately start
 		// the http api so that connections don't fail while the daemon
 		// is booting
@@ -156,9 +185,16 @@ func main() {
 			job.Setenv("DefaultIp", *flDefaultIp)
 			job.SetenvBool("InterContainerCommunication", *flInterContainerComm)
 			job.Setenv("GraphDriver", *flGraphDriver)
+			job.SetenvList("GraphOptions", flGraphOpts.GetAll())
 			job.Setenv("ExecDriver", *flExecDriver)
 			job.SetenvInt("Mtu", *flMtu)
 			job.SetenvBool("EnableSelinuxSupport", *flSelinuxEnabled)
+			job.SetenvList("Mirrors", flRegistryMirrors.GetAll())
+			job.SetenvList("InsecureRegistries", flInsecureRegistries.GetAll())
+			job.SetenvInt("MaxConcurrentDownloads", *flMaxDownloads)
+			job.SetenvInt("MaxConcurrentUploads", *flMaxUploads)
+			job.SetenvBool("Trust", *flTrust)
+			job.Setenv("TrustDir", dockerConfDir+defaultTrustDir)
 			if err := job.Run(); err != nil {
 				log.Fatal(err)
 			}
@@ -249,6 +285,29 @@ func main() {
 	}
 }
 
+// parseMigrateStorage parses the from=<driver>,to=<driver> value of
+// --migrate-storage.
+func parseMigrateStorage(val string) (from, to string, err error) {
+	for _, opt := range strings.Split(val, ",") {
+		key, value, err := utils.ParseKeyValueOpt(opt)
+		if err != nil {
+			return "", "", err
+		}
+		switch key {
+		case "from":
+			from = value
+		case "to":
+			to = value
+		default:
+			return "", "", fmt.Errorf("Invalid --migrate-storage option: %s", key)
+		}
+	}
+	if from == "" || to == "" {
+		return "", "", fmt.Errorf("--migrate-storage needs both from=<driver> and to=<driver>")
+	}
+	return from, to, nil
+}
+
 func showVersion() {
 	fmt.Printf("Docker version %s, build %s\n", dockerversion.VERSION, dockerversion.GITCOMMIT)
 }
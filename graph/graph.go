@@ -155,6 +155,67 @@ func (graph *Graph) Create(layerData archive.ArchiveReader, containerID, contain
 	return img, nil
 }
 
+// Squash creates an image whose layer holds all the changes made by the image
+// id and its parents on top of its ancestor parent. The new image is a child
+// of parent, with the config of id.
+func (graph *Graph) Squash(id, parent, comment string, containerConfig *runconfig.Config) (*image.Image, error) {
+	img, err := graph.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	isAncestor := false
+	if err := img.WalkHistory(func(img *image.Image) error {
+		if img.ID == parent {
+			isAncestor = true
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if !isAncestor || id == parent {
+		return nil, fmt.Errorf("Image %s is not an ancestor of %s", parent, id)
+	}
+
+	layerFs, err := graph.driver.Get(img.ID, "")
+	if err != nil {
+		return nil, err
+	}
+	defer graph.driver.Put(img.ID)
+
+	parentFs, err := graph.driver.Get(parent, "")
+	if err != nil {
+		return nil, err
+	}
+	defer graph.driver.Put(parent)
+
+	changes, err := archive.ChangesDirs(layerFs, parentFs)
+	if err != nil {
+		return nil, err
+	}
+	layer, err := archive.ExportChanges(layerFs, changes)
+	if err != nil {
+		return nil, err
+	}
+	defer layer.Close()
+
+	squashed := &image.Image{
+		ID:              utils.GenerateRandomID(),
+		Parent:          parent,
+		Comment:         comment,
+		Created:         time.Now().UTC(),
+		DockerVersion:   dockerversion.VERSION,
+		Author:          img.Author,
+		Config:          img.Config,
+		ContainerConfig: *containerConfig,
+		Architecture:    runtime.GOARCH,
+		OS:              runtime.GOOS,
+	}
+	if err := graph.Register(nil, layer, squashed); err != nil {
+		return nil, err
+	}
+	return squashed, nil
+}
+
 // Register imports a pre-existing image into the graph.
 // FIXME: pass img as first argument
 func (graph *Graph) Register(jsonData []byte, layerData archive.ArchiveReader, img *image.Image) (err error) {
@@ -409,6 +470,48 @@ func (graph *Graph) Heads() (map[string]*image.Image, error) {
 	return heads, err
 }
 
+// MigrateTo copies the layers of all the images in the graph to driver,
+// parents first, and verifies their content. The graph itself is left
+// untouched: a graph using driver must be created to use the copies.
+func (graph *Graph) MigrateTo(driver graphdriver.Driver, out io.Writer) error {
+	images := make(map[string]*image.Image)
+	if err := graph.walkAll(func(img *image.Image) {
+		images[img.ID] = img
+	}); err != nil {
+		return err
+	}
+
+	migrated := make(map[string]bool)
+	var migrate func(img *image.Image) error
+	migrate = func(img *image.Image) error {
+		if migrated[img.ID] {
+			return nil
+		}
+		if img.Parent != "" {
+			parent, exists := images[img.Parent]
+			if !exists {
+				return fmt.Errorf("Parent %s of image %s not found", img.Parent, img.ID)
+			}
+			if err := migrate(parent); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(out, "Migrating image %s\n", utils.TruncateID(img.ID))
+		if err := graphdriver.MigrateLayer(graph.driver, driver, img.ID, img.Parent); err != nil {
+			return fmt.Errorf("Error migrating image %s: %s", img.ID, err)
+		}
+		migrated[img.ID] = true
+		return nil
+	}
+
+	for _, img := range images {
+		if err := migrate(img); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (graph *Graph) ImageRoot(id string) string {
 	return path.Join(graph.Root, id)
 }
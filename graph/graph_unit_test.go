@@ -0,0 +1,158 @@
+package graph
+
+import (
+	"bytes"
+	"github.com/dotcloud/docker/daemon/graphdriver"
+	"github.com/dotcloud/docker/image"
+	"github.com/dotcloud/docker/runconfig"
+	"github.com/dotcloud/docker/utils"
+	"github.com/dotcloud/docker/vendor/src/code.google.com/p/go/src/pkg/archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// layerTar returns a layer with the given files, and whiteouts for the
+// files whose content is nil.
+func layerTar(files map[string][]byte) (io.Reader, error) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for name, content := range files {
+		if content == nil {
+			name = path.Join(path.Dir(name), ".wh."+path.Base(name))
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: name, Size: int64(len(content)), Mode: 0644}); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func TestMigrateTo(t *testing.T) {
+	tmp, err := utils.TestDirectory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	store := mkTestTagStore(tmp, t)
+	defer store.graph.driver.Cleanup()
+
+	archive, err := fakeTar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	child := &image.Image{ID: "bar", Parent: testImageID}
+	if err := store.graph.Register(nil, archive, child); err != nil {
+		t.Fatal(err)
+	}
+
+	// Use another vfs driver as the destination
+	driver, err := graphdriver.GetDriver("vfs", path.Join(tmp, "dst"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Cleanup()
+
+	out := new(bytes.Buffer)
+	if err := store.graph.MigrateTo(driver, out); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{testImageID, "bar"} {
+		if !driver.Exists(id) {
+			t.Fatalf("Expected image %s to be migrated", id)
+		}
+	}
+
+	// Migrating again only verifies the layers, and fails on those which
+	// differ
+	if err := store.graph.MigrateTo(driver, out); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := driver.Get("bar", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwd := path.Join(dir, "etc", "passwd")
+	if err := ioutil.WriteFile(passwd, []byte("Hello World!\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	driver.Put("bar")
+	if err := store.graph.MigrateTo(driver, out); err == nil {
+		t.Fatal("Expected the migration of a modified layer to fail")
+	}
+	if dir, err = driver.Get("bar", ""); err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Put("bar")
+	content, err := ioutil.ReadFile(passwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "Hello World!\n" {
+		t.Fatalf("Expected the modified layer to be kept, got %q", content)
+	}
+}
+
+func TestSquash(t *testing.T) {
+	tmp, err := utils.TestDirectory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	store := mkTestTagStore(tmp, t)
+	defer store.graph.driver.Cleanup()
+
+	parent := testImageID
+	for _, layer := range []struct {
+		id    string
+		files map[string][]byte
+	}{
+		{"bar", map[string][]byte{"/etc/new": []byte("new\n"), "/etc/passwd": nil}},
+		{"baz", map[string][]byte{"/etc/new": []byte("changed\n")}},
+	} {
+		archive, err := layerTar(layer.files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img := &image.Image{ID: layer.id, Parent: parent, Config: &runconfig.Config{Cmd: []string{layer.id}}}
+		if err := store.graph.Register(nil, archive, img); err != nil {
+			t.Fatal(err)
+		}
+		parent = layer.id
+	}
+
+	if _, err := store.graph.Squash("bar", "baz", "", &runconfig.Config{}); err == nil {
+		t.Fatal("Expected an error when squashing on top of a child")
+	}
+
+	img, err := store.graph.Squash("baz", testImageID, "Squashed 2 steps", &runconfig.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Parent != testImageID || img.Config == nil || img.Config.Cmd[0] != "baz" {
+		t.Fatalf("Unexpected squashed image: %#v", img)
+	}
+
+	dir, err := store.graph.driver.Get(img.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.graph.driver.Put(img.ID)
+	if content, err := ioutil.ReadFile(path.Join(dir, "etc", "new")); err != nil || string(content) != "changed\n" {
+		t.Fatalf("Expected /etc/new to be changed, got %q (%v)", content, err)
+	}
+	if _, err := os.Stat(path.Join(dir, "etc", "passwd")); !os.IsNotExist(err) {
+		t.Fatalf("Expected /etc/passwd to be removed, got %v", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "etc", "postgres", "postgres.conf")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -129,14 +129,18 @@ func (s *TagStore) CmdGet(job *engine.Job) engine.Status {
 	return engine.StatusOK
 }
 
-// CmdLookup return an image encoded in JSON
+// CmdLookup return an image encoded in JSON, along with the digests
+// referring to it
 func (s *TagStore) CmdLookup(job *engine.Job) engine.Status {
 	if len(job.Args) != 1 {
 		return job.Errorf("usage: %s NAME", job.Name)
 	}
 	name := job.Args[0]
-	if image, err := s.LookupImage(name); err == nil && image != nil {
-		b, err := json.Marshal(image)
+	if img, err := s.LookupImage(name); err == nil && img != nil {
+		b, err := json.Marshal(struct {
+			*image.Image
+			RepoDigests []string `json:",omitempty"`
+		}{img, s.DigestsByID()[img.ID]})
 		if err != nil {
 			return job.Error(err)
 		}
@@ -18,6 +18,9 @@ type TagStore struct {
 	path         string
 	graph        *Graph
 	Repositories map[string]Repository
+	// Images by manifest digest, for each repository. The digests are
+	// recorded when images are pulled or pushed.
+	Digests map[string]Repository `json:",omitempty"`
 }
 
 type Repository map[string]string
@@ -31,6 +34,7 @@ func NewTagStore(path string, graph *Graph) (*TagStore, error) {
 		path:         abspath,
 		graph:        graph,
 		Repositories: make(map[string]Repository),
+		Digests:      make(map[string]Repository),
 	}
 	// Load the json file if it exists, otherwise create it.
 	if err := store.Reload(); os.IsNotExist(err) {
@@ -102,6 +106,19 @@ func (store *TagStore) ByID() map[string][]string {
 	return byID
 }
 
+// DigestsByID returns a reverse-lookup table of the digest references of
+// each image, e.g. {"43b5f19b10584": {"base@sha256:2c26b46b68ff"}}
+func (store *TagStore) DigestsByID() map[string][]string {
+	byID := make(map[string][]string)
+	for repoName, digests := range store.Digests {
+		for digest, id := range digests {
+			byID[id] = append(byID[id], repoName+"@"+digest)
+			sort.Strings(byID[id])
+		}
+	}
+	return byID
+}
+
 func (store *TagStore) ImageName(id string) string {
 	if names, exists := store.ByID()[id]; exists && len(names) > 0 {
 		return names[0]
@@ -110,6 +127,12 @@ func (store *TagStore) ImageName(id string) string {
 }
 
 func (store *TagStore) DeleteAll(id string) error {
+	for _, name := range store.DigestsByID()[id] {
+		repoName, digest := utils.ParseRepositoryTag(name)
+		if _, err := store.Delete(repoName, digest); err != nil {
+			return err
+		}
+	}
 	names, exists := store.ByID()[id]
 	if !exists || len(names) == 0 {
 		return nil
@@ -134,6 +157,16 @@ func (store *TagStore) Delete(repoName, tag string) (bool, error) {
 	if err := store.Reload(); err != nil {
 		return false, err
 	}
+	if utils.IsDigest(tag) {
+		if _, exists := store.Digests[repoName][tag]; !exists {
+			return false, fmt.Errorf("No such digest: %s@%s", repoName, tag)
+		}
+		delete(store.Digests[repoName], tag)
+		if len(store.Digests[repoName]) == 0 {
+			delete(store.Digests, repoName)
+		}
+		return true, store.Save()
+	}
 	if r, exists := store.Repositories[repoName]; exists {
 		if tag != "" {
 			if _, exists2 := r[tag]; exists2 {
@@ -186,6 +219,32 @@ func (store *TagStore) Set(repoName, tag, imageName string, force bool) error {
 	return store.Save()
 }
 
+// SetDigest records that the manifest digest of the repository repoName
+// refers to the image imageName.
+func (store *TagStore) SetDigest(repoName, digest, imageName string) error {
+	img, err := store.LookupImage(imageName)
+	if err != nil {
+		return err
+	}
+	if err := validateRepoName(repoName); err != nil {
+		return err
+	}
+	if !utils.IsDigest(digest) {
+		return fmt.Errorf("Illegal digest: %s", digest)
+	}
+	if err := store.Reload(); err != nil {
+		return err
+	}
+	if store.Digests == nil {
+		store.Digests = make(map[string]Repository)
+	}
+	if _, exists := store.Digests[repoName]; !exists {
+		store.Digests[repoName] = make(Repository)
+	}
+	store.Digests[repoName][digest] = img.ID
+	return store.Save()
+}
+
 func (store *TagStore) Get(repoName string) (Repository, error) {
 	if err := store.Reload(); err != nil {
 		return nil, err
@@ -197,6 +256,15 @@ func (store *TagStore) Get(repoName string) (Repository, error) {
 }
 
 func (store *TagStore) GetImage(repoName, tagOrID string) (*image.Image, error) {
+	if utils.IsDigest(tagOrID) {
+		if err := store.Reload(); err != nil {
+			return nil, err
+		}
+		if id, exists := store.Digests[repoName][tagOrID]; exists {
+			return store.graph.Get(id)
+		}
+		return nil, nil
+	}
 	repo, err := store.Get(repoName)
 	if err != nil {
 		return nil, err
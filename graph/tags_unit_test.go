@@ -36,7 +36,7 @@ func fakeTar() (io.Reader, error) {
 }
 
 func mkTestTagStore(root string, t *testing.T) *TagStore {
-	driver, err := graphdriver.New(root)
+	driver, err := graphdriver.New(root, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -108,3 +108,53 @@ func TestLookupImage(t *testing.T) {
 		t.Errorf("Expected 1 image, none found")
 	}
 }
+
+func TestLookupImageByDigest(t *testing.T) {
+	tmp, err := utils.TestDirectory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	store := mkTestTagStore(tmp, t)
+	defer store.graph.driver.Cleanup()
+
+	digest := "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	if err := store.SetDigest(testImageName, "latest", testImageID); err == nil {
+		t.Fatal("Expected an error for a tag set as digest")
+	}
+	if err := store.SetDigest(testImageName, digest, testImageID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set(testImageName, digest, testImageID, true); err == nil {
+		t.Fatal("Expected an error for a digest set as tag")
+	}
+
+	if img, err := store.LookupImage(testImageName + "@" + digest); err != nil {
+		t.Fatal(err)
+	} else if img == nil || img.ID != testImageID {
+		t.Fatalf("Expected image %s, got %v", testImageID, img)
+	}
+	if img, err := store.LookupImage(testImageName + "@sha256:0000"); err == nil {
+		t.Errorf("Expected error, none found")
+	} else if img != nil {
+		t.Errorf("Expected 0 image, 1 found")
+	}
+	if names := store.DigestsByID()[testImageID]; len(names) != 1 || names[0] != testImageName+"@"+digest {
+		t.Fatalf("Unexpected digests %v", names)
+	}
+
+	// The digests are saved with the tags
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := store.Digests[testImageName][digest]; !exists {
+		t.Fatal("Expected the digest to be saved")
+	}
+
+	if err := store.DeleteAll(testImageID); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.Digests) != 0 || len(store.Repositories) != 0 {
+		t.Fatalf("Expected the tags and digests to be deleted, got %v and %v", store.Repositories, store.Digests)
+	}
+}
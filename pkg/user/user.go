@@ -74,7 +74,13 @@ func ParsePasswd() ([]*User, error) {
 }
 
 func ParsePasswdFilter(filter func(*User) bool) ([]*User, error) {
-	f, err := os.Open("/etc/passwd")
+	return ParsePasswdFileFilter("/etc/passwd", filter)
+}
+
+// ParsePasswdFileFilter is like ParsePasswdFilter, for the passwd file at
+// path, e.g. in the rootfs of a container.
+func ParsePasswdFileFilter(path string, filter func(*User) bool) ([]*User, error) {
+	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
@@ -122,7 +128,13 @@ func ParseGroup() ([]*Group, error) {
 }
 
 func ParseGroupFilter(filter func(*Group) bool) ([]*Group, error) {
-	f, err := os.Open("/etc/group")
+	return ParseGroupFileFilter("/etc/group", filter)
+}
+
+// ParseGroupFileFilter is like ParseGroupFilter, for the group file at path,
+// e.g. in the rootfs of a container.
+func ParseGroupFileFilter(path string, filter func(*Group) bool) ([]*Group, error) {
+	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
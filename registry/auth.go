@@ -34,10 +34,19 @@ type AuthConfig struct {
 }
 
 type ConfigFile struct {
-	Configs  map[string]AuthConfig `json:"configs,omitempty"`
+	Configs map[string]AuthConfig `json:"configs,omitempty"`
+	// The credential helpers keeping the credentials of the registries,
+	// instead of the config file
+	Helpers  map[string]string `json:"-"`
 	rootPath string
 }
 
+// configEntry is the entry of a registry in the config file.
+type configEntry struct {
+	AuthConfig
+	Helper string `json:"helper,omitempty"`
+}
+
 func IndexServerAddress() string {
 	return INDEXSERVER
 }
@@ -74,7 +83,7 @@ func decodeAuth(authStr string) (string, string, error) {
 // load up the auth config information and return values
 // FIXME: use the internal golang config parser
 func LoadConfig(rootPath string) (*ConfigFile, error) {
-	configFile := ConfigFile{Configs: make(map[string]AuthConfig), rootPath: rootPath}
+	configFile := ConfigFile{Configs: make(map[string]AuthConfig), Helpers: make(map[string]string), rootPath: rootPath}
 	confFile := path.Join(rootPath, CONFIGFILE)
 	if _, err := os.Stat(confFile); err != nil {
 		return &configFile, nil //missing file is not an error
@@ -84,7 +93,8 @@ func LoadConfig(rootPath string) (*ConfigFile, error) {
 		return &configFile, err
 	}
 
-	if err := json.Unmarshal(b, &configFile.Configs); err != nil {
+	entries := make(map[string]configEntry)
+	if err := json.Unmarshal(b, &entries); err != nil {
 		arr := strings.Split(string(b), "\n")
 		if len(arr) < 2 {
 			return &configFile, fmt.Errorf("The Auth config file is empty")
@@ -106,9 +116,12 @@ func LoadConfig(rootPath string) (*ConfigFile, error) {
 		authConfig.ServerAddress = IndexServerAddress()
 		configFile.Configs[IndexServerAddress()] = authConfig
 	} else {
-		for k, authConfig := range configFile.Configs {
-			authConfig.Username, authConfig.Password, err = decodeAuth(authConfig.Auth)
-			if err != nil {
+		for k, entry := range entries {
+			authConfig := entry.AuthConfig
+			if entry.Helper != "" {
+				// The credentials are only fetched from the helper when needed
+				configFile.Helpers[k] = entry.Helper
+			} else if authConfig.Username, authConfig.Password, err = decodeAuth(authConfig.Auth); err != nil {
 				return &configFile, err
 			}
 			authConfig.Auth = ""
@@ -127,15 +140,20 @@ func SaveConfig(configFile *ConfigFile) error {
 		return nil
 	}
 
-	configs := make(map[string]AuthConfig, len(configFile.Configs))
+	configs := make(map[string]configEntry, len(configFile.Configs))
 	for k, authConfig := range configFile.Configs {
 		authCopy := authConfig
 
-		authCopy.Auth = encodeAuth(&authCopy)
+		helper := configFile.Helpers[k]
+		if helper == "" {
+			authCopy.Auth = encodeAuth(&authCopy)
+		} else {
+			authCopy.Auth = ""
+		}
 		authCopy.Username = ""
 		authCopy.Password = ""
 		authCopy.ServerAddress = ""
-		configs[k] = authCopy
+		configs[k] = configEntry{AuthConfig: authCopy, Helper: helper}
 	}
 
 	b, err := json.Marshal(configs)
@@ -155,7 +173,7 @@ func Login(authConfig *AuthConfig, factory *utils.HTTPRequestFactory) (string, e
 		status        string
 		reqBody       []byte
 		err           error
-		client        = &http.Client{}
+		client        = &http.Client{Transport: newTransport(false)}
 		reqStatusCode = 0
 		serverAddress = authConfig.ServerAddress
 	)
@@ -253,14 +271,68 @@ func Login(authConfig *AuthConfig, factory *utils.HTTPRequestFactory) (string, e
 
 // this method matches a auth configuration to a server address or a url
 func (config *ConfigFile) ResolveAuthConfig(hostname string) AuthConfig {
+	return config.Configs[config.resolveServerAddress(hostname)]
+}
+
+// GetAuthConfig matches an auth configuration to a server address or a url
+// like ResolveAuthConfig, and fetches its credentials from its credential
+// helper if it has one.
+func (config *ConfigFile) GetAuthConfig(hostname string) (AuthConfig, error) {
+	serverAddress := config.resolveServerAddress(hostname)
+	authConfig, exists := config.Configs[serverAddress]
+	helper := config.Helpers[serverAddress]
+	if !exists || helper == "" || authConfig.Username != "" {
+		return authConfig, nil
+	}
+
+	username, password, err := getHelperCredentials(helper, serverAddress)
+	if err != nil {
+		return AuthConfig{}, err
+	}
+	authConfig.Username = username
+	authConfig.Password = password
+	authConfig.ServerAddress = serverAddress
+	config.Configs[serverAddress] = authConfig
+	return authConfig, nil
+}
+
+// StoreCredentials stores the credentials for serverAddress with its
+// credential helper if it has one. Otherwise they are only stored in the
+// config file by SaveConfig.
+func (config *ConfigFile) StoreCredentials(serverAddress string) error {
+	helper := config.Helpers[serverAddress]
+	if helper == "" {
+		return nil
+	}
+	return storeHelperCredentials(helper, serverAddress, config.Configs[serverAddress])
+}
+
+// EraseCredentials removes the credentials for serverAddress. The registry
+// keeps its credential helper, if any, for the next login.
+func (config *ConfigFile) EraseCredentials(serverAddress string) error {
+	helper := config.Helpers[serverAddress]
+	if helper == "" {
+		delete(config.Configs, serverAddress)
+		return nil
+	}
+	if err := eraseHelperCredentials(helper, serverAddress); err != nil {
+		return err
+	}
+	config.Configs[serverAddress] = AuthConfig{Email: config.Configs[serverAddress].Email}
+	return nil
+}
+
+// resolveServerAddress returns the server address of the auth
+// configuration matching hostname, or an empty string if there is none.
+func (config *ConfigFile) resolveServerAddress(hostname string) string {
 	if hostname == IndexServerAddress() || len(hostname) == 0 {
 		// default to the index server
-		return config.Configs[IndexServerAddress()]
+		return IndexServerAddress()
 	}
 
 	// First try the happy case
-	if c, found := config.Configs[hostname]; found {
-		return c
+	if _, found := config.Configs[hostname]; found {
+		return hostname
 	}
 
 	convertToHostname := func(url string) string {
@@ -279,12 +351,12 @@ func (config *ConfigFile) ResolveAuthConfig(hostname string) AuthConfig {
 	// Maybe they have a legacy config file, we will iterate the keys converting
 	// them to the new format and testing
 	normalizedHostename := convertToHostname(hostname)
-	for registry, config := range config.Configs {
+	for registry := range config.Configs {
 		if registryHostname := convertToHostname(registry); registryHostname == normalizedHostename {
-			return config
+			return registry
 		}
 	}
 
-	// When all else fails, return an empty auth config
-	return AuthConfig{}
+	// When all else fails, there is no auth config
+	return ""
 }
@@ -1,8 +1,10 @@
 package registry
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
+	"path"
 	"testing"
 )
 
@@ -147,3 +149,104 @@ func TestResolveAuthConfigFullURL(t *testing.T) {
 		}
 	}
 }
+
+// A credential helper keeping the credentials in files of its directory
+const testCredentialHelper = `#!/bin/sh
+dir=$(dirname "$0")
+case "$1" in
+get)
+	server=$(cat)
+	file="$dir/$(echo "$server" | tr -c 'a-zA-Z0-9\n' _)"
+	if [ ! -f "$file" ]; then
+		echo "credentials not found in native keychain"
+		exit 1
+	fi
+	cat "$file"
+	;;
+store)
+	input=$(cat)
+	server=$(echo "$input" | sed 's/.*"ServerURL":"\([^"]*\)".*/\1/')
+	echo "$input" > "$dir/$(echo "$server" | tr -c 'a-zA-Z0-9\n' _)"
+	;;
+erase)
+	server=$(cat)
+	rm -f "$dir/$(echo "$server" | tr -c 'a-zA-Z0-9\n' _)"
+	;;
+esac
+`
+
+func TestCredentialHelper(t *testing.T) {
+	configFile, err := setupTempConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(configFile.rootPath)
+
+	helperDir := path.Join(configFile.rootPath, "bin")
+	if err := os.Mkdir(helperDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(helperDir, "docker-credential-test"), []byte(testCredentialHelper), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", helperDir+":"+os.Getenv("PATH"))
+
+	configFile.Helpers = map[string]string{"testIndex": "test"}
+	if err := configFile.StoreCredentials("testIndex"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveConfig(configFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// The password is kept by the helper, not in the config file
+	b, err := ioutil.ReadFile(path.Join(configFile.rootPath, CONFIGFILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]configEntry)
+	if err := json.Unmarshal(b, &entries); err != nil {
+		t.Fatal(err)
+	}
+	if entry := entries["testIndex"]; entry.Helper != "test" || entry.Auth != "" {
+		t.Fatalf("Unexpected config file %s", b)
+	}
+	if entry := entries[IndexServerAddress()]; entry.Helper != "" || entry.Auth == "" {
+		t.Fatalf("Unexpected config file %s", b)
+	}
+
+	loaded, err := LoadConfig(configFile.rootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Configs["testIndex"].Username != "" {
+		t.Fatal("Expected the credentials not to be fetched before they are needed")
+	}
+	authConfig, err := loaded.GetAuthConfig("testIndex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authConfig.Username != "docker-user" || authConfig.Password != "docker-pass" || authConfig.Email != "docker@docker.io" {
+		t.Fatalf("Unexpected credentials %+v", authConfig)
+	}
+	if authConfig, err = loaded.GetAuthConfig(IndexServerAddress()); err != nil || authConfig.Password != "docker-pass" {
+		t.Fatalf("Expected the credentials of the config file, got %+v (%v)", authConfig, err)
+	}
+
+	if err := loaded.EraseCredentials("testIndex"); err != nil {
+		t.Fatal(err)
+	}
+	if authConfig, err = loaded.GetAuthConfig("testIndex"); err != nil || authConfig.Username != "" {
+		t.Fatalf("Expected no credentials after erasing them, got %+v (%v)", authConfig, err)
+	}
+	if loaded.Helpers["testIndex"] != "test" {
+		t.Fatal("Expected the helper to be kept for the next login")
+	}
+
+	loaded.Helpers["testIndex"] = "missing"
+	loaded.Configs["testIndex"] = AuthConfig{Email: "docker@docker.io"}
+	if _, err := loaded.GetAuthConfig("testIndex"); err == nil {
+		t.Fatal("Expected an error with a missing helper")
+	}
+}
@@ -0,0 +1,84 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// A credential helper is a program named docker-credential-<helper> which
+// keeps the credentials of the registries, e.g. in the keychain of the
+// system, instead of the config file. It is run with the action get, store
+// or erase as argument. get and erase read the address of the registry on
+// stdin, store reads the credentials in JSON, and get writes them to stdout.
+const credentialHelperPrefix = "docker-credential-"
+
+// The message of the helpers which have no credentials for a registry.
+const credentialsNotFound = "credentials not found"
+
+type helperCredentials struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+// runCredentialHelper runs the action of the helper with input on its stdin,
+// and returns its stdout.
+func runCredentialHelper(helper, action string, input []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(credentialHelperPrefix+helper, action)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stdout.String() + stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return nil, fmt.Errorf("Error running the credential helper %s %s: %s", credentialHelperPrefix+helper, action, msg)
+	}
+	return stdout.Bytes(), nil
+}
+
+// getHelperCredentials returns the username and password the helper keeps
+// for serverAddress, which are empty if it has none.
+func getHelperCredentials(helper, serverAddress string) (string, string, error) {
+	output, err := runCredentialHelper(helper, "get", []byte(serverAddress))
+	if err != nil {
+		if strings.Contains(err.Error(), credentialsNotFound) {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+	var creds helperCredentials
+	if err := json.Unmarshal(output, &creds); err != nil {
+		return "", "", fmt.Errorf("Invalid output of the credential helper %s: %s", credentialHelperPrefix+helper, err)
+	}
+	return creds.Username, creds.Secret, nil
+}
+
+// storeHelperCredentials stores the credentials of authConfig for
+// serverAddress with the helper.
+func storeHelperCredentials(helper, serverAddress string, authConfig AuthConfig) error {
+	input, err := json.Marshal(&helperCredentials{
+		ServerURL: serverAddress,
+		Username:  authConfig.Username,
+		Secret:    authConfig.Password,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = runCredentialHelper(helper, "store", input)
+	return err
+}
+
+// eraseHelperCredentials removes the credentials the helper keeps for
+// serverAddress.
+func eraseHelperCredentials(helper, serverAddress string) error {
+	if _, err := runCredentialHelper(helper, "erase", []byte(serverAddress)); err != nil && !strings.Contains(err.Error(), credentialsNotFound) {
+		return err
+	}
+	return nil
+}
@@ -4,21 +4,22 @@ import (
 	"bytes"
 	"crypto/sha256"
 	_ "crypto/sha512"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
-	"time"
 
+	"github.com/dotcloud/docker/archive"
 	"github.com/dotcloud/docker/dockerversion"
 	"github.com/dotcloud/docker/utils"
 )
@@ -35,21 +36,7 @@ func pingRegistryEndpoint(endpoint string) (RegistryInfo, error) {
 		// (and we never want to fallback to http in case of error)
 		return RegistryInfo{Standalone: false}, nil
 	}
-	httpDial := func(proto string, addr string) (net.Conn, error) {
-		// Set the connect timeout to 5 seconds
-		conn, err := net.DialTimeout(proto, addr, time.Duration(5)*time.Second)
-		if err != nil {
-			return nil, err
-		}
-		// Set the recv timeout to 10 seconds
-		conn.SetDeadline(time.Now().Add(time.Duration(10) * time.Second))
-		return conn, nil
-	}
-	httpTransport := &http.Transport{
-		Dial:  httpDial,
-		Proxy: http.ProxyFromEnvironment,
-	}
-	client := &http.Client{Transport: httpTransport}
+	client := &http.Client{Transport: newTransport(true)}
 	resp, err := client.Get(endpoint + "_ping")
 	if err != nil {
 		return RegistryInfo{Standalone: false}, err
@@ -148,6 +135,9 @@ func ExpandAndVerifyRegistryUrl(hostname string) (string, error) {
 			// there is no path given. Expand with default path
 			hostname = hostname + "/v1/"
 		}
+		if u, err := url.Parse(hostname); err == nil && u.Scheme == "http" && IsSecure(u.Host) {
+			return "", fmt.Errorf("Invalid Registry endpoint %s: plain http is only allowed for the registries given with --insecure-registry", hostname)
+		}
 		if _, err := pingRegistryEndpoint(hostname); err != nil {
 			return "", errors.New("Invalid Registry endpoint: " + err.Error())
 		}
@@ -155,6 +145,9 @@ func ExpandAndVerifyRegistryUrl(hostname string) (string, error) {
 	}
 	endpoint := fmt.Sprintf("https://%s/v1/", hostname)
 	if _, err := pingRegistryEndpoint(endpoint); err != nil {
+		if IsSecure(hostname) {
+			return "", fmt.Errorf("Invalid Registry endpoint %s: %s. If this registry uses plain http or a certificate signed by an unknown CA, add --insecure-registry %s to the daemon options, or put its CA certificate in %s", endpoint, err, hostname, filepath.Join(CertsDir, hostname, "ca.crt"))
+		}
 		utils.Debugf("Registry %s does not work (%s), falling back to http", endpoint, err)
 		endpoint = fmt.Sprintf("http://%s/v1/", hostname)
 		if _, err = pingRegistryEndpoint(endpoint); err != nil {
@@ -165,6 +158,28 @@ func ExpandAndVerifyRegistryUrl(hostname string) (string, error) {
 	return endpoint, nil
 }
 
+// ValidateMirror checks that val is the URL of a registry mirror, e.g.
+// https://mirror.example.com, and returns the endpoint of its v1 API.
+func ValidateMirror(val string) (string, error) {
+	u, err := url.Parse(val)
+	if err != nil {
+		return "", fmt.Errorf("Invalid registry mirror %s: %s", val, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("Invalid registry mirror %s: the scheme must be http or https", val)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("Invalid registry mirror %s: no host given", val)
+	}
+	if path := strings.TrimSuffix(u.Path, "/"); path != "" && path != "/v1" {
+		return "", fmt.Errorf("Invalid registry mirror %s: unsupported path %s", val, u.Path)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("Invalid registry mirror %s: unexpected query or fragment", val)
+	}
+	return fmt.Sprintf("%s://%s/v1/", u.Scheme, u.Host), nil
+}
+
 func setTokenAuth(req *http.Request, token []string) {
 	if req.Header.Get("Authorization") == "" { // Don't override
 		req.Header.Set("Authorization", "Token "+strings.Join(token, ","))
@@ -224,20 +239,23 @@ func (r *Registry) LookupRemoteImage(imgID, registry string, token []string) boo
 }
 
 // Retrieve an image from the Registry.
-func (r *Registry) GetRemoteImageJSON(imgID, registry string, token []string) ([]byte, int, error) {
+// GetRemoteImageJSON returns the json of the image imgID, the size of its
+// layer and the checksum of the layer, which is empty if the registry
+// doesn't give it.
+func (r *Registry) GetRemoteImageJSON(imgID, registry string, token []string) ([]byte, int, string, error) {
 	// Get the JSON
 	req, err := r.reqFactory.NewRequest("GET", registry+"images/"+imgID+"/json", nil)
 	if err != nil {
-		return nil, -1, fmt.Errorf("Failed to download json: %s", err)
+		return nil, -1, "", fmt.Errorf("Failed to download json: %s", err)
 	}
 	setTokenAuth(req, token)
 	res, err := r.client.Do(req)
 	if err != nil {
-		return nil, -1, fmt.Errorf("Failed to download json: %s", err)
+		return nil, -1, "", fmt.Errorf("Failed to download json: %s", err)
 	}
 	defer res.Body.Close()
 	if res.StatusCode != 200 {
-		return nil, -1, utils.NewHTTPRequestError(fmt.Sprintf("HTTP code %d", res.StatusCode), res)
+		return nil, -1, "", utils.NewHTTPRequestError(fmt.Sprintf("HTTP code %d", res.StatusCode), res)
 	}
 
 	// if the size header is not present, then set it to '-1'
@@ -245,33 +263,89 @@ func (r *Registry) GetRemoteImageJSON(imgID, registry string, token []string) ([
 	if hdr := res.Header.Get("X-Docker-Size"); hdr != "" {
 		imageSize, err = strconv.Atoi(hdr)
 		if err != nil {
-			return nil, -1, err
+			return nil, -1, "", err
 		}
 	}
 
+	// The checksum of the payload is cheaper to verify than the tarsum
+	checksum := res.Header.Get("X-Docker-Checksum-Payload")
+	if checksum == "" {
+		checksum = res.Header.Get("X-Docker-Checksum")
+	}
+
 	jsonString, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return nil, -1, fmt.Errorf("Failed to parse downloaded json: %s (%s)", err, jsonString)
+		return nil, -1, "", fmt.Errorf("Failed to parse downloaded json: %s (%s)", err, jsonString)
 	}
-	return jsonString, imageSize, nil
+	return jsonString, imageSize, checksum, nil
 }
 
-func (r *Registry) GetRemoteImageLayer(imgID, registry string, token []string) (io.ReadCloser, error) {
+// GetRemoteImageLayer returns the layer of the image imgID from the offset
+// byte on, and the offset the layer actually starts at, which is 0 if the
+// registry doesn't support ranges.
+func (r *Registry) GetRemoteImageLayer(imgID, registry string, token []string, offset int64) (io.ReadCloser, int64, error) {
 	req, err := r.reqFactory.NewRequest("GET", registry+"images/"+imgID+"/layer", nil)
 	if err != nil {
-		return nil, fmt.Errorf("Error while getting from the server: %s\n", err)
+		return nil, 0, fmt.Errorf("Error while getting from the server: %s\n", err)
 	}
 	setTokenAuth(req, token)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
 	res, err := r.client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	switch res.StatusCode {
+	case 200:
+		return res.Body, 0, nil
+	case 206:
+		var start int64
+		if _, err := fmt.Sscanf(res.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			res.Body.Close()
+			return nil, 0, fmt.Errorf("Invalid range %q while fetching image layer (%s) from byte %d", res.Header.Get("Content-Range"), imgID, offset)
+		}
+		return res.Body, offset, nil
 	}
-	if res.StatusCode != 200 {
-		res.Body.Close()
-		return nil, fmt.Errorf("Server error: Status %d while fetching image layer (%s)",
-			res.StatusCode, imgID)
+	res.Body.Close()
+	return nil, 0, utils.NewHTTPRequestError(fmt.Sprintf("Server error: Status %d while fetching image layer (%s)",
+		res.StatusCode, imgID), res)
+}
+
+// VerifyLayerChecksum checks the layer of an image against the checksum the
+// registry gives for it, either a sha256 of the json of the image and the
+// layer, or the tarsum of the content of the layer. Checksums in other
+// formats are not verified, as when the registry gives none.
+func VerifyLayerChecksum(layer io.Reader, jsonRaw []byte, checksum string) error {
+	var sum string
+	switch {
+	case strings.HasPrefix(checksum, "sha256:"):
+		h := sha256.New()
+		h.Write(jsonRaw)
+		h.Write([]byte{'\n'})
+		if _, err := io.Copy(h, layer); err != nil {
+			return err
+		}
+		sum = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	case strings.HasPrefix(checksum, "tarsum+sha256:"):
+		decompressed, err := archive.DecompressStream(layer)
+		if err != nil {
+			return err
+		}
+		defer decompressed.Close()
+		tarsum := &utils.TarSum{Reader: decompressed}
+		if _, err := io.Copy(ioutil.Discard, tarsum); err != nil {
+			return err
+		}
+		sum = tarsum.Sum(jsonRaw)
+	default:
+		utils.Debugf("Unsupported checksum %s, not verifying the layer", checksum)
+		return nil
 	}
-	return res.Body, nil
+	if sum != checksum {
+		return fmt.Errorf("Checksum mismatch: expected %s, got %s", checksum, sum)
+	}
+	return nil
 }
 
 func (r *Registry) GetRemoteTags(registries []string, repository string, token []string) (map[string]string, error) {
@@ -646,9 +720,21 @@ func (r *Registry) PushImageJSONIndex(remote string, imgList []*ImgData, validat
 	}, nil
 }
 
-func (r *Registry) SearchRepositories(term string) (*SearchResults, error) {
+// SearchRepositories returns the page of the results of the search of term
+// on the registry, pages having pageSize results. The registry picks the
+// page size if it is 0. The registries which don't page their results
+// return them all, with a page size of 0.
+func (r *Registry) SearchRepositories(term string, pageSize, page int) (*SearchResults, error) {
 	utils.Debugf("Index server: %s", r.indexEndpoint)
-	u := r.indexEndpoint + "search?q=" + url.QueryEscape(term)
+	v := url.Values{}
+	v.Set("q", term)
+	if pageSize > 0 {
+		v.Set("n", strconv.Itoa(pageSize))
+	}
+	if page > 0 {
+		v.Set("page", strconv.Itoa(page))
+	}
+	u := r.indexEndpoint + "search?" + v.Encode()
 	req, err := r.reqFactory.NewRequest("GET", u, nil)
 	if err != nil {
 		return nil, err
@@ -697,6 +783,9 @@ type SearchResult struct {
 type SearchResults struct {
 	Query      string         `json:"query"`
 	NumResults int            `json:"num_results"`
+	NumPages   int            `json:"num_pages"`
+	Page       int            `json:"page"`
+	PageSize   int            `json:"page_size"`
 	Results    []SearchResult `json:"results"`
 }
 
@@ -726,15 +815,10 @@ type Registry struct {
 }
 
 func NewRegistry(authConfig *AuthConfig, factory *utils.HTTPRequestFactory, indexEndpoint string) (r *Registry, err error) {
-	httpTransport := &http.Transport{
-		DisableKeepAlives: true,
-		Proxy:             http.ProxyFromEnvironment,
-	}
-
 	r = &Registry{
 		authConfig: authConfig,
 		client: &http.Client{
-			Transport: httpTransport,
+			Transport: newTokenTransport(newTransport(false), authConfig),
 		},
 		indexEndpoint: indexEndpoint,
 	}
@@ -12,6 +12,8 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -77,6 +79,15 @@ var (
 			"latest": "42d718c941f5c532ac049bf0b0ab53f0062f09a03afd4aa4a02c098e46032b9d",
 		},
 	}
+
+	// Blobs, manifests by repository and tag or digest, and uploads in
+	// progress of the v2 registry
+	testBlobs     = map[string][]byte{}
+	testManifests = map[string]map[string][]byte{}
+	testUploads   = map[string][]byte{}
+	// Number of PATCH requests to fail after storing half of their chunk
+	testFailChunks int
+	testV2Lock     sync.Mutex
 )
 
 func init() {
@@ -91,6 +102,13 @@ func init() {
 	r.HandleFunc("/v1/repositories/{repository:.+}{action:/images|/}", handlerImages).Methods("GET", "PUT", "DELETE")
 	r.HandleFunc("/v1/repositories/{repository:.+}/auth", handlerAuth).Methods("PUT")
 	r.HandleFunc("/v1/search", handlerSearch).Methods("GET")
+	r.HandleFunc("/v2/", handlerGetPingV2).Methods("GET")
+	r.HandleFunc("/v2/{repository:.+}/tags/list", handlerGetTagsV2).Methods("GET")
+	r.HandleFunc("/v2/{repository:.+}/manifests/{reference:[^/]+}", handlerGetManifestV2).Methods("GET")
+	r.HandleFunc("/v2/{repository:.+}/manifests/{reference:[^/]+}", handlerPutManifestV2).Methods("PUT")
+	r.HandleFunc("/v2/{repository:.+}/blobs/uploads/", handlerStartUploadV2).Methods("POST")
+	r.HandleFunc("/v2/{repository:.+}/blobs/uploads/{uuid:[^/]+}", handlerUploadV2).Methods("GET", "PATCH", "PUT")
+	r.HandleFunc("/v2/{repository:.+}/blobs/{digest:sha256:[a-f0-9]+}", handlerGetBlobV2).Methods("GET", "HEAD")
 	testHttpServer = httptest.NewServer(handlerAccessLog(r))
 }
 
@@ -192,6 +210,11 @@ func handlerGetImage(w http.ResponseWriter, r *http.Request) {
 	writeHeaders(w)
 	layer_size := len(layer["layer"])
 	w.Header().Add("X-Docker-Size", strconv.Itoa(layer_size))
+	if vars["action"] == "layer" {
+		// Support the ranges of resumed downloads
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(layer["layer"]))
+		return
+	}
 	io.WriteString(w, layer[vars["action"]])
 }
 
@@ -320,15 +343,223 @@ func handlerAuth(w http.ResponseWriter, r *http.Request) {
 	writeResponse(w, "OK", 200)
 }
 
+// The results of the searches of "paged", which are paged like the index
+// does, with pages of 3 results at most. All the results are returned when
+// no page size is requested.
+var testPagedSearchResults = []SearchResult{
+	{Name: "paged/a", StarCount: 3},
+	{Name: "paged/b", StarCount: 12, IsOfficial: true},
+	{Name: "paged/c", StarCount: 7, IsTrusted: true},
+	{Name: "paged/d", StarCount: 40, IsOfficial: true},
+	{Name: "paged/e", StarCount: 0},
+	{Name: "paged/f", StarCount: 25, IsTrusted: true},
+	{Name: "paged/g", StarCount: 1, IsOfficial: true},
+}
+
+// The number of searches of "paged"
+var testPagedSearchRequests int32
+
 func handlerSearch(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("q") != "paged" {
+		result := &SearchResults{
+			Query:      "fakequery",
+			NumResults: 1,
+			Results:    []SearchResult{{Name: "fakeimage", StarCount: 42}},
+		}
+		writeResponse(w, result, 200)
+		return
+	}
+	atomic.AddInt32(&testPagedSearchRequests, 1)
+	pageSize, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil {
+		pageSize = len(testPagedSearchResults)
+	} else if pageSize > 3 {
+		pageSize = 3
+	}
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil {
+		page = 1
+	}
 	result := &SearchResults{
-		Query:      "fakequery",
-		NumResults: 1,
-		Results:    []SearchResult{{Name: "fakeimage", StarCount: 42}},
+		Query:      "paged",
+		NumResults: len(testPagedSearchResults),
+		NumPages:   (len(testPagedSearchResults) + pageSize - 1) / pageSize,
+		Page:       page,
+		PageSize:   pageSize,
+	}
+	if start := (page - 1) * pageSize; start < len(testPagedSearchResults) {
+		end := start + pageSize
+		if end > len(testPagedSearchResults) {
+			end = len(testPagedSearchResults)
+		}
+		result.Results = testPagedSearchResults[start:end]
 	}
 	writeResponse(w, result, 200)
 }
 
+func handlerGetPingV2(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	writeResponse(w, map[string]string{}, 200)
+}
+
+func v2APIError(w http.ResponseWriter, code string, message string, status int) {
+	writeResponse(w, map[string][]map[string]string{
+		"errors": {{"code": code, "message": message}},
+	}, status)
+}
+
+func handlerGetTagsV2(w http.ResponseWriter, r *http.Request) {
+	testV2Lock.Lock()
+	defer testV2Lock.Unlock()
+	repositoryName := mux.Vars(r)["repository"]
+	manifests, exists := testManifests[repositoryName]
+	if !exists {
+		v2APIError(w, "NAME_UNKNOWN", "repository name not known to registry", 404)
+		return
+	}
+	tags := []string{}
+	for reference := range manifests {
+		if !strings.HasPrefix(reference, "sha256:") {
+			tags = append(tags, reference)
+		}
+	}
+	writeResponse(w, map[string]interface{}{"name": repositoryName, "tags": tags}, 200)
+}
+
+func handlerGetManifestV2(w http.ResponseWriter, r *http.Request) {
+	testV2Lock.Lock()
+	defer testV2Lock.Unlock()
+	vars := mux.Vars(r)
+	manifest, exists := testManifests[vars["repository"]][vars["reference"]]
+	if !exists {
+		v2APIError(w, "MANIFEST_UNKNOWN", "manifest unknown", 404)
+		return
+	}
+	payload, err := ManifestPayload(manifest)
+	if err != nil {
+		apiError(w, err.Error(), 500)
+		return
+	}
+	writeHeaders(w)
+	w.Header().Set("Docker-Content-Digest", Digest(payload))
+	w.Write(manifest)
+}
+
+func handlerPutManifestV2(w http.ResponseWriter, r *http.Request) {
+	testV2Lock.Lock()
+	defer testV2Lock.Unlock()
+	vars := mux.Vars(r)
+	raw, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		apiError(w, err.Error(), 500)
+		return
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(raw, manifest); err != nil {
+		v2APIError(w, "MANIFEST_INVALID", err.Error(), 400)
+		return
+	}
+	for _, layer := range manifest.FSLayers {
+		if _, exists := testBlobs[layer.BlobSum]; !exists {
+			v2APIError(w, "BLOB_UNKNOWN", "blob unknown to registry: "+layer.BlobSum, 400)
+			return
+		}
+	}
+	payload, err := ManifestPayload(raw)
+	if err != nil {
+		v2APIError(w, "MANIFEST_INVALID", err.Error(), 400)
+		return
+	}
+	if _, exists := testManifests[vars["repository"]]; !exists {
+		testManifests[vars["repository"]] = make(map[string][]byte)
+	}
+	testManifests[vars["repository"]][vars["reference"]] = raw
+	testManifests[vars["repository"]][Digest(payload)] = raw
+	w.Header().Set("Docker-Content-Digest", Digest(payload))
+	writeResponse(w, "", 201)
+}
+
+func handlerGetBlobV2(w http.ResponseWriter, r *http.Request) {
+	testV2Lock.Lock()
+	defer testV2Lock.Unlock()
+	blob, exists := testBlobs[mux.Vars(r)["digest"]]
+	if !exists {
+		v2APIError(w, "BLOB_UNKNOWN", "blob unknown to registry", 404)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(200)
+	if r.Method == "GET" {
+		w.Write(blob)
+	}
+}
+
+func writeUploadHeaders(w http.ResponseWriter, r *http.Request, uuid string) {
+	w.Header().Set("Location", "/v2/"+mux.Vars(r)["repository"]+"/blobs/uploads/"+uuid)
+	end := len(testUploads[uuid]) - 1
+	if end < 0 {
+		end = 0
+	}
+	w.Header().Set("Range", fmt.Sprintf("0-%d", end))
+}
+
+func handlerStartUploadV2(w http.ResponseWriter, r *http.Request) {
+	testV2Lock.Lock()
+	defer testV2Lock.Unlock()
+	uuid := utils.GenerateRandomID()
+	testUploads[uuid] = []byte{}
+	writeUploadHeaders(w, r, uuid)
+	writeResponse(w, "", 202)
+}
+
+func handlerUploadV2(w http.ResponseWriter, r *http.Request) {
+	testV2Lock.Lock()
+	defer testV2Lock.Unlock()
+	uuid := mux.Vars(r)["uuid"]
+	upload, exists := testUploads[uuid]
+	if !exists {
+		v2APIError(w, "BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry", 404)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeUploadHeaders(w, r, uuid)
+		w.WriteHeader(204)
+	case "PATCH":
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "%d-%d", &start, &end); err != nil || start != len(upload) {
+			writeUploadHeaders(w, r, uuid)
+			v2APIError(w, "BLOB_UPLOAD_INVALID", "invalid content range", 416)
+			return
+		}
+		chunk, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			apiError(w, err.Error(), 500)
+			return
+		}
+		if testFailChunks > 0 {
+			testFailChunks--
+			testUploads[uuid] = append(upload, chunk[:len(chunk)/2]...)
+			apiError(w, "Connection reset", 500)
+			return
+		}
+		testUploads[uuid] = append(upload, chunk...)
+		writeUploadHeaders(w, r, uuid)
+		writeResponse(w, "", 202)
+	case "PUT":
+		digest := r.URL.Query().Get("digest")
+		if Digest(upload) != digest {
+			v2APIError(w, "DIGEST_INVALID", "provided digest did not match uploaded content", 400)
+			return
+		}
+		delete(testUploads, uuid)
+		testBlobs[digest] = upload
+		w.Header().Set("Location", "/v2/"+mux.Vars(r)["repository"]+"/blobs/"+digest)
+		writeResponse(w, "", 201)
+	}
+}
+
 func TestPing(t *testing.T) {
 	res, err := http.Get(makeURL("/v1/_ping"))
 	if err != nil {
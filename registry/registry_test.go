@@ -1,8 +1,12 @@
 package registry
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
+	"github.com/dotcloud/docker/archive"
 	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
 	"net/url"
 	"strings"
 	"testing"
@@ -53,7 +57,7 @@ func TestLookupRemoteImage(t *testing.T) {
 
 func TestGetRemoteImageJSON(t *testing.T) {
 	r := spawnTestRegistry(t)
-	json, size, err := r.GetRemoteImageJSON(IMAGE_ID, makeURL("/v1/"), TOKEN)
+	json, size, checksum, err := r.GetRemoteImageJSON(IMAGE_ID, makeURL("/v1/"), TOKEN)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -61,8 +65,9 @@ func TestGetRemoteImageJSON(t *testing.T) {
 	if len(json) <= 0 {
 		t.Fatal("Expected non-empty json")
 	}
+	assertEqual(t, checksum, "", "Expected no checksum")
 
-	_, _, err = r.GetRemoteImageJSON("abcdef", makeURL("/v1/"), TOKEN)
+	_, _, _, err = r.GetRemoteImageJSON("abcdef", makeURL("/v1/"), TOKEN)
 	if err == nil {
 		t.Fatal("Expected image not found error")
 	}
@@ -70,17 +75,72 @@ func TestGetRemoteImageJSON(t *testing.T) {
 
 func TestGetRemoteImageLayer(t *testing.T) {
 	r := spawnTestRegistry(t)
-	data, err := r.GetRemoteImageLayer(IMAGE_ID, makeURL("/v1/"), TOKEN)
+	data, offset, err := r.GetRemoteImageLayer(IMAGE_ID, makeURL("/v1/"), TOKEN, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if data == nil {
 		t.Fatal("Expected non-nil data result")
 	}
+	data.Close()
+	assertEqual(t, offset, int64(0), "")
 
-	_, err = r.GetRemoteImageLayer("abcdef", makeURL("/v1/"), TOKEN)
-	if err == nil {
-		t.Fatal("Expected image not found error")
+	// Resume the download
+	data, offset, err = r.GetRemoteImageLayer(IMAGE_ID, makeURL("/v1/"), TOKEN, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, err := ioutil.ReadAll(data)
+	data.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, offset, int64(100), "")
+	assertEqual(t, string(rest), testLayers[IMAGE_ID]["layer"][100:], "Unexpected end of the layer")
+
+	_, _, err = r.GetRemoteImageLayer("abcdef", makeURL("/v1/"), TOKEN, 0)
+	if jerr, ok := err.(*utils.JSONError); !ok || jerr.Code != 404 {
+		t.Fatalf("Expected image not found error, got %v", err)
+	}
+}
+
+func TestVerifyLayerChecksum(t *testing.T) {
+	jsonRaw := []byte(testLayers[IMAGE_ID]["json"])
+	tarLayer, err := archive.DecompressStream(strings.NewReader(testLayers[IMAGE_ID]["layer"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tarLayer.Close()
+
+	// Compute the checksums like a push does
+	tarsumLayer := &utils.TarSum{Reader: tarLayer}
+	h := sha256.New()
+	h.Write(jsonRaw)
+	h.Write([]byte{'\n'})
+	checksumLayer := &utils.CheckSum{Reader: tarsumLayer, Hash: h}
+	uploaded, err := ioutil.ReadAll(checksumLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksums := []string{tarsumLayer.Sum(jsonRaw), "sha256:" + checksumLayer.Sum()}
+
+	for _, checksum := range checksums {
+		if err := VerifyLayerChecksum(bytes.NewReader(uploaded), jsonRaw, checksum); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	corrupted := append([]byte{}, uploaded...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	for _, checksum := range checksums {
+		if err := VerifyLayerChecksum(bytes.NewReader(corrupted), jsonRaw, checksum); err == nil {
+			t.Fatalf("Expected an error verifying a corrupted layer against %s", checksum)
+		}
+	}
+
+	// Unsupported checksums are skipped
+	if err := VerifyLayerChecksum(bytes.NewReader(corrupted), jsonRaw, "md5:abcdef"); err != nil {
+		t.Fatal(err)
 	}
 }
 
@@ -168,6 +228,28 @@ func TestResolveRepositoryName(t *testing.T) {
 	assertEqual(t, repo, "ubuntu-12.04-base", "Expected endpoint to be ubuntu-12.04-base")
 }
 
+func TestValidateMirror(t *testing.T) {
+	valid := map[string]string{
+		"http://mirror.local":           "http://mirror.local/v1/",
+		"https://mirror.local:5000/":    "https://mirror.local:5000/v1/",
+		"https://mirror.local:5000/v1/": "https://mirror.local:5000/v1/",
+		"https://mirror.local:5000/v1":  "https://mirror.local:5000/v1/",
+	}
+	for mirror, expected := range valid {
+		endpoint, err := ValidateMirror(mirror)
+		if err != nil {
+			t.Fatalf("Unexpected error validating %s: %s", mirror, err)
+		}
+		assertEqual(t, endpoint, expected, "Unexpected endpoint for "+mirror)
+	}
+
+	for _, mirror := range []string{"mirror.local", "ftp://mirror.local", "https://", "https://mirror.local/v2/", "https://mirror.local?q=1"} {
+		if _, err := ValidateMirror(mirror); err == nil {
+			t.Fatalf("Expected an error validating %s", mirror)
+		}
+	}
+}
+
 func TestPushRegistryTag(t *testing.T) {
 	r := spawnTestRegistry(t)
 	err := r.PushRegistryTag("foo42/bar", IMAGE_ID, "stable", makeURL("/v1/"), TOKEN)
@@ -206,7 +288,7 @@ func TestPushImageJSONIndex(t *testing.T) {
 
 func TestSearchRepositories(t *testing.T) {
 	r := spawnTestRegistry(t)
-	results, err := r.SearchRepositories("fakequery")
+	results, err := r.SearchRepositories("fakequery", 0, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,482 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/dotcloud/docker/utils"
+)
+
+// The registry v2 protocol addresses the layers, called blobs, by the
+// sha256 digest of their content. A tag points to a manifest, which lists
+// the digests of the layers of the image along with their image json.
+
+var (
+	ErrV2NotSupported = errors.New("The registry doesn't support the v2 protocol")
+
+	// Size of the chunks of the blob uploads
+	v2ChunkSize int64 = 5 << 20
+	// Number of times an upload is resumed after a failed chunk
+	v2UploadRetries = 3
+)
+
+type FSLayer struct {
+	BlobSum string `json:"blobSum"`
+}
+
+type ManifestHistory struct {
+	V1Compatibility string `json:"v1Compatibility"`
+}
+
+// Manifest lists the layers of an image, from the topmost layer to the
+// base layer. FSLayers[i] is the layer of the image whose json is
+// History[i].
+type Manifest struct {
+	SchemaVersion int                `json:"schemaVersion"`
+	Name          string             `json:"name"`
+	Tag           string             `json:"tag"`
+	Architecture  string             `json:"architecture"`
+	FSLayers      []*FSLayer         `json:"fsLayers"`
+	History       []*ManifestHistory `json:"history"`
+
+	// Raw is the manifest as given by the registry, with its signatures
+	Raw []byte `json:"-"`
+}
+
+// manifestSignature is the part of the JWS signatures of a signed manifest
+// needed to recover the signed payload.
+type manifestSignature struct {
+	Protected string `json:"protected"`
+}
+
+type manifestProtectedHeader struct {
+	FormatLength int    `json:"formatLength"`
+	FormatTail   string `json:"formatTail"`
+}
+
+// ManifestPayload returns the payload of a manifest, i.e. the manifest
+// without its signatures if it is signed. Digests of manifests are computed
+// on their payload.
+func ManifestPayload(raw []byte) ([]byte, error) {
+	var signed struct {
+		Signatures []*manifestSignature `json:"signatures"`
+	}
+	if err := json.Unmarshal(raw, &signed); err != nil {
+		return nil, err
+	}
+	if len(signed.Signatures) == 0 {
+		return raw, nil
+	}
+
+	protected, err := joseBase64Decode(signed.Signatures[0].Protected)
+	if err != nil {
+		return nil, err
+	}
+	var header manifestProtectedHeader
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return nil, err
+	}
+	if header.FormatLength < 0 || header.FormatLength > len(raw) {
+		return nil, fmt.Errorf("Invalid format length %d of a signed manifest", header.FormatLength)
+	}
+	tail, err := joseBase64Decode(header.FormatTail)
+	if err != nil {
+		return nil, err
+	}
+	return append(raw[:header.FormatLength:header.FormatLength], tail...), nil
+}
+
+// joseBase64Decode decodes base64url without padding, as used by JWS.
+func joseBase64Decode(s string) ([]byte, error) {
+	if n := len(s) % 4; n != 0 {
+		s += strings.Repeat("=", 4-n)
+	}
+	return base64.URLEncoding.DecodeString(s)
+}
+
+// Digest returns the digest of data, in the form sha256:<hex>.
+func Digest(data []byte) string {
+	h := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+// DigestReader returns the digest of the content of r.
+func DigestReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// V2Endpoint returns the v2 endpoint of the registry of the v1 endpoint,
+// e.g. https://registry.domain.tld/v2/ for https://registry.domain.tld/v1/.
+func V2Endpoint(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s://%s/v2/", u.Scheme, u.Host), nil
+}
+
+// PingV2 checks whether the registry of the v2 endpoint supports the v2
+// protocol.
+func (r *Registry) PingV2(endpoint string) error {
+	req, err := r.reqFactory.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	// Registries requiring authentication answer 401, but tell which
+	// version of the protocol they speak
+	if res.StatusCode == 200 || res.Header.Get("Docker-Distribution-API-Version") == "registry/2.0" {
+		return nil
+	}
+	utils.Debugf("Registry %s answered %d to the v2 ping", endpoint, res.StatusCode)
+	return ErrV2NotSupported
+}
+
+// v2Error returns an error for an unexpected response, with the errors
+// the registry gives in its body.
+func v2Error(res *http.Response, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	body, _ := ioutil.ReadAll(res.Body)
+	var errs struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &errs); err == nil && len(errs.Errors) > 0 {
+		for _, e := range errs.Errors {
+			msg += fmt.Sprintf(", %s: %s", e.Code, e.Message)
+		}
+	}
+	return utils.NewHTTPRequestError(fmt.Sprintf("HTTP code %d %s", res.StatusCode, msg), res)
+}
+
+// GetV2Tags returns the tags of the repository name.
+func (r *Registry) GetV2Tags(endpoint, name string) ([]string, error) {
+	req, err := r.reqFactory.NewRequest("GET", endpoint+name+"/tags/list", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 401 {
+		return nil, errLoginRequired
+	}
+	if res.StatusCode != 200 {
+		return nil, v2Error(res, "trying to fetch the tags of %s", name)
+	}
+	var tags struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tags); err != nil {
+		return nil, err
+	}
+	return tags.Tags, nil
+}
+
+// GetV2Manifest returns the manifest of the tag or digest reference of the
+// repository name, along with its digest. The manifest is checked against
+// the digest given by the registry, and against reference if it is a
+// digest.
+func (r *Registry) GetV2Manifest(endpoint, name, reference string) (*Manifest, string, error) {
+	req, err := r.reqFactory.NewRequest("GET", endpoint+name+"/manifests/"+reference, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 401 {
+		return nil, "", errLoginRequired
+	}
+	if res.StatusCode != 200 {
+		return nil, "", v2Error(res, "trying to fetch the manifest %s of %s", reference, name)
+	}
+
+	raw, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error while reading the http response: %s", err)
+	}
+	payload, err := ManifestPayload(raw)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error reading the manifest %s of %s: %s", reference, name, err)
+	}
+	digest := Digest(payload)
+	if expected := res.Header.Get("Docker-Content-Digest"); expected != "" && expected != digest {
+		return nil, "", fmt.Errorf("The manifest %s of %s has digest %s, but the registry announced %s", reference, name, digest, expected)
+	}
+	if utils.IsDigest(reference) && reference != digest {
+		return nil, "", fmt.Errorf("The manifest %s of %s has digest %s", reference, name, digest)
+	}
+
+	manifest := &Manifest{Raw: raw}
+	if err := json.Unmarshal(payload, manifest); err != nil {
+		return nil, "", err
+	}
+	if manifest.SchemaVersion != 1 {
+		return nil, "", fmt.Errorf("Unsupported schema version %d of the manifest %s of %s", manifest.SchemaVersion, reference, name)
+	}
+	if len(manifest.FSLayers) == 0 || len(manifest.FSLayers) != len(manifest.History) {
+		return nil, "", fmt.Errorf("The manifest %s of %s has %d layers for %d images", reference, name, len(manifest.FSLayers), len(manifest.History))
+	}
+	return manifest, digest, nil
+}
+
+// PutV2Manifest uploads the manifest of the tag of the repository name,
+// signed with key unless it is nil, and returns its digest.
+func (r *Registry) PutV2Manifest(endpoint, name, tag string, manifest *Manifest, key *ecdsa.PrivateKey) (string, error) {
+	payload, err := json.MarshalIndent(manifest, "", "   ")
+	if err != nil {
+		return "", err
+	}
+	raw := payload
+	if key != nil {
+		if raw, err = SignManifest(payload, key); err != nil {
+			return "", err
+		}
+	}
+	req, err := r.reqFactory.NewRequest("PUT", endpoint+name+"/manifests/"+tag, bytes.NewReader(raw))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.ContentLength = int64(len(raw))
+	res, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 401 {
+		return "", errLoginRequired
+	}
+	if res.StatusCode != 201 && res.StatusCode != 202 {
+		return "", v2Error(res, "trying to push the manifest %s of %s", tag, name)
+	}
+	return Digest(payload), nil
+}
+
+// V2BlobExists checks whether the blob digest of the repository name is
+// already in the registry.
+func (r *Registry) V2BlobExists(endpoint, name, digest string) (bool, error) {
+	req, err := r.reqFactory.NewRequest("HEAD", endpoint+name+"/blobs/"+digest, nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+		return true, nil
+	case 404:
+		return false, nil
+	case 401:
+		return false, errLoginRequired
+	}
+	return false, utils.NewHTTPRequestError(fmt.Sprintf("HTTP code %d checking the blob %s of %s", res.StatusCode, digest, name), res)
+}
+
+// GetV2Blob returns the content of the blob digest of the repository name,
+// and its size, or -1 if unknown. Reading the content fails at its end if
+// it doesn't match the digest.
+func (r *Registry) GetV2Blob(endpoint, name, digest string) (io.ReadCloser, int64, error) {
+	if !utils.IsDigest(digest) {
+		return nil, -1, fmt.Errorf("Unsupported digest %s", digest)
+	}
+	req, err := r.reqFactory.NewRequest("GET", endpoint+name+"/blobs/"+digest, nil)
+	if err != nil {
+		return nil, -1, err
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return nil, -1, err
+	}
+	if res.StatusCode != 200 {
+		defer res.Body.Close()
+		if res.StatusCode == 401 {
+			return nil, -1, errLoginRequired
+		}
+		return nil, -1, v2Error(res, "trying to fetch the blob %s of %s", digest, name)
+	}
+	return &verifiedReader{ReadCloser: res.Body, hash: sha256.New(), digest: digest}, res.ContentLength, nil
+}
+
+// verifiedReader fails at the end of its content if it doesn't match
+// digest.
+type verifiedReader struct {
+	io.ReadCloser
+	hash   hash.Hash
+	digest string
+}
+
+func (r *verifiedReader) Read(buf []byte) (int, error) {
+	n, err := r.ReadCloser.Read(buf)
+	r.hash.Write(buf[:n])
+	if err == io.EOF {
+		if digest := "sha256:" + hex.EncodeToString(r.hash.Sum(nil)); digest != r.digest {
+			return n, fmt.Errorf("Blob verification failed: expected %s, got %s", r.digest, digest)
+		}
+	}
+	return n, err
+}
+
+// PutV2Blob uploads the blob digest of the repository name, of the given
+// size. The blob is sent in chunks, and the upload is resumed from what
+// the registry received if a chunk fails.
+func (r *Registry) PutV2Blob(endpoint, name, digest string, blob io.ReadSeeker, size int64) error {
+	req, err := r.reqFactory.NewRequest("POST", endpoint+name+"/blobs/uploads/", nil)
+	if err != nil {
+		return err
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode == 401 {
+		return errLoginRequired
+	}
+	if res.StatusCode != 202 {
+		return v2Error(res, "trying to start the upload of %s to %s", digest, name)
+	}
+	location, err := uploadLocation(res)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	for retries := 0; offset < size; {
+		n := v2ChunkSize
+		if size-offset < n {
+			n = size - offset
+		}
+		if _, err := blob.Seek(offset, 0); err != nil {
+			return err
+		}
+		newLocation, err := r.patchV2Chunk(location, io.LimitReader(blob, n), offset, n)
+		if err == nil {
+			location = newLocation
+			offset += n
+			continue
+		}
+		if retries++; retries > v2UploadRetries {
+			return err
+		}
+		utils.Debugf("Uploading %s to %s failed at %d (%s), resuming", digest, name, offset, err)
+		if location, offset, err = r.v2UploadStatus(location); err != nil {
+			return err
+		}
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	query := u.Query()
+	query.Set("digest", digest)
+	u.RawQuery = query.Encode()
+	req, err = r.reqFactory.NewRequest("PUT", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = 0
+	res, err = r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 {
+		return v2Error(res, "trying to complete the upload of %s to %s", digest, name)
+	}
+	return nil
+}
+
+// patchV2Chunk sends the n bytes of chunk, starting at offset, to the upload
+// at location, and returns the location of the next chunk.
+func (r *Registry) patchV2Chunk(location string, chunk io.Reader, offset, n int64) (string, error) {
+	req, err := r.reqFactory.NewRequest("PATCH", location, chunk)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+n-1))
+	req.ContentLength = n
+	res, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 202 {
+		return "", v2Error(res, "uploading the chunk at %d", offset)
+	}
+	return uploadLocation(res)
+}
+
+// v2UploadStatus returns the location of the upload at location, and the
+// offset up to which the registry received its content.
+func (r *Registry) v2UploadStatus(location string) (string, int64, error) {
+	req, err := r.reqFactory.NewRequest("GET", location, nil)
+	if err != nil {
+		return "", -1, err
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return "", -1, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 204 {
+		return "", -1, v2Error(res, "checking the status of the upload")
+	}
+	newLocation, err := uploadLocation(res)
+	if err != nil {
+		return "", -1, err
+	}
+	// The range of the received content is inclusive, as in 0-1023. It is
+	// missing, or 0-0, when nothing was received yet: as 0-0 may also be a
+	// single byte, the upload is then started over.
+	var start, end int64
+	if _, err := fmt.Sscanf(res.Header.Get("Range"), "%d-%d", &start, &end); err != nil || end <= 0 {
+		return newLocation, 0, nil
+	}
+	return newLocation, end + 1, nil
+}
+
+// uploadLocation returns the absolute location of an upload given by res.
+func uploadLocation(res *http.Response) (string, error) {
+	location := res.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("The registry didn't give the location of the upload")
+	}
+	u, err := res.Request.URL.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
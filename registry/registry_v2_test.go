@@ -0,0 +1,168 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestPingV2(t *testing.T) {
+	r := spawnTestRegistry(t)
+	endpoint, err := V2Endpoint(makeURL("/v1/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, endpoint, makeURL("/v2/"), "")
+	if err := r.PingV2(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.PingV2(makeURL("/v3/")); err != ErrV2NotSupported {
+		t.Fatalf("Expected ErrV2NotSupported, got %v", err)
+	}
+}
+
+func TestPushPullV2(t *testing.T) {
+	r := spawnTestRegistry(t)
+	endpoint := makeURL("/v2/")
+
+	defer func(size int64) { v2ChunkSize = size }(v2ChunkSize)
+	v2ChunkSize = 64
+
+	var (
+		layers   = [][]byte{bytes.Repeat([]byte("base"), 100), []byte("top")}
+		manifest = &Manifest{SchemaVersion: 1, Name: "foo42/baz", Tag: "latest"}
+	)
+	for i, layer := range layers {
+		digest := Digest(layer)
+		exists, err := r.V2BlobExists(endpoint, "foo42/baz", digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, exists, false, "Expected the blob not to exist before the upload")
+
+		// The first upload is resumed after a failed chunk
+		if i == 0 {
+			testFailChunks = 1
+		}
+		if err := r.PutV2Blob(endpoint, "foo42/baz", digest, bytes.NewReader(layer), int64(len(layer))); err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, testFailChunks, 0, "Expected the failed chunk to be sent")
+
+		if exists, err = r.V2BlobExists(endpoint, "foo42/baz", digest); err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, exists, true, "Expected the blob to exist after the upload")
+
+		manifest.FSLayers = append([]*FSLayer{{BlobSum: digest}}, manifest.FSLayers...)
+		manifest.History = append([]*ManifestHistory{{V1Compatibility: `{"id":"` + strings.Repeat("ab"[i:i+1], 64) + `"}`}}, manifest.History...)
+	}
+
+	if err := r.PutV2Blob(endpoint, "foo42/baz", Digest([]byte("other")), bytes.NewReader(layers[1]), int64(len(layers[1]))); err == nil {
+		t.Fatal("Expected an error uploading a blob with a wrong digest")
+	}
+
+	digest, err := r.PutV2Manifest(endpoint, "foo42/baz", "latest", manifest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := r.GetV2Tags(endpoint, "foo42/baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0] != "latest" {
+		t.Fatalf("Expected the tag latest, got %v", tags)
+	}
+
+	for _, reference := range []string{"latest", digest} {
+		pulled, pulledDigest, err := r.GetV2Manifest(endpoint, "foo42/baz", reference)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, pulledDigest, digest, "Unexpected digest of the manifest "+reference)
+		assertEqual(t, len(pulled.FSLayers), 2, "Expected 2 layers")
+		assertEqual(t, pulled.History[1].V1Compatibility, manifest.History[1].V1Compatibility, "")
+	}
+	if _, _, err := r.GetV2Manifest(endpoint, "foo42/baz", Digest([]byte("other"))); err == nil {
+		t.Fatal("Expected an error for an unknown manifest")
+	}
+
+	blob, size, err := r.GetV2Blob(endpoint, "foo42/baz", manifest.FSLayers[1].BlobSum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(blob)
+	blob.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, size, int64(len(layers[0])), "")
+	assertEqual(t, string(content), string(layers[0]), "Unexpected content of the blob")
+
+	// Corrupt the blob in the registry
+	testV2Lock.Lock()
+	testBlobs[manifest.FSLayers[0].BlobSum] = []byte("pot")
+	testV2Lock.Unlock()
+	if blob, _, err = r.GetV2Blob(endpoint, "foo42/baz", manifest.FSLayers[0].BlobSum); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(blob)
+	blob.Close()
+	if err == nil {
+		t.Fatal("Expected an error reading a corrupted blob")
+	}
+}
+
+func TestPutV2BlobStartOver(t *testing.T) {
+	r := spawnTestRegistry(t)
+	endpoint := makeURL("/v2/")
+
+	// The failed chunk leaves nothing uploaded, which the registry tells
+	// with the range 0-0
+	blob := []byte("a")
+	testFailChunks = 1
+	if err := r.PutV2Blob(endpoint, "foo42/baz", Digest(blob), bytes.NewReader(blob), int64(len(blob))); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, testFailChunks, 0, "Expected the failed chunk to be sent")
+	exists, err := r.V2BlobExists(endpoint, "foo42/baz", Digest(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, exists, true, "Expected the blob to exist after the upload")
+}
+
+func TestManifestPayload(t *testing.T) {
+	payload := []byte("{\n   \"schemaVersion\": 1,\n   \"name\": \"foo42/bar\"\n}")
+	if unsigned, err := ManifestPayload(payload); err != nil || !bytes.Equal(unsigned, payload) {
+		t.Fatalf("Expected an unsigned manifest to be its own payload, got %q (%v)", unsigned, err)
+	}
+
+	// Signed manifests have their signatures inserted before the last
+	// closing brace of the payload
+	formatLength := bytes.LastIndex(payload, []byte("\n}"))
+	encode := func(data []byte) string {
+		return strings.TrimRight(base64.URLEncoding.EncodeToString(data), "=")
+	}
+	protected, err := json.Marshal(map[string]interface{}{
+		"formatLength": formatLength,
+		"formatTail":   encode(payload[formatLength:]),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := append([]byte{}, payload[:formatLength]...)
+	signed = append(signed, []byte(",\n   \"signatures\": [{\"protected\": \""+encode(protected)+"\", \"signature\": \"sig\"}]\n}")...)
+
+	extracted, err := ManifestPayload(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(extracted, payload) {
+		t.Fatalf("Expected the payload %q, got %q", payload, extracted)
+	}
+}
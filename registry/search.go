@@ -0,0 +1,199 @@
+package registry
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultSearchLimit = 25
+	MaxSearchLimit     = 100
+)
+
+// SearchFilters select the results of a search. The official and automated
+// filters are only applied when set.
+type SearchFilters struct {
+	IsOfficial  *bool
+	IsAutomated *bool
+	Stars       int
+}
+
+// ParseSearchFilters parses the filters of a search, given as lists of
+// values by name: is-official and is-automated take true or false, and
+// stars the minimum number of stars.
+func ParseSearchFilters(filters map[string][]string) (*SearchFilters, error) {
+	f := &SearchFilters{}
+	for name, values := range filters {
+		for _, value := range values {
+			switch name {
+			case "is-official", "is-automated":
+				b, err := strconv.ParseBool(value)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid value %q of the search filter %s: expected true or false", value, name)
+				}
+				if name == "is-official" {
+					f.IsOfficial = &b
+				} else {
+					f.IsAutomated = &b
+				}
+			case "stars":
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("Invalid value %q of the search filter stars: expected a number of stars", value)
+				}
+				f.Stars = n
+			default:
+				return nil, fmt.Errorf("Invalid search filter %s", name)
+			}
+		}
+	}
+	return f, nil
+}
+
+// Empty returns whether the filters select all the results.
+func (f *SearchFilters) Empty() bool {
+	return f == nil || (f.IsOfficial == nil && f.IsAutomated == nil && f.Stars == 0)
+}
+
+// Match returns whether result is selected by the filters. The automated
+// builds are flagged as trusted by the registries.
+func (f *SearchFilters) Match(result SearchResult) bool {
+	if f == nil {
+		return true
+	}
+	if f.IsOfficial != nil && result.IsOfficial != *f.IsOfficial {
+		return false
+	}
+	if f.IsAutomated != nil && result.IsTrusted != *f.IsAutomated {
+		return false
+	}
+	return result.StarCount >= f.Stars
+}
+
+// SplitReposSearchTerm splits the hostname of the registry to search from a
+// search term, e.g. myregistry:5000/term. The terms without hostname are
+// searched on the index.
+func SplitReposSearchTerm(term string) (string, string) {
+	parts := strings.SplitN(term, "/", 2)
+	if len(parts) == 1 || (!strings.Contains(parts[0], ".") && !strings.Contains(parts[0], ":") && parts[0] != "localhost") {
+		return IndexServerAddress(), term
+	}
+	return parts[0], parts[1]
+}
+
+type searchResultsByStars []SearchResult
+
+func (r searchResultsByStars) Len() int           { return len(r) }
+func (r searchResultsByStars) Less(i, j int) bool { return r[i].StarCount > r[j].StarCount }
+func (r searchResultsByStars) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// The number of pages of the registry a filtered search goes through at most
+const maxFilteredSearchPages = 10
+
+// Search returns the page, counted from 1, of the results of the search of
+// term matching filters, pages having limit results. The results of a page
+// are ordered by number of stars.
+//
+// Without filters, the pages of the registry are returned as they are.
+// Otherwise the pages of the registry are filtered until the requested page
+// is complete and another match is found, or until maxFilteredSearchPages
+// pages were searched: the number of results is then a lower bound. The
+// registries which don't page their results are filtered and paged by the
+// daemon.
+func (r *Registry) Search(term string, filters *SearchFilters, limit, page int) (*SearchResults, error) {
+	if limit == 0 {
+		limit = DefaultSearchLimit
+	}
+	if limit < 1 || limit > MaxSearchLimit {
+		return nil, fmt.Errorf("Invalid search limit %d: it must be between 1 and %d", limit, MaxSearchLimit)
+	}
+	if page == 0 {
+		page = 1
+	}
+	if page < 1 {
+		return nil, fmt.Errorf("Invalid search page %d", page)
+	}
+
+	if filters.Empty() {
+		results, err := r.SearchRepositories(term, limit, page)
+		if err != nil {
+			return nil, err
+		}
+		if results.PageSize == 0 {
+			sort.Stable(searchResultsByStars(results.Results))
+			return pageSearchResults(term, results.Results, limit, page), nil
+		}
+		if results.Results == nil {
+			results.Results = []SearchResult{}
+		}
+		sort.Stable(searchResultsByStars(results.Results))
+		return results, nil
+	}
+
+	var matches []SearchResult
+	for p := 1; p <= maxFilteredSearchPages; p++ {
+		results, err := r.SearchRepositories(term, MaxSearchLimit, p)
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range results.Results {
+			if filters.Match(result) {
+				matches = append(matches, result)
+			}
+		}
+		if results.PageSize == 0 {
+			sort.Stable(searchResultsByStars(matches))
+			break
+		}
+		if p >= results.NumPages || len(results.Results) == 0 || len(matches) > page*limit {
+			break
+		}
+	}
+	return pageSearchResults(term, matches, limit, page), nil
+}
+
+// SearchAll returns all the results of the search of term matching filters,
+// as the registry returns them when no page is requested, ordered by number
+// of stars.
+func (r *Registry) SearchAll(term string, filters *SearchFilters) (*SearchResults, error) {
+	results, err := r.SearchRepositories(term, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	matches := []SearchResult{}
+	for _, result := range results.Results {
+		if filters.Match(result) {
+			matches = append(matches, result)
+		}
+	}
+	sort.Stable(searchResultsByStars(matches))
+	return &SearchResults{
+		Query:      term,
+		NumResults: len(matches),
+		Results:    matches,
+	}, nil
+}
+
+// pageSearchResults returns the page of results. The results of the page
+// are ordered by number of stars.
+func pageSearchResults(term string, results []SearchResult, limit, page int) *SearchResults {
+	paged := &SearchResults{
+		Query:      term,
+		NumResults: len(results),
+		NumPages:   (len(results) + limit - 1) / limit,
+		Page:       page,
+		PageSize:   limit,
+		Results:    []SearchResult{},
+	}
+	if start := (page - 1) * limit; start < len(results) {
+		end := start + limit
+		if end > len(results) {
+			end = len(results)
+		}
+		paged.Results = results[start:end]
+	}
+	sort.Stable(searchResultsByStars(paged.Results))
+	return paged
+}
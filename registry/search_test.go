@@ -0,0 +1,144 @@
+package registry
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func searchNames(results *SearchResults) []string {
+	var names []string
+	for _, result := range results.Results {
+		names = append(names, result.Name)
+	}
+	return names
+}
+
+func assertNames(t *testing.T, results *SearchResults, expected ...string) {
+	names := searchNames(results)
+	if len(names) != len(expected) {
+		t.Fatalf("Expected the results %v, got %v", expected, names)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Fatalf("Expected the results %v, got %v", expected, names)
+		}
+	}
+}
+
+func TestParseSearchFilters(t *testing.T) {
+	filters, err := ParseSearchFilters(map[string][]string{
+		"is-official":  {"true"},
+		"is-automated": {"false"},
+		"stars":        {"3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filters.IsOfficial == nil || !*filters.IsOfficial || filters.IsAutomated == nil || *filters.IsAutomated || filters.Stars != 3 {
+		t.Fatalf("Unexpected filters %+v", filters)
+	}
+	assertEqual(t, filters.Match(SearchResult{IsOfficial: true, StarCount: 3}), true, "")
+	assertEqual(t, filters.Match(SearchResult{IsOfficial: true, StarCount: 2}), false, "")
+	assertEqual(t, filters.Match(SearchResult{IsOfficial: true, IsTrusted: true, StarCount: 3}), false, "")
+
+	if filters, err = ParseSearchFilters(nil); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, filters.Empty(), true, "Expected no filter")
+
+	for _, invalid := range []map[string][]string{
+		{"is-official": {"yes please"}},
+		{"stars": {"-1"}},
+		{"name": {"foo"}},
+	} {
+		if _, err := ParseSearchFilters(invalid); err == nil {
+			t.Fatalf("Expected an error parsing the filters %v", invalid)
+		}
+	}
+}
+
+func TestSplitReposSearchTerm(t *testing.T) {
+	expected := map[string][2]string{
+		"ubuntu":                {IndexServerAddress(), "ubuntu"},
+		"foo/bar":               {IndexServerAddress(), "foo/bar"},
+		"myregistry:5000/term":  {"myregistry:5000", "term"},
+		"registry.example.com/": {"registry.example.com", ""},
+		"localhost/foo/bar":     {"localhost", "foo/bar"},
+	}
+	for term, parts := range expected {
+		hostname, searched := SplitReposSearchTerm(term)
+		assertEqual(t, hostname, parts[0], "Unexpected registry of "+term)
+		assertEqual(t, searched, parts[1], "Unexpected term of "+term)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	r := spawnTestRegistry(t)
+
+	// The pages of the registry are kept, and ordered by stars
+	results, err := r.Search("paged", nil, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, results.NumResults, 7, "")
+	assertEqual(t, results.NumPages, 3, "")
+	assertEqual(t, results.Page, 2, "")
+	assertEqual(t, results.PageSize, 3, "")
+	assertNames(t, results, "paged/d", "paged/f", "paged/e")
+
+	// The filtered results are paged by the daemon, which stops searching
+	// the pages of the registry once the page is complete and another
+	// match is found
+	official := true
+	filters := &SearchFilters{IsOfficial: &official, Stars: 2}
+	requests := atomic.LoadInt32(&testPagedSearchRequests)
+	if results, err = r.Search("paged", filters, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, atomic.LoadInt32(&testPagedSearchRequests)-requests, int32(2), "Unexpected number of pages searched")
+	assertEqual(t, results.NumResults, 2, "")
+	assertEqual(t, results.NumPages, 2, "")
+	assertEqual(t, results.Page, 1, "")
+	assertNames(t, results, "paged/b")
+	if results, err = r.Search("paged", filters, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	assertNames(t, results, "paged/d")
+	if results, err = r.Search("paged", filters, 1, 3); err != nil {
+		t.Fatal(err)
+	}
+	assertNames(t, results)
+
+	// So are the results of the registries which don't page them
+	if results, err = r.Search("fakequery", nil, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, results.NumResults, 1, "")
+	assertEqual(t, results.NumPages, 1, "")
+	assertEqual(t, results.PageSize, DefaultSearchLimit, "")
+	assertNames(t, results, "fakeimage")
+
+	if _, err := r.Search("paged", nil, MaxSearchLimit+1, 1); err == nil {
+		t.Fatal("Expected an error for a limit over the maximum")
+	}
+	if _, err := r.Search("paged", nil, 10, -1); err == nil {
+		t.Fatal("Expected an error for an invalid page")
+	}
+}
+
+func TestSearchAll(t *testing.T) {
+	r := spawnTestRegistry(t)
+
+	results, err := r.SearchAll("paged", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, results.NumResults, 7, "")
+	assertNames(t, results, "paged/d", "paged/f", "paged/b", "paged/c", "paged/a", "paged/g", "paged/e")
+
+	official := true
+	if results, err = r.SearchAll("paged", &SearchFilters{IsOfficial: &official}); err != nil {
+		t.Fatal(err)
+	}
+	assertNames(t, results, "paged/d", "paged/b", "paged/g")
+}
@@ -1,6 +1,8 @@
 package registry
 
 import (
+	"encoding/json"
+
 	"github.com/dotcloud/docker/engine"
 )
 
@@ -54,8 +56,9 @@ func (s *Service) Auth(job *engine.Job) engine.Status {
 	return engine.StatusOK
 }
 
-// Search queries the public registry for images matching the specified
-// search terms, and returns the results.
+// Search queries a registry for images matching the specified search
+// terms, and returns a page of results. The index is searched, unless the
+// term starts with the hostname of a registry, e.g. myregistry:5000/term.
 //
 // Argument syntax: search TERM
 //
@@ -66,38 +69,61 @@ func (s *Service) Auth(job *engine.Job) engine.Status {
 //	'metaHeaders': extra HTTP headers to include in the request to the registry.
 //		The headers should be passed as a json-encoded dictionary.
 //
+//	'filters': json-encoded lists of values by filter name, among is-official,
+//		is-automated and stars. Only the results matching all the filters are returned.
+//
+//	'limit': number of results per page, 25 by default and 100 at most.
+//
+//	'page': page of the results to return, counted from 1.
+//
+//	'all': return all the results in a single page, ignoring limit and page.
+//
 // Output:
-//	Results are sent as a collection of structured messages (using engine.Table).
-//	Each result is sent as a separate message.
-//	Results are ordered by number of stars on the public registry.
+//	The page is sent as a structured message with the query, the numbers of
+//	results and pages, the page, its size, and its results.
+//	Results are ordered by number of stars on the registry.
 func (s *Service) Search(job *engine.Job) engine.Status {
 	if n := len(job.Args); n != 1 {
 		return job.Errorf("Usage: %s TERM", job.Name)
 	}
 	var (
-		term        = job.Args[0]
-		metaHeaders = map[string][]string{}
-		authConfig  = &AuthConfig{}
+		hostname, term = SplitReposSearchTerm(job.Args[0])
+		metaHeaders    = map[string][]string{}
+		authConfig     = &AuthConfig{}
+		filters        = map[string][]string{}
+		endpoint       = hostname
+		err            error
 	)
 	job.GetenvJson("authConfig", authConfig)
 	job.GetenvJson("metaHeaders", metaHeaders)
+	if err := job.GetenvJson("filters", &filters); err != nil {
+		return job.Errorf("Invalid search filters: %s", err)
+	}
 
-	r, err := NewRegistry(authConfig, HTTPRequestFactory(metaHeaders), IndexServerAddress())
+	searchFilters, err := ParseSearchFilters(filters)
 	if err != nil {
 		return job.Error(err)
 	}
-	results, err := r.SearchRepositories(term)
+	if hostname != IndexServerAddress() {
+		if endpoint, err = ExpandAndVerifyRegistryUrl(hostname); err != nil {
+			return job.Error(err)
+		}
+	}
+	r, err := NewRegistry(authConfig, HTTPRequestFactory(metaHeaders), endpoint)
 	if err != nil {
 		return job.Error(err)
 	}
-	outs := engine.NewTable("star_count", 0)
-	for _, result := range results.Results {
-		out := &engine.Env{}
-		out.Import(result)
-		outs.Add(out)
+	var results *SearchResults
+	if job.GetenvBool("all") {
+		results, err = r.SearchAll(term, searchFilters)
+	} else {
+		results, err = r.Search(term, searchFilters, job.GetenvInt("limit"), job.GetenvInt("page"))
+	}
+	if err != nil {
+		return job.Error(err)
 	}
-	outs.ReverseSort()
-	if _, err := outs.WriteListTo(job.Stdout); err != nil {
+
+	if err := json.NewEncoder(job.Stdout).Encode(results); err != nil {
 		return job.Error(err)
 	}
 	return engine.StatusOK
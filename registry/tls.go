@@ -0,0 +1,218 @@
+package registry
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dotcloud/docker/utils"
+)
+
+// CertsDir holds the TLS configuration of the registries, in a directory
+// per hostname, e.g. /etc/docker/certs.d/myregistry:5000/. The CA
+// certificates of a registry are read from the files ending in .crt, and
+// its client certificate from client.cert and client.key.
+var CertsDir = "/etc/docker/certs.d"
+
+// The registries on the loopback interface are always insecure.
+var loopbackRegistries = []string{"127.0.0.0/8", "::1/128"}
+
+var insecureRegistries = struct {
+	sync.RWMutex
+	hosts map[string]bool
+	nets  []*net.IPNet
+}{}
+
+func init() {
+	if err := SetInsecureRegistries(nil); err != nil {
+		panic(err)
+	}
+}
+
+// ValidateInsecureRegistry checks that val is a hostname, with an optional
+// port, or a CIDR network.
+func ValidateInsecureRegistry(val string) (string, error) {
+	if strings.Contains(val, "://") {
+		return "", fmt.Errorf("Invalid insecure registry %s: give a hostname or a CIDR network, without scheme", val)
+	}
+	if _, _, err := net.ParseCIDR(val); err == nil {
+		return val, nil
+	}
+	if val == "" || strings.ContainsAny(val, "/ ") {
+		return "", fmt.Errorf("Invalid insecure registry %s", val)
+	}
+	return val, nil
+}
+
+// SetInsecureRegistries sets the registries which may be reached over plain
+// http or https without verifying their certificate, given by hostname or
+// by CIDR network.
+func SetInsecureRegistries(registries []string) error {
+	hosts := make(map[string]bool)
+	nets := []*net.IPNet{}
+	for _, registry := range append(loopbackRegistries, registries...) {
+		if _, err := ValidateInsecureRegistry(registry); err != nil {
+			return err
+		}
+		if _, ipnet, err := net.ParseCIDR(registry); err == nil {
+			nets = append(nets, ipnet)
+		} else {
+			hosts[registry] = true
+		}
+	}
+
+	insecureRegistries.Lock()
+	insecureRegistries.hosts = hosts
+	insecureRegistries.nets = nets
+	insecureRegistries.Unlock()
+	return nil
+}
+
+// IsSecure returns whether the registry at hostname, with an optional
+// port, must be reached over https with a verified certificate.
+func IsSecure(hostname string) bool {
+	if index, err := url.Parse(IndexServerAddress()); err == nil && index.Host == hostname {
+		return true
+	}
+
+	insecureRegistries.RLock()
+	defer insecureRegistries.RUnlock()
+
+	host := hostname
+	if h, _, err := net.SplitHostPort(hostname); err == nil {
+		host = h
+	}
+	if insecureRegistries.hosts[hostname] || insecureRegistries.hosts[host] {
+		return false
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append(ips, ip)
+	} else if addrs, err := net.LookupIP(host); err == nil {
+		ips = addrs
+	}
+	for _, ip := range ips {
+		for _, ipnet := range insecureRegistries.nets {
+			if ipnet.Contains(ip) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// tlsConfig returns the TLS configuration of the registry at hostname,
+// loaded from its directory in CertsDir if any.
+func tlsConfig(hostname string) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: !IsSecure(hostname)}
+
+	dir := filepath.Join(CertsDir, hostname)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return nil, err
+	}
+
+	for _, f := range files {
+		switch name := f.Name(); {
+		case strings.HasSuffix(name, ".crt"):
+			if config.RootCAs == nil {
+				config.RootCAs = x509.NewCertPool()
+			}
+			data, err := ioutil.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				return nil, err
+			}
+			if !config.RootCAs.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("Could not read the CA certificate %s", filepath.Join(dir, name))
+			}
+			utils.Debugf("Trusting the CA certificate %s for %s", name, hostname)
+		case strings.HasSuffix(name, ".cert"):
+			keyName := strings.TrimSuffix(name, ".cert") + ".key"
+			cert, err := tls.LoadX509KeyPair(filepath.Join(dir, name), filepath.Join(dir, keyName))
+			if err != nil {
+				return nil, fmt.Errorf("Could not load the client certificate %s and its key %s: %s", filepath.Join(dir, name), keyName, err)
+			}
+			config.Certificates = append(config.Certificates, cert)
+			utils.Debugf("Using the client certificate %s for %s", name, hostname)
+		case strings.HasSuffix(name, ".key"):
+			certName := strings.TrimSuffix(name, ".key") + ".cert"
+			if _, err := os.Stat(filepath.Join(dir, certName)); err != nil {
+				return nil, fmt.Errorf("Missing the client certificate %s for the key %s", certName, filepath.Join(dir, name))
+			}
+		}
+	}
+	return config, nil
+}
+
+// transport is an http.RoundTripper using the TLS configuration of the
+// registry each request is sent to.
+type transport struct {
+	sync.Mutex
+	timeout    bool
+	transports map[string]*http.Transport
+}
+
+// newTransport returns a transport for the registries. If timeout is set,
+// connections time out after a few seconds, e.g. to ping a registry.
+func newTransport(timeout bool) *transport {
+	return &transport{
+		timeout:    timeout,
+		transports: make(map[string]*http.Transport),
+	}
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tr, err := t.hostTransport(req.URL.Host)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return tr.RoundTrip(req)
+}
+
+func (t *transport) hostTransport(hostname string) (*http.Transport, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if tr, exists := t.transports[hostname]; exists {
+		return tr, nil
+	}
+	config, err := tlsConfig(hostname)
+	if err != nil {
+		return nil, err
+	}
+	tr := &http.Transport{
+		DisableKeepAlives: true,
+		Proxy:             http.ProxyFromEnvironment,
+		TLSClientConfig:   config,
+	}
+	if t.timeout {
+		tr.Dial = func(proto string, addr string) (net.Conn, error) {
+			// Set the connect timeout to 5 seconds
+			conn, err := net.DialTimeout(proto, addr, time.Duration(5)*time.Second)
+			if err != nil {
+				return nil, err
+			}
+			// Set the recv timeout to 10 seconds
+			conn.SetDeadline(time.Now().Add(time.Duration(10) * time.Second))
+			return conn, nil
+		}
+	}
+	t.transports[hostname] = tr
+	return tr, nil
+}
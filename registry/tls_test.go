@@ -0,0 +1,136 @@
+package registry
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate and its key in PEM
+// format to certFile and keyFile.
+func writeTestCertificate(t *testing.T, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "registry"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if keyFile == "" {
+		return
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateInsecureRegistry(t *testing.T) {
+	for _, registry := range []string{"myregistry", "myregistry:5000", "10.1.0.0/16", "192.0.2.1:5000"} {
+		if _, err := ValidateInsecureRegistry(registry); err != nil {
+			t.Fatalf("Unexpected error validating %s: %s", registry, err)
+		}
+	}
+	for _, registry := range []string{"", "http://myregistry", "myregistry/path", "10.1.0.0/40"} {
+		if _, err := ValidateInsecureRegistry(registry); err == nil {
+			t.Fatalf("Expected an error validating %s", registry)
+		}
+	}
+}
+
+func TestIsSecure(t *testing.T) {
+	if err := SetInsecureRegistries([]string{"myregistry:5000", "10.1.0.0/16"}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetInsecureRegistries(nil)
+
+	expected := map[string]bool{
+		"index.docker.io": true,
+		"127.0.0.1:5000":  false,
+		"[::1]:5000":      false,
+		"myregistry:5000": false,
+		"10.1.2.3:5000":   false,
+		"10.2.0.1":        true,
+		"192.0.2.1:5000":  true,
+	}
+	for hostname, secure := range expected {
+		assertEqual(t, IsSecure(hostname), secure, "Unexpected security of "+hostname)
+	}
+
+	if _, err := ExpandAndVerifyRegistryUrl("http://192.0.2.1:5000"); err == nil {
+		t.Fatal("Expected an error using plain http with a secure registry")
+	}
+	if err := SetInsecureRegistries([]string{"http://myregistry"}); err == nil {
+		t.Fatal("Expected an error setting an invalid insecure registry")
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	defer func(dir string) { CertsDir = dir }(CertsDir)
+	CertsDir = tmp
+
+	// No configuration for the registry
+	config, err := tlsConfig("192.0.2.1:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.RootCAs != nil || len(config.Certificates) != 0 || config.InsecureSkipVerify {
+		t.Fatalf("Expected the default configuration, got %+v", config)
+	}
+
+	dir := filepath.Join(tmp, "192.0.2.1:5000")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestCertificate(t, filepath.Join(dir, "ca.crt"), "")
+	writeTestCertificate(t, filepath.Join(dir, "client.cert"), filepath.Join(dir, "client.key"))
+	if config, err = tlsConfig("192.0.2.1:5000"); err != nil {
+		t.Fatal(err)
+	}
+	if config.RootCAs == nil || len(config.Certificates) != 1 || config.InsecureSkipVerify {
+		t.Fatalf("Expected the CA and the client certificate to be loaded, got %+v", config)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "client.cert")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tlsConfig("192.0.2.1:5000"); err == nil {
+		t.Fatal("Expected an error for a client key without certificate")
+	}
+
+	// Insecure registries skip the verification
+	if config, err = tlsConfig("127.0.0.1:5000"); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, config.InsecureSkipVerify, true, "Expected the verification to be skipped for an insecure registry")
+}
@@ -0,0 +1,281 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dotcloud/docker/utils"
+)
+
+// The v2 API requests on a repository, giving its name
+var v2RepositoryPath = regexp.MustCompile(`/v2/(.+?)/(manifests|blobs|tags)/`)
+
+// The lifetime of the tokens which don't give it
+const defaultTokenExpiration = 60 * time.Second
+
+// challenge is an authentication challenge of a WWW-Authenticate header.
+type challenge struct {
+	Scheme     string
+	Parameters map[string]string
+}
+
+// parseChallenges parses the challenges of the WWW-Authenticate headers,
+// e.g. Bearer realm="https://auth.example.com/token",service="registry".
+func parseChallenges(headers []string) []challenge {
+	var challenges []challenge
+	for _, header := range headers {
+		s := strings.TrimSpace(header)
+		for s != "" {
+			var c challenge
+			i := strings.IndexAny(s, " \t")
+			if i == -1 {
+				i = len(s)
+			}
+			c.Scheme, s = strings.ToLower(s[:i]), strings.TrimSpace(s[i:])
+			c.Parameters, s = parseChallengeParameters(s)
+			challenges = append(challenges, c)
+		}
+	}
+	return challenges
+}
+
+// parseChallengeParameters parses the comma separated key=value parameters
+// at the start of s, where the values may be quoted strings, and returns
+// them with the rest of s.
+func parseChallengeParameters(s string) (map[string]string, string) {
+	params := make(map[string]string)
+	for {
+		i := strings.IndexAny(s, "=, \t")
+		if i <= 0 || s[i] != '=' {
+			// The next challenge starts here
+			return params, s
+		}
+		key := strings.ToLower(s[:i])
+		s = s[i+1:]
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var buf []byte
+			escaped, closed := false, false
+			for i = 1; i < len(s); i++ {
+				if escaped {
+					buf = append(buf, s[i])
+					escaped = false
+				} else if s[i] == '\\' {
+					escaped = true
+				} else if s[i] == '"' {
+					closed = true
+					break
+				} else {
+					buf = append(buf, s[i])
+				}
+			}
+			if !closed {
+				params[key] = string(buf)
+				return params, ""
+			}
+			value, s = string(buf), s[i+1:]
+		} else {
+			i = strings.IndexAny(s, ", \t")
+			if i == -1 {
+				i = len(s)
+			}
+			value, s = s[:i], s[i:]
+		}
+		params[key] = value
+
+		s = strings.TrimLeft(s, " \t")
+		if !strings.HasPrefix(s, ",") {
+			return params, s
+		}
+		s = strings.TrimLeft(s[1:], " \t")
+	}
+}
+
+// requestScope returns the scope of the token needed by a request of the v2
+// API, or an empty string if it isn't about a repository.
+func requestScope(req *http.Request) string {
+	m := v2RepositoryPath.FindStringSubmatch(req.URL.Path)
+	if m == nil {
+		return ""
+	}
+	if req.Method == "GET" || req.Method == "HEAD" {
+		return "repository:" + m[1] + ":pull"
+	}
+	return "repository:" + m[1] + ":pull,push"
+}
+
+type bearerToken struct {
+	token   string
+	expires time.Time
+}
+
+// tokenTransport is an http.RoundTripper authenticating the requests to the
+// registries asking for a bearer token. The token is fetched from the
+// authorization service given by the challenge of the registry, with the
+// credentials of authConfig, and the request is sent again. The tokens are
+// cached per scope, and the challenges per registry, so that the next
+// requests get their token before being sent.
+type tokenTransport struct {
+	sync.Mutex
+	transport  http.RoundTripper
+	authConfig *AuthConfig
+	challenges map[string]map[string]string
+	tokens     map[string]bearerToken
+}
+
+func newTokenTransport(transport http.RoundTripper, authConfig *AuthConfig) *tokenTransport {
+	return &tokenTransport{
+		transport:  transport,
+		authConfig: authConfig,
+		challenges: make(map[string]map[string]string),
+		tokens:     make(map[string]bearerToken),
+	}
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	scope := requestScope(req)
+
+	t.Lock()
+	params, known := t.challenges[req.URL.Host]
+	t.Unlock()
+	if known && scope != "" {
+		token, err := t.getToken(params, scope)
+		if err != nil && err != errLoginRequired {
+			return nil, err
+		}
+		if err == nil {
+			req = authorizedRequest(req, token)
+		}
+	}
+
+	res, err := t.transport.RoundTrip(req)
+	if err != nil || res.StatusCode != 401 {
+		return res, err
+	}
+	for _, c := range parseChallenges(res.Header["Www-Authenticate"]) {
+		if c.Scheme != "bearer" || c.Parameters["realm"] == "" {
+			continue
+		}
+		t.Lock()
+		t.challenges[req.URL.Host] = c.Parameters
+		t.Unlock()
+
+		if s := c.Parameters["scope"]; s != "" {
+			scope = s
+		}
+		// A request with a body can't be sent again, the next ones will
+		// have their token
+		if req.Body != nil {
+			return res, nil
+		}
+		token, err := t.getToken(c.Parameters, scope)
+		if err == errLoginRequired {
+			// The credentials were refused, the caller gets the challenge
+			return res, nil
+		}
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		return t.transport.RoundTrip(authorizedRequest(req, token))
+	}
+	return res, nil
+}
+
+// authorizedRequest returns a copy of req with the bearer token.
+func authorizedRequest(req *http.Request, token string) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+// getToken returns a token for scope from the authorization service of the
+// challenge params, from the cache if it is still valid.
+func (t *tokenTransport) getToken(params map[string]string, scope string) (string, error) {
+	key := params["realm"] + " " + params["service"] + " " + scope
+
+	t.Lock()
+	cached, exists := t.tokens[key]
+	t.Unlock()
+	if exists && time.Now().Before(cached.expires) {
+		return cached.token, nil
+	}
+
+	token, err := t.fetchToken(params["realm"], params["service"], scope)
+	if err != nil {
+		return "", err
+	}
+	t.Lock()
+	t.tokens[key] = token
+	t.Unlock()
+	return token.token, nil
+}
+
+func (t *tokenTransport) fetchToken(realm, service, scope string) (bearerToken, error) {
+	u, err := url.Parse(realm)
+	if err != nil {
+		return bearerToken{}, fmt.Errorf("Invalid token realm %s: %s", realm, err)
+	}
+	q := u.Query()
+	if service != "" {
+		q.Set("service", service)
+	}
+	if scope != "" {
+		q.Set("scope", scope)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return bearerToken{}, err
+	}
+	if t.authConfig != nil && t.authConfig.Username != "" {
+		req.SetBasicAuth(t.authConfig.Username, t.authConfig.Password)
+	}
+	utils.Debugf("[registry] Fetching a token for %q from %s", scope, realm)
+	res, err := t.transport.RoundTrip(req)
+	if err != nil {
+		return bearerToken{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 401 {
+		return bearerToken{}, errLoginRequired
+	}
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return bearerToken{}, utils.NewHTTPRequestError(fmt.Sprintf("Error fetching a token from %s: HTTP code %d, %s", realm, res.StatusCode, body), res)
+	}
+
+	var tr struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tr); err != nil {
+		return bearerToken{}, fmt.Errorf("Invalid token from %s: %s", realm, err)
+	}
+	if tr.Token == "" {
+		tr.Token = tr.AccessToken
+	}
+	if tr.Token == "" {
+		return bearerToken{}, fmt.Errorf("No token given by %s", realm)
+	}
+	expiration := defaultTokenExpiration
+	if tr.ExpiresIn > 0 {
+		expiration = time.Duration(tr.ExpiresIn) * time.Second
+	}
+	return bearerToken{token: tr.Token, expires: time.Now().Add(expiration)}, nil
+}
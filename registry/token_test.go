@@ -0,0 +1,155 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dotcloud/docker/utils"
+)
+
+func TestParseChallenges(t *testing.T) {
+	challenges := parseChallenges([]string{
+		`Bearer realm="https://auth.example.com/token",service="registry.example.com", scope="repository:foo/bar:pull,push"`,
+		`Basic realm="Registry \"realm\"" Token`,
+	})
+	if len(challenges) != 3 {
+		t.Fatalf("Expected 3 challenges, got %v", challenges)
+	}
+	assertEqual(t, challenges[0].Scheme, "bearer", "")
+	assertEqual(t, challenges[0].Parameters["realm"], "https://auth.example.com/token", "")
+	assertEqual(t, challenges[0].Parameters["service"], "registry.example.com", "")
+	assertEqual(t, challenges[0].Parameters["scope"], "repository:foo/bar:pull,push", "")
+	assertEqual(t, challenges[1].Scheme, "basic", "")
+	assertEqual(t, challenges[1].Parameters["realm"], `Registry "realm"`, "")
+	assertEqual(t, challenges[2].Scheme, "token", "")
+	assertEqual(t, len(challenges[2].Parameters), 0, "")
+}
+
+func TestRequestScope(t *testing.T) {
+	expected := map[string]string{
+		"GET /v2/":                                  "",
+		"GET /v2/foo/bar/tags/list":                 "repository:foo/bar:pull",
+		"HEAD /v2/foo/blobs/sha256:abc":             "repository:foo:pull",
+		"PUT /v2/foo/bar/manifests/latest":          "repository:foo/bar:pull,push",
+		"PATCH /v2/foo/bar/blobs/uploads/1234":      "repository:foo/bar:pull,push",
+		"GET /v1/repositories/foo/bar/tags":         "",
+		"GET /registry/v2/foo/bar/manifests/latest": "repository:foo/bar:pull",
+	}
+	for request, scope := range expected {
+		parts := strings.SplitN(request, " ", 2)
+		req, err := http.NewRequest(parts[0], "https://registry.example.com"+parts[1], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, requestScope(req), scope, "Unexpected scope of "+request)
+	}
+}
+
+// spawnTokenRegistry starts an authorization service and a registry
+// requiring its tokens. The number of tokens issued per scope is counted.
+func spawnTokenRegistry(t *testing.T) (auth, registry *httptest.Server, issued map[string]int, lock *sync.Mutex) {
+	issued = make(map[string]int)
+	lock = &sync.Mutex{}
+
+	auth = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "foo" || password != "bar" {
+			w.WriteHeader(401)
+			return
+		}
+		if r.URL.Query().Get("service") != "test-registry" {
+			w.WriteHeader(400)
+			return
+		}
+		scope := r.URL.Query().Get("scope")
+		lock.Lock()
+		issued[scope]++
+		lock.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"token": "token-" + scope, "expires_in": 300})
+	}))
+
+	registry = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope := requestScope(r)
+		if r.Header.Get("Authorization") != "Bearer token-"+scope {
+			challenge := fmt.Sprintf(`Bearer realm="%s/token",service="test-registry"`, auth.URL)
+			if scope != "" {
+				challenge += fmt.Sprintf(`,scope="%s"`, scope)
+			}
+			w.Header().Set("WWW-Authenticate", challenge)
+			w.WriteHeader(401)
+			return
+		}
+		switch {
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/tags/list"):
+			w.Write([]byte(`{"name": "foo/bar", "tags": ["latest"]}`))
+		case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/blobs/uploads/"):
+			w.Header().Set("Location", "/v2/foo/bar/blobs/uploads/1234")
+			w.WriteHeader(202)
+		default:
+			w.WriteHeader(200)
+		}
+	}))
+	return auth, registry, issued, lock
+}
+
+func TestTokenAuth(t *testing.T) {
+	auth, registry, issued, lock := spawnTokenRegistry(t)
+	defer auth.Close()
+	defer registry.Close()
+
+	r, err := NewRegistry(&AuthConfig{Username: "foo", Password: "bar"}, utils.NewHTTPRequestFactory(), registry.URL+"/v1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := registry.URL + "/v2/"
+	if err := r.PingV2(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first request is sent again with its token, the next ones use the
+	// cached token
+	for i := 0; i < 2; i++ {
+		tags, err := r.GetV2Tags(endpoint, "foo/bar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tags) != 1 || tags[0] != "latest" {
+			t.Fatalf("Unexpected tags %v", tags)
+		}
+	}
+	if _, err := r.V2BlobExists(endpoint, "foo/bar", Digest([]byte("foo"))); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	assertEqual(t, issued["repository:foo/bar:pull"], 1, "Expected the pull token to be cached")
+	lock.Unlock()
+
+	// The push scope needs another token, fetched before the request since
+	// the challenge of the registry is known
+	req, err := http.NewRequest("PUT", endpoint+"foo/bar/manifests/latest", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assertEqual(t, res.StatusCode, 200, "Expected the request with a body to be authorized")
+	lock.Lock()
+	assertEqual(t, issued["repository:foo/bar:pull,push"], 1, "")
+	lock.Unlock()
+
+	// Wrong credentials
+	r, err = NewRegistry(&AuthConfig{Username: "foo", Password: "baz"}, utils.NewHTTPRequestFactory(), registry.URL+"/v1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetV2Tags(endpoint, "foo/bar"); err != errLoginRequired {
+		t.Fatalf("Expected errLoginRequired, got %v", err)
+	}
+}
@@ -0,0 +1,282 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The manifests of the tags are signed with JSON Web Signatures, in the
+// format of the signed manifests of the registry v2 protocol: the
+// signatures are inserted at the end of the pretty printed manifest, and
+// their protected header tells how to recover the signed manifest.
+//
+// The keys are kept in a trust directory, under the docker configuration
+// directory: the private key signing the pushed tags, and the public keys
+// trusted to sign the pulled tags, in PEM format.
+const (
+	TrustKeyFile       = "key.pem"
+	TrustPublicKeyFile = "key.pub"
+	TrustedKeysDir     = "trusted_keys"
+)
+
+var ErrManifestNotSigned = errors.New("The manifest is not signed")
+
+type jsonWebKey struct {
+	Curve   string `json:"crv"`
+	KeyID   string `json:"kid"`
+	KeyType string `json:"kty"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+type jsonSignatureHeader struct {
+	JWK       jsonWebKey `json:"jwk"`
+	Algorithm string     `json:"alg"`
+}
+
+type jsonSignature struct {
+	Header    jsonSignatureHeader `json:"header"`
+	Signature string              `json:"signature"`
+	Protected string              `json:"protected"`
+}
+
+type jsonProtectedHeader struct {
+	FormatLength int    `json:"formatLength"`
+	FormatTail   string `json:"formatTail"`
+	Time         string `json:"time"`
+}
+
+func joseBase64Encode(data []byte) string {
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(data), "=")
+}
+
+// KeyID returns the fingerprint of a public key, e.g.
+// NNKT:UF2O:O2ZU:UA2I:YCHH:QJQ2:XYWU:2XFA:N4NZ:BCYV:N3ML:YOGH.
+func KeyID(key *ecdsa.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return ""
+	}
+	h := sha256.Sum256(der)
+	s := strings.TrimRight(base32.StdEncoding.EncodeToString(h[:30]), "=")
+	var groups []string
+	for i := 0; i < len(s); i += 4 {
+		groups = append(groups, s[i:i+4])
+	}
+	return strings.Join(groups, ":")
+}
+
+// coordinate encodes an integer of the P-256 curve on 32 bytes.
+func coordinate(n *big.Int) []byte {
+	b := n.Bytes()
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+func newJSONWebKey(key *ecdsa.PublicKey) jsonWebKey {
+	return jsonWebKey{
+		Curve:   "P-256",
+		KeyID:   KeyID(key),
+		KeyType: "EC",
+		X:       joseBase64Encode(coordinate(key.X)),
+		Y:       joseBase64Encode(coordinate(key.Y)),
+	}
+}
+
+func (k jsonWebKey) publicKey() (*ecdsa.PublicKey, error) {
+	if k.KeyType != "EC" || k.Curve != "P-256" {
+		return nil, fmt.Errorf("Unsupported key type %s %s", k.KeyType, k.Curve)
+	}
+	x, err := joseBase64Decode(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := joseBase64Decode(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !key.Curve.IsOnCurve(key.X, key.Y) {
+		return nil, fmt.Errorf("Invalid key %s", k.KeyID)
+	}
+	return key, nil
+}
+
+// SignManifest signs the pretty printed manifest raw with key, and returns
+// the signed manifest.
+func SignManifest(raw []byte, key *ecdsa.PrivateKey) ([]byte, error) {
+	end := bytes.LastIndex(raw, []byte("}"))
+	if end == -1 {
+		return nil, fmt.Errorf("Invalid manifest")
+	}
+	formatLength := len(bytes.TrimRight(raw[:end], " \t\r\n"))
+	protected, err := json.Marshal(&jsonProtectedHeader{
+		FormatLength: formatLength,
+		FormatTail:   joseBase64Encode(raw[formatLength:]),
+		Time:         time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sig := &jsonSignature{
+		Header:    jsonSignatureHeader{JWK: newJSONWebKey(&key.PublicKey), Algorithm: "ES256"},
+		Protected: joseBase64Encode(protected),
+	}
+	h := sha256.Sum256([]byte(sig.Protected + "." + joseBase64Encode(raw)))
+	r, s, err := ecdsa.Sign(rand.Reader, key, h[:])
+	if err != nil {
+		return nil, err
+	}
+	sig.Signature = joseBase64Encode(append(coordinate(r), coordinate(s)...))
+
+	sigs, err := json.MarshalIndent([]*jsonSignature{sig}, "   ", "   ")
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Write(raw[:formatLength])
+	buf.WriteString(",\n   \"signatures\": ")
+	buf.Write(sigs)
+	buf.Write(raw[formatLength:])
+	return buf.Bytes(), nil
+}
+
+// VerifyManifest checks the signatures of the signed manifest raw, and
+// returns the id of the key among trusted which signed it. An error is
+// returned if a signature is invalid or if none is by a trusted key.
+func VerifyManifest(raw []byte, trusted []*ecdsa.PublicKey) (string, error) {
+	var signed struct {
+		Signatures []*jsonSignature `json:"signatures"`
+	}
+	if err := json.Unmarshal(raw, &signed); err != nil {
+		return "", err
+	}
+	if len(signed.Signatures) == 0 {
+		return "", ErrManifestNotSigned
+	}
+	payload, err := ManifestPayload(raw)
+	if err != nil {
+		return "", err
+	}
+	encodedPayload := joseBase64Encode(payload)
+
+	var signers []string
+	trustedBy := ""
+	for _, sig := range signed.Signatures {
+		if sig.Header.Algorithm != "ES256" {
+			return "", fmt.Errorf("Unsupported signature algorithm %s", sig.Header.Algorithm)
+		}
+		key, err := sig.Header.JWK.publicKey()
+		if err != nil {
+			return "", err
+		}
+		signature, err := joseBase64Decode(sig.Signature)
+		if err != nil || len(signature) != 64 {
+			return "", fmt.Errorf("Invalid signature by the key %s", KeyID(key))
+		}
+		h := sha256.Sum256([]byte(sig.Protected + "." + encodedPayload))
+		if !ecdsa.Verify(key, h[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+			return "", fmt.Errorf("Invalid signature by the key %s", KeyID(key))
+		}
+		for _, t := range trusted {
+			if t.X.Cmp(key.X) == 0 && t.Y.Cmp(key.Y) == 0 {
+				trustedBy = KeyID(key)
+			}
+		}
+		signers = append(signers, KeyID(key))
+	}
+	if trustedBy != "" {
+		return trustedBy, nil
+	}
+	return "", fmt.Errorf("The manifest is signed by %s, which is not a trusted key", strings.Join(signers, ", "))
+}
+
+// LoadOrCreateTrustKey returns the private key of the trust directory dir,
+// which is generated the first time along with its public key.
+func LoadOrCreateTrustKey(dir string) (*ecdsa.PrivateKey, error) {
+	keyFile := filepath.Join(dir, TrustKeyFile)
+	data, err := ioutil.ReadFile(keyFile)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "EC PRIVATE KEY" {
+			return nil, fmt.Errorf("Invalid trust key %s: expected an EC private key in PEM format", keyFile)
+		}
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trust key %s: %s", keyFile, err)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	pubDer, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, TrustedKeysDir), 0700); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, TrustPublicKeyFile), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDer}), 0644); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// LoadTrustedKeys returns the public keys of the files ending in .pem in
+// the trusted keys directory of the trust directory dir.
+func LoadTrustedKeys(dir string) ([]*ecdsa.PublicKey, error) {
+	files, err := filepath.Glob(filepath.Join(dir, TrustedKeysDir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	var keys []*ecdsa.PublicKey
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("Invalid trusted key %s: expected a public key in PEM format", file)
+		}
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted key %s: %s", file, err)
+		}
+		key, ok := pub.(*ecdsa.PublicKey)
+		if !ok || key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("Invalid trusted key %s: only P-256 ECDSA keys are supported", file)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
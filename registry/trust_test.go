@@ -0,0 +1,159 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTrustKeys(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-trust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	key, err := LoadOrCreateTrustKey(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadOrCreateTrustKey(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, KeyID(&loaded.PublicKey), KeyID(&key.PublicKey), "Expected the key to be loaded again")
+	assertEqual(t, len(KeyID(&key.PublicKey)), 59, "Unexpected key id "+KeyID(&key.PublicKey))
+
+	keys, err := LoadTrustedKeys(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(keys), 0, "Expected no trusted key")
+
+	// Trust the public key of the daemon
+	pub, err := ioutil.ReadFile(filepath.Join(tmp, TrustPublicKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, TrustedKeysDir, "ci.pem"), pub, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err = LoadTrustedKeys(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || KeyID(keys[0]) != KeyID(&key.PublicKey) {
+		t.Fatalf("Expected the public key of the daemon to be trusted, got %v", keys)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tmp, TrustedKeysDir, "invalid.pem"), []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTrustedKeys(tmp); err == nil {
+		t.Fatal("Expected an error loading an invalid trusted key")
+	}
+}
+
+func TestSignManifest(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-trust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	key, err := LoadOrCreateTrustKey(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := LoadOrCreateTrustKey(filepath.Join(tmp, "other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := &Manifest{
+		SchemaVersion: 1,
+		Name:          "foo/bar",
+		Tag:           "latest",
+		FSLayers:      []*FSLayer{{BlobSum: Digest([]byte("layer"))}},
+		History:       []*ManifestHistory{{V1Compatibility: `{"id":"abcd"}`}},
+	}
+	payload, err := json.MarshalIndent(manifest, "", "   ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := SignManifest(payload, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The payload and its digest are kept
+	recovered, err := ManifestPayload(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(recovered, payload) {
+		t.Fatalf("Expected the payload to be recovered, got %s", recovered)
+	}
+
+	keyID, err := VerifyManifest(signed, []*ecdsa.PublicKey{&other.PublicKey, &key.PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, keyID, KeyID(&key.PublicKey), "Unexpected signing key")
+
+	if _, err := VerifyManifest(signed, []*ecdsa.PublicKey{&other.PublicKey}); err == nil {
+		t.Fatal("Expected an error verifying a manifest signed by an untrusted key")
+	}
+	if _, err := VerifyManifest(payload, []*ecdsa.PublicKey{&key.PublicKey}); err != ErrManifestNotSigned {
+		t.Fatalf("Expected ErrManifestNotSigned, got %v", err)
+	}
+	tampered := bytes.Replace(signed, []byte(`"latest"`), []byte(`"stable"`), 1)
+	if _, err := VerifyManifest(tampered, []*ecdsa.PublicKey{&key.PublicKey}); err == nil {
+		t.Fatal("Expected an error verifying a tampered manifest")
+	}
+}
+
+func TestPushPullSignedManifest(t *testing.T) {
+	r := spawnTestRegistry(t)
+	endpoint := makeURL("/v2/")
+
+	tmp, err := ioutil.TempDir("", "docker-trust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	key, err := LoadOrCreateTrustKey(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layer := []byte("signed")
+	if err := r.PutV2Blob(endpoint, "foo42/signed", Digest(layer), bytes.NewReader(layer), int64(len(layer))); err != nil {
+		t.Fatal(err)
+	}
+	manifest := &Manifest{
+		SchemaVersion: 1,
+		Name:          "foo42/signed",
+		Tag:           "latest",
+		FSLayers:      []*FSLayer{{BlobSum: Digest(layer)}},
+		History:       []*ManifestHistory{{V1Compatibility: `{"id":"abcd"}`}},
+	}
+	digest, err := r.PutV2Manifest(endpoint, "foo42/signed", "latest", manifest, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The digest doesn't depend on the signatures
+	for _, reference := range []string{"latest", digest} {
+		pulled, pulledDigest, err := r.GetV2Manifest(endpoint, "foo42/signed", reference)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, pulledDigest, digest, "Unexpected digest of the manifest "+reference)
+		if _, err := VerifyManifest(pulled.Raw, []*ecdsa.PublicKey{&key.PublicKey}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -22,6 +22,7 @@ func Compare(a, b *Config) bool {
 		len(a.PortSpecs) != len(b.PortSpecs) ||
 		len(a.ExposedPorts) != len(b.ExposedPorts) ||
 		len(a.Entrypoint) != len(b.Entrypoint) ||
+		len(a.Shell) != len(b.Shell) ||
 		len(a.Volumes) != len(b.Volumes) {
 		return false
 	}
@@ -51,6 +52,11 @@ func Compare(a, b *Config) bool {
 			return false
 		}
 	}
+	for i := 0; i < len(a.Shell); i++ {
+		if a.Shell[i] != b.Shell[i] {
+			return false
+		}
+	}
 	for key := range a.Volumes {
 		if _, exists := b.Volumes[key]; !exists {
 			return false
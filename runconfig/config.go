@@ -32,6 +32,8 @@ type Config struct {
 	Entrypoint      []string
 	NetworkDisabled bool
 	OnBuild         []string
+	StorageOpt      map[string]string // Storage driver options for the writable layer, eg. size=10G
+	Shell           []string          // Shell used by the shell form of RUN, CMD and ENTRYPOINT in builds
 }
 
 func ContainerConfigFromJob(job *engine.Job) *Config {
@@ -55,6 +57,7 @@ func ContainerConfigFromJob(job *engine.Job) *Config {
 	}
 	job.GetenvJson("ExposedPorts", &config.ExposedPorts)
 	job.GetenvJson("Volumes", &config.Volumes)
+	job.GetenvJson("StorageOpt", &config.StorageOpt)
 	if PortSpecs := job.GetenvList("PortSpecs"); PortSpecs != nil {
 		config.PortSpecs = PortSpecs
 	}
@@ -67,5 +70,8 @@ func ContainerConfigFromJob(job *engine.Job) *Config {
 	if Entrypoint := job.GetenvList("Entrypoint"); Entrypoint != nil {
 		config.Entrypoint = Entrypoint
 	}
+	if Shell := job.GetenvList("Shell"); Shell != nil {
+		config.Shell = Shell
+	}
 	return config
 }
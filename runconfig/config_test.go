@@ -174,6 +174,11 @@ func TestCompare(t *testing.T) {
 	if Compare(&config1, &config5) {
 		t.Fatalf("Compare should return false, Volumes are different")
 	}
+	config6 := config1
+	config6.Shell = []string{"/bin/bash", "-c"}
+	if Compare(&config1, &config6) {
+		t.Fatalf("Compare should return false, Shell is different")
+	}
 	if !Compare(&config1, &config1) {
 		t.Fatalf("Compare should return true")
 	}
@@ -49,6 +49,7 @@ func parseRun(cmd *flag.FlagSet, args []string, sysInfo *sysinfo.SysInfo) (*Conf
 		flVolumesFrom opts.ListOpts
 		flLxcOpts     opts.ListOpts
 		flEnvFile     opts.ListOpts
+		flStorageOpt  opts.ListOpts
 
 		flAutoRemove      = cmd.Bool([]string{"#rm", "-rm"}, false, "Automatically remove the container when it exits (incompatible with -d)")
 		flDetach          = cmd.Bool([]string{"d", "-detach"}, false, "Detached mode: Run container in the background, print new container id")
@@ -83,6 +84,7 @@ func parseRun(cmd *flag.FlagSet, args []string, sysInfo *sysinfo.SysInfo) (*Conf
 	cmd.Var(&flDnsSearch, []string{"-dns-search"}, "Set custom dns search domains")
 	cmd.Var(&flVolumesFrom, []string{"#volumes-from", "-volumes-from"}, "Mount volumes from the specified container(s)")
 	cmd.Var(&flLxcOpts, []string{"#lxc-conf", "-lxc-conf"}, "(lxc exec-driver only) Add custom lxc options --lxc-conf=\"lxc.cgroup.cpuset.cpus = 0,1\"")
+	cmd.Var(&flStorageOpt, []string{"-storage-opt"}, "Set storage driver options for the container (e.g. --storage-opt size=10G)")
 
 	if err := cmd.Parse(args); err != nil {
 		return nil, nil, cmd, err
@@ -165,6 +167,11 @@ func parseRun(cmd *flag.FlagSet, args []string, sysInfo *sysinfo.SysInfo) (*Conf
 		return nil, nil, cmd, err
 	}
 
+	storageOpt, err := parseStorageOpts(flStorageOpt)
+	if err != nil {
+		return nil, nil, cmd, err
+	}
+
 	var (
 		domainname string
 		hostname   = *flHostname
@@ -231,6 +238,7 @@ func parseRun(cmd *flag.FlagSet, args []string, sysInfo *sysinfo.SysInfo) (*Conf
 		Volumes:         flVolumes.GetMap(),
 		Entrypoint:      entrypoint,
 		WorkingDir:      *flWorkingDir,
+		StorageOpt:      storageOpt,
 	}
 
 	hostConfig := &HostConfig{
@@ -290,6 +298,29 @@ func parseKeyValueOpts(opts opts.ListOpts) ([]utils.KeyValuePair, error) {
 	return out, nil
 }
 
+func parseStorageOpts(opts opts.ListOpts) (map[string]string, error) {
+	if opts.Len() == 0 {
+		return nil, nil
+	}
+	out := make(map[string]string, opts.Len())
+	for _, o := range opts.GetAll() {
+		k, v, err := utils.ParseKeyValueOpt(o)
+		if err != nil {
+			return nil, err
+		}
+		switch k {
+		case "size":
+			if _, err := units.RAMInBytes(v); err != nil {
+				return nil, fmt.Errorf("invalid storage size %s: %s", v, err)
+			}
+		default:
+			return nil, fmt.Errorf("unknown storage option %s", k)
+		}
+		out[k] = v
+	}
+	return out, nil
+}
+
 func parseNetMode(netMode string) (NetworkMode, error) {
 	parts := strings.Split(netMode, ":")
 	switch mode := parts[0]; mode {
@@ -22,3 +22,19 @@ func TestParseLxcConfOpt(t *testing.T) {
 		}
 	}
 }
+
+func TestParseStorageOpt(t *testing.T) {
+	config, _, _, err := Parse([]string{"--storage-opt", "size=10G", "busybox"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.StorageOpt["size"] != "10G" {
+		t.Fatalf("Expected size=10G, got %v", config.StorageOpt)
+	}
+
+	for _, opt := range []string{"size", "size=ten", "quota=10G"} {
+		if _, _, _, err := Parse([]string{"--storage-opt", opt, "busybox"}, nil); err == nil {
+			t.Fatalf("Expected an error for --storage-opt %s", opt)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/url"
 	"os"
 	"path"
@@ -15,14 +16,19 @@ import (
 	"reflect"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/dotcloud/docker/archive"
 	"github.com/dotcloud/docker/daemon"
+	"github.com/dotcloud/docker/image"
 	"github.com/dotcloud/docker/nat"
+	"github.com/dotcloud/docker/pkg/mount"
 	"github.com/dotcloud/docker/pkg/symlink"
 	"github.com/dotcloud/docker/pkg/system"
+	"github.com/dotcloud/docker/pkg/user"
 	"github.com/dotcloud/docker/registry"
 	"github.com/dotcloud/docker/runconfig"
 	"github.com/dotcloud/docker/utils"
@@ -48,6 +54,36 @@ type buildFile struct {
 
 	contextPath string
 	context     *utils.TarSum
+	excludes    []string
+	// Path of the Dockerfile, relative to the context, if not Dockerfile
+	dockerfileName string
+
+	// Images built by the previous stages of a multi-stage build,
+	// by stage name and index
+	stages     map[string]string
+	stageName  string
+	stageCount int
+	// Name of the stage to stop at, if any
+	target string
+
+	// Images whose history is used as cache, instead of the local images
+	cacheFrom       []string
+	cacheFromImages []*image.Image
+
+	// Contents of the secrets RUN --secret can use, by id
+	secrets map[string][]byte
+	// Paths of the SSH agent sockets RUN --ssh can use, by id
+	sshAgents map[string]string
+
+	// Squash the layers of the last stage into one
+	squash bool
+	// Image of the FROM of the current stage, and its following steps
+	stageBase  string
+	stageSteps []string
+
+	// Send a JSON record of each step, and whether it used the cache
+	jsonSteps bool
+	cached    bool
 
 	verbose      bool
 	utilizeCache bool
@@ -80,8 +116,19 @@ func (b *buildFile) clearTmp(containers map[string]struct{}) {
 	}
 }
 
-func (b *buildFile) CmdFrom(name string) error {
-	image, err := b.daemon.Repositories().LookupImage(name)
+// getImage returns the image built by the stage name of a multi-stage
+// build, or else the image name, which is pulled if needed.
+func (b *buildFile) getImage(name string) (*image.Image, error) {
+	if id, exists := b.stages[strings.ToLower(name)]; exists {
+		return b.daemon.Graph().Get(id)
+	}
+	return b.lookupOrPullImage(name)
+}
+
+// lookupOrPullImage returns the image name, which is pulled with the
+// credentials of the build if it doesn't exist locally.
+func (b *buildFile) lookupOrPullImage(name string) (*image.Image, error) {
+	img, err := b.daemon.Repositories().LookupImage(name)
 	if err != nil {
 		if b.daemon.Graph().IsNotExist(err) {
 			remote, tag := utils.ParseRepositoryTag(name)
@@ -90,7 +137,7 @@ func (b *buildFile) CmdFrom(name string) error {
 				// The request came with a full auth config file, we prefer to use that
 				endpoint, _, err := registry.ResolveRepositoryName(remote)
 				if err != nil {
-					return err
+					return nil, err
 				}
 				resolvedAuth := b.configFile.ResolveAuthConfig(endpoint)
 				pullRegistryAuth = &resolvedAuth
@@ -101,20 +148,62 @@ func (b *buildFile) CmdFrom(name string) error {
 			job.SetenvJson("authConfig", pullRegistryAuth)
 			job.Stdout.Add(b.outOld)
 			if err := job.Run(); err != nil {
-				return err
+				return nil, err
 			}
-			image, err = b.daemon.Repositories().LookupImage(name)
-			if err != nil {
-				return err
-			}
-		} else {
-			return err
+			return b.daemon.Repositories().LookupImage(name)
 		}
+		return nil, err
 	}
-	b.image = image.ID
+	return img, nil
+}
+
+// parseFrom parses the arguments of FROM: <image> [AS <name>].
+func parseFrom(args string) (name, stageName string, err error) {
+	fields := strings.Fields(args)
+	switch {
+	case len(fields) == 1:
+		return fields[0], "", nil
+	case len(fields) == 3 && strings.EqualFold(fields[1], "AS"):
+		stageName = strings.ToLower(fields[2])
+		if _, err := strconv.Atoi(stageName); err == nil {
+			return "", "", fmt.Errorf("Invalid stage name %s, it can't be a number", fields[2])
+		}
+		return fields[0], stageName, nil
+	}
+	return "", "", fmt.Errorf("Invalid FROM format, must be FROM <image> [AS <name>]")
+}
+
+// Each FROM starts a new stage. The images built by the previous stages
+// can be used by FROM and COPY --from.
+func (b *buildFile) CmdFrom(args string) error {
+	name, stageName, err := parseFrom(args)
+	if err != nil {
+		return err
+	}
+	if b.stageCount > 0 {
+		b.stages[strconv.Itoa(b.stageCount-1)] = b.image
+		if b.stageName != "" {
+			b.stages[b.stageName] = b.image
+		}
+	}
+	if _, exists := b.stages[stageName]; exists && stageName != "" {
+		return fmt.Errorf("Duplicate stage name %s", stageName)
+	}
+
+	img, err := b.getImage(name)
+	if err != nil {
+		return err
+	}
+	b.stageName = stageName
+	b.stageCount++
+
+	b.image = img.ID
+	b.stageBase = img.ID
+	b.stageSteps = nil
+	b.maintainer = ""
 	b.config = &runconfig.Config{}
-	if image.Config != nil {
-		b.config = image.Config
+	if img.Config != nil {
+		b.config = img.Config
 	}
 	if b.config.Env == nil || len(b.config.Env) == 0 {
 		b.config.Env = append(b.config.Env, "HOME=/", "PATH="+daemon.DefaultPathEnv)
@@ -160,31 +249,79 @@ func (b *buildFile) CmdMaintainer(name string) error {
 	return b.commit("", b.config.Cmd, fmt.Sprintf("MAINTAINER %s", name))
 }
 
+// loadCacheFrom looks up the history of the --cache-from images, which are
+// pulled if they don't exist locally. Images which can't be pulled are
+// skipped.
+func (b *buildFile) loadCacheFrom() error {
+	for _, name := range b.cacheFrom {
+		img, err := b.lookupOrPullImage(name)
+		if err != nil {
+			fmt.Fprintf(b.errStream, "Warning: can't use %s as cache, skipping: %s\n", name, err)
+			continue
+		}
+		history, err := img.History()
+		if err != nil {
+			return err
+		}
+		b.cacheFromImages = append(b.cacheFromImages, history...)
+	}
+	return nil
+}
+
+// getCachedFrom returns the image built from the current image with the
+// current config in the history of the --cache-from images, if any.
+func (b *buildFile) getCachedFrom() *image.Image {
+	var children []*image.Image
+	for _, img := range b.cacheFromImages {
+		if img.Parent == b.image {
+			children = append(children, img)
+		}
+	}
+	return getCachedChild(children, b.config)
+}
+
 // probeCache checks to see if image-caching is enabled (`b.utilizeCache`)
 // and if so attempts to look up the current `b.image` and `b.config` pair
-// in the current server `b.srv`. If an image is found, probeCache returns
+// in the current server `b.srv`, or only in the history of the --cache-from
+// images if any were given. If an image is found, probeCache returns
 // `(true, nil)`. If no image is found, it returns `(false, nil)`. If there
 // is any error, it returns `(false, err)`.
 func (b *buildFile) probeCache() (bool, error) {
 	if b.utilizeCache {
-		if cache, err := b.srv.ImageGetCached(b.image, b.config); err != nil {
-			return false, err
-		} else if cache != nil {
+		var cache *image.Image
+		if len(b.cacheFrom) > 0 {
+			cache = b.getCachedFrom()
+		} else {
+			var err error
+			if cache, err = b.srv.ImageGetCached(b.image, b.config); err != nil {
+				return false, err
+			}
+		}
+		if cache != nil {
 			fmt.Fprintf(b.outStream, " ---> Using cache\n")
 			utils.Debugf("[BUILDER] Use cached version")
 			b.image = cache.ID
+			b.cached = true
 			return true, nil
 		} else {
 			utils.Debugf("[BUILDER] Cache miss")
 		}
 	}
+	b.cached = false
 	return false, nil
 }
 
+// RUN --secret=<id>[,<id>...] exposes the given build secrets to the
+// command, and RUN --ssh=<id> forwards it the given SSH agent. They are left
+// out of the cache key and of the committed image.
 func (b *buildFile) CmdRun(args string) error {
 	if b.image == "" {
 		return fmt.Errorf("Please provide a source image with `from` prior to run")
 	}
+	flags, args, err := parseFlags(args, "secret", "ssh")
+	if err != nil {
+		return err
+	}
 	config, _, _, err := runconfig.Parse(append([]string{b.image}, b.buildCmdFromJson(args)...), nil)
 	if err != nil {
 		return err
@@ -215,7 +352,51 @@ func (b *buildFile) CmdRun(args string) error {
 	c.Mount()
 	defer c.Unmount()
 
+	var (
+		binds    []string
+		releases []func() error
+	)
+	release := func() error {
+		var err error
+		for _, release := range releases {
+			if e := release(); e != nil && err == nil {
+				err = e
+			}
+		}
+		return err
+	}
+	if ids, exists := flags["secret"]; exists {
+		bind, releaseSecrets, err := b.mountSecrets(c, strings.Split(ids, ","))
+		if err != nil {
+			return err
+		}
+		binds = append(binds, bind)
+		releases = append(releases, releaseSecrets)
+	}
+	if id, exists := flags["ssh"]; exists {
+		bind, releaseAgent, err := b.forwardSSHAgent(c, id)
+		if err != nil {
+			release()
+			return err
+		}
+		binds = append(binds, bind)
+		releases = append(releases, releaseAgent)
+
+		// The container sees the agent through SSH_AUTH_SOCK, which is
+		// only set for this step: the config of c is restored before
+		// the commit, and b.config is left as is
+		runConfig := *b.config
+		runConfig.Env = append(append([]string{}, b.config.Env...), "SSH_AUTH_SOCK="+path.Join(sshAgentDir, sshAgentSocket))
+		c.Config = &runConfig
+	}
+	if len(binds) > 0 {
+		c.SetHostConfig(&runconfig.HostConfig{Binds: binds})
+	}
 	err = b.run(c)
+	c.Config = b.config
+	if err := release(); err != nil {
+		return err
+	}
 	if err != nil {
 		return err
 	}
@@ -226,6 +407,186 @@ func (b *buildFile) CmdRun(args string) error {
 	return nil
 }
 
+// Mount points of the build secrets and of the SSH agent socket in the
+// build containers
+const (
+	secretsDir     = "/run/secrets"
+	sshAgentDir    = "/run/ssh-agent"
+	sshAgentSocket = "agent.sock"
+)
+
+// mountSecrets writes the build secrets ids to a tmpfs, and returns the
+// bind mounting it read-only at /run/secrets in the container c. The
+// returned function unmounts the tmpfs, and removes the mount point from the
+// rootfs of c if it had to be created, so that nothing is left in the layer
+// committed from c.
+func (b *buildFile) mountSecrets(c *daemon.Container, ids []string) (string, func() error, error) {
+	tmpfs, err := ioutil.TempDir("", "docker-build-secrets")
+	if err != nil {
+		return "", nil, err
+	}
+	if err := mount.Mount("tmpfs", tmpfs, "tmpfs", "mode=0755"); err != nil {
+		os.RemoveAll(tmpfs)
+		return "", nil, err
+	}
+	releaseTmpfs := func() error {
+		if err := mount.Unmount(tmpfs); err != nil {
+			return err
+		}
+		return os.RemoveAll(tmpfs)
+	}
+
+	for _, id := range ids {
+		if id == "" || id == "." || id == ".." || strings.Contains(id, "/") {
+			releaseTmpfs()
+			return "", nil, fmt.Errorf("Invalid secret id: %q", id)
+		}
+		data, exists := b.secrets[id]
+		if !exists {
+			releaseTmpfs()
+			return "", nil, fmt.Errorf("Secret %s not found, use docker build --secret id=%s,src=<file>", id, id)
+		}
+		if err := ioutil.WriteFile(path.Join(tmpfs, id), data, 0400); err != nil {
+			releaseTmpfs()
+			return "", nil, err
+		}
+	}
+
+	releaseMountPoint, err := createdMountPoint(c, secretsDir)
+	if err != nil {
+		releaseTmpfs()
+		return "", nil, err
+	}
+	return tmpfs + ":" + secretsDir + ":ro", func() error {
+		if err := releaseMountPoint(); err != nil {
+			releaseTmpfs()
+			return err
+		}
+		return releaseTmpfs()
+	}, nil
+}
+
+// forwardSSHAgent listens on a socket forwarding its connections to the SSH
+// agent id given to the build, and returns the bind mounting its directory
+// at /run/ssh-agent in the container c. The agent must be a socket on the
+// host of the daemon. Only the user of the step can use the forwarded
+// socket. The returned function closes the socket, and removes the mount
+// point from the rootfs of c if it had to be created.
+func (b *buildFile) forwardSSHAgent(c *daemon.Container, id string) (string, func() error, error) {
+	agent, exists := b.sshAgents[id]
+	if !exists {
+		return "", nil, fmt.Errorf("SSH agent %s not found, use docker build --ssh %s[=<socket>]", id, id)
+	}
+	if !filepath.IsAbs(agent) || filepath.Clean(agent) != agent {
+		return "", nil, fmt.Errorf("Invalid socket %q of the SSH agent %s: must be an absolute path", agent, id)
+	}
+	if fi, err := os.Stat(agent); err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return "", nil, fmt.Errorf("Invalid socket %q of the SSH agent %s: not a socket on the daemon host", agent, id)
+	}
+	uid, gid := 0, 0
+	if b.config.User != "" {
+		var err error
+		if uid, gid, err = parseChown(b.config.User, c.RootfsPath()); err != nil {
+			return "", nil, err
+		}
+	}
+	conn, err := net.Dial("unix", agent)
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to reach the SSH agent %s, the daemon must run on the same host as docker build: %s", id, err)
+	}
+	conn.Close()
+
+	dir, err := ioutil.TempDir("", "docker-build-ssh")
+	if err != nil {
+		return "", nil, err
+	}
+	l, err := net.Listen("unix", path.Join(dir, sshAgentSocket))
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	// The socket and its directory belong to the user of the step, as the
+	// socket of ssh -A does
+	for p, mode := range map[string]os.FileMode{dir: 0700, path.Join(dir, sshAgentSocket): 0600} {
+		err := os.Chown(p, uid, gid)
+		if err == nil {
+			err = os.Chmod(p, mode)
+		}
+		if err != nil {
+			l.Close()
+			os.RemoveAll(dir)
+			return "", nil, err
+		}
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go proxySSHAgent(conn, agent)
+		}
+	}()
+	releaseListener := func() error {
+		l.Close()
+		return os.RemoveAll(dir)
+	}
+
+	releaseMountPoint, err := createdMountPoint(c, sshAgentDir)
+	if err != nil {
+		releaseListener()
+		return "", nil, err
+	}
+	return dir + ":" + sshAgentDir + ":ro", func() error {
+		if err := releaseMountPoint(); err != nil {
+			releaseListener()
+			return err
+		}
+		return releaseListener()
+	}, nil
+}
+
+// proxySSHAgent forwards the connection conn to the agent socket.
+func proxySSHAgent(conn net.Conn, agent string) {
+	defer conn.Close()
+	agentConn, err := net.Dial("unix", agent)
+	if err != nil {
+		utils.Errorf("Unable to reach the SSH agent %s: %s", agent, err)
+		return
+	}
+	defer agentConn.Close()
+	go func() {
+		io.Copy(agentConn, conn)
+		// Let the agent know the client is done
+		agentConn.(*net.UnixConn).CloseWrite()
+	}()
+	io.Copy(conn, agentConn)
+}
+
+// createdMountPoint returns a function removing the topmost dir of the
+// mount point dest in the rootfs of the container c which doesn't exist yet,
+// i.e. which will be created for the mount.
+func createdMountPoint(c *daemon.Container, dest string) (func() error, error) {
+	rootfs := c.RootfsPath()
+	mountPoint, err := symlink.FollowSymlinkInScope(path.Join(rootfs, dest), rootfs)
+	if err != nil {
+		return nil, err
+	}
+	var created string
+	for dir := mountPoint; dir != rootfs && dir != "/"; dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); !os.IsNotExist(err) {
+			break
+		}
+		created = dir
+	}
+	return func() error {
+		if created == "" {
+			return nil
+		}
+		return os.RemoveAll(created)
+	}, nil
+}
+
 func (b *buildFile) FindEnvKey(key string) int {
 	for k, envVar := range b.config.Env {
 		envParts := strings.SplitN(envVar, "=", 2)
@@ -283,15 +644,36 @@ func (b *buildFile) CmdEnv(args string) error {
 	return b.commit("", b.config.Cmd, fmt.Sprintf("ENV %s", replacedVar))
 }
 
+// shell returns the command prefix of the shell form of RUN, CMD and
+// ENTRYPOINT, as set by SHELL.
+func (b *buildFile) shell() []string {
+	if len(b.config.Shell) > 0 {
+		return b.config.Shell
+	}
+	return []string{"/bin/sh", "-c"}
+}
+
 func (b *buildFile) buildCmdFromJson(args string) []string {
 	var cmd []string
 	if err := json.Unmarshal([]byte(args), &cmd); err != nil {
-		utils.Debugf("Error unmarshalling: %s, setting to /bin/sh -c", err)
-		cmd = []string{"/bin/sh", "-c", args}
+		shell := b.shell()
+		utils.Debugf("Error unmarshalling: %s, setting to %s", err, strings.Join(shell, " "))
+		cmd = append(append([]string{}, shell...), args)
 	}
 	return cmd
 }
 
+// SHELL sets the shell used by the shell form of the following RUN, CMD and
+// ENTRYPOINT. It is kept in the image config, for the builds based on it.
+func (b *buildFile) CmdShell(args string) error {
+	var shell []string
+	if err := json.Unmarshal([]byte(args), &shell); err != nil || len(shell) == 0 {
+		return fmt.Errorf("SHELL requires a non-empty JSON array, e.g. SHELL [\"/bin/bash\", \"-c\"]")
+	}
+	b.config.Shell = shell
+	return b.commit("", b.config.Cmd, fmt.Sprintf("SHELL %v", shell))
+}
+
 func (b *buildFile) CmdCmd(args string) error {
 	cmd := b.buildCmdFromJson(args)
 	b.config.Cmd = cmd
@@ -339,8 +721,193 @@ func (b *buildFile) CmdInsert(args string) error {
 	return fmt.Errorf("INSERT has been deprecated. Please use ADD instead")
 }
 
+// COPY is like ADD, without remote files and archive extraction. With
+// --from=<stage|image>, the files are taken from the image built by an
+// earlier stage, or from another image, instead of the context.
 func (b *buildFile) CmdCopy(args string) error {
-	return fmt.Errorf("COPY has been deprecated. Please use ADD instead")
+	flags, args, err := parseFlags(args, "from", "chown")
+	if err != nil {
+		return err
+	}
+	if from, exists := flags["from"]; exists {
+		return b.copyFromImage(from, args, flags)
+	}
+	return b.runContextCommand(args, flags, false, false, "COPY")
+}
+
+// cacheFlags returns the flags names of an instruction which change its
+// result, to be part of its cache key.
+func cacheFlags(flags map[string]string, names ...string) string {
+	var s string
+	for _, name := range names {
+		if value, exists := flags[name]; exists {
+			s += fmt.Sprintf("--%s=%s ", name, value)
+		}
+	}
+	return s
+}
+
+// parseChown returns the uid and gid of --chown=<user>[:<group>]. Names are
+// looked up in the rootfs of the container. Without group, the gid is the
+// same as the uid.
+func parseChown(spec, rootfs string) (int, int, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	uid, err := lookupId(parts[0], rootfs, "/etc/passwd")
+	if err != nil {
+		return -1, -1, err
+	}
+	if len(parts) == 1 {
+		return uid, uid, nil
+	}
+	gid, err := lookupId(parts[1], rootfs, "/etc/group")
+	if err != nil {
+		return -1, -1, err
+	}
+	return uid, gid, nil
+}
+
+// lookupId returns the id of a user or group name in the passwd or group
+// file of rootfs. Numeric names are ids.
+func lookupId(name, rootfs, file string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		if id < 0 {
+			return -1, fmt.Errorf("Invalid id %d", id)
+		}
+		return id, nil
+	}
+	filePath, err := symlink.FollowSymlinkInScope(path.Join(rootfs, file), rootfs)
+	if err != nil {
+		return -1, err
+	}
+	var ids []int
+	if file == "/etc/passwd" {
+		users, err := user.ParsePasswdFileFilter(filePath, func(u *user.User) bool { return u.Name == name })
+		if err != nil && !os.IsNotExist(err) {
+			return -1, err
+		}
+		for _, u := range users {
+			ids = append(ids, u.Uid)
+		}
+	} else {
+		groups, err := user.ParseGroupFileFilter(filePath, func(g *user.Group) bool { return g.Name == name })
+		if err != nil && !os.IsNotExist(err) {
+			return -1, err
+		}
+		for _, g := range groups {
+			ids = append(ids, g.Gid)
+		}
+	}
+	if len(ids) == 0 {
+		return -1, fmt.Errorf("Unable to find %s in %s", name, file)
+	}
+	return ids[0], nil
+}
+
+// parseFlags splits the leading --name=value flags off the arguments of
+// an instruction. Only the flags in allowed are accepted.
+func parseFlags(args string, allowed ...string) (map[string]string, string, error) {
+	flags := make(map[string]string)
+	for strings.HasPrefix(args, "--") {
+		parts := strings.SplitN(args, " ", 2)
+		flag := strings.SplitN(strings.TrimPrefix(parts[0], "--"), "=", 2)
+		if len(flag) != 2 {
+			return nil, "", fmt.Errorf("Invalid flag %s, must be --<name>=<value>", parts[0])
+		}
+		known := false
+		for _, name := range allowed {
+			if flag[0] == name {
+				known = true
+			}
+		}
+		if !known {
+			return nil, "", fmt.Errorf("Unknown flag --%s", flag[0])
+		}
+		flags[flag[0]] = flag[1]
+
+		args = ""
+		if len(parts) == 2 {
+			args = strings.TrimLeft(parts[1], " \t")
+		}
+	}
+	return flags, args, nil
+}
+
+func (b *buildFile) copyFromImage(from, args string, flags map[string]string) error {
+	if b.image == "" {
+		return fmt.Errorf("Please provide a source image with `from` prior to copy")
+	}
+	tmp := strings.SplitN(args, " ", 2)
+	if len(tmp) != 2 {
+		return fmt.Errorf("Invalid COPY format")
+	}
+
+	orig, err := b.ReplaceEnvMatches(strings.Trim(tmp[0], " \t"))
+	if err != nil {
+		return err
+	}
+
+	dest, err := b.ReplaceEnvMatches(strings.Trim(tmp[1], " \t"))
+	if err != nil {
+		return err
+	}
+
+	img, err := b.getImage(from)
+	if err != nil {
+		return err
+	}
+
+	// Images are immutable, so their id is as good as a checksum
+	cmd := b.config.Cmd
+	b.config.Cmd = []string{"/bin/sh", "-c", fmt.Sprintf("#(nop) COPY %sfrom:%s:%s in %s", cacheFlags(flags, "chown"), img.ID, orig, dest)}
+	defer func(cmd []string) { b.config.Cmd = cmd }(cmd)
+	b.config.Image = b.image
+
+	hit, err := b.probeCache()
+	if err != nil {
+		return err
+	}
+	if hit {
+		return nil
+	}
+
+	driver := b.daemon.Graph().Driver()
+	rootfs, err := driver.Get(img.ID, "")
+	if err != nil {
+		return fmt.Errorf("Driver %s failed to get image rootfs %s: %s", driver, img.ID, err)
+	}
+	defer driver.Put(img.ID)
+
+	origPath, err := symlink.FollowSymlinkInScope(path.Join(rootfs, orig), rootfs)
+	if err != nil {
+		return err
+	}
+	origPath, err = filepath.Rel(rootfs, origPath)
+	if err != nil {
+		return err
+	}
+
+	container, _, err := b.daemon.Create(b.config, "")
+	if err != nil {
+		return err
+	}
+	b.tmpContainers[container.ID] = struct{}{}
+
+	if err := container.Mount(); err != nil {
+		return err
+	}
+	defer container.Unmount()
+
+	uid, gid := 0, 0
+	if spec, exists := flags["chown"]; exists {
+		if uid, gid, err = parseChown(spec, container.RootfsPath()); err != nil {
+			return err
+		}
+	}
+	if err := b.addContext(container, rootfs, origPath, dest, false, uid, gid); err != nil {
+		return err
+	}
+
+	return b.commit(container.ID, cmd, fmt.Sprintf("COPY --from=%s %s in %s", from, orig, dest))
 }
 
 func (b *buildFile) CmdWorkdir(workdir string) error {
@@ -399,11 +966,14 @@ func (b *buildFile) checkPathForAddition(orig string) error {
 	return nil
 }
 
-func (b *buildFile) addContext(container *daemon.Container, orig, dest string, remote bool) error {
+// addContext copies orig, relative to root, to dest in the container, owned
+// by uid and gid. Local archives are extracted if decompress is true, with
+// the ownership of their files.
+func (b *buildFile) addContext(container *daemon.Container, root, orig, dest string, decompress bool, uid, gid int) error {
 	var (
 		err        error
 		destExists = true
-		origPath   = path.Join(b.contextPath, orig)
+		origPath   = path.Join(root, orig)
 		destPath   = path.Join(container.RootfsPath(), dest)
 	)
 
@@ -436,11 +1006,10 @@ func (b *buildFile) addContext(container *daemon.Container, orig, dest string, r
 	}
 
 	if fi.IsDir() {
-		return copyAsDirectory(origPath, destPath, destExists)
+		return copyAsDirectory(origPath, destPath, destExists, uid, gid)
 	}
 
-	// If we are adding a remote file, do not try to untar it
-	if !remote {
+	if decompress {
 		// First try to unpack the source as an archive
 		// to support the untar feature we need to clean up the path a little bit
 		// because tar is very forgiving.  First we need to strip off the archive's
@@ -470,16 +1039,35 @@ func (b *buildFile) addContext(container *daemon.Container, orig, dest string, r
 		resPath = path.Join(destPath, path.Base(origPath))
 	}
 
-	return fixPermissions(resPath, 0, 0)
+	return fixPermissions(resPath, uid, gid)
 }
 
+// ADD --checksum=sha256:<hex> checks the content of remote files, and
+// --extract=false copies local archives as they are.
 func (b *buildFile) CmdAdd(args string) error {
+	flags, args, err := parseFlags(args, "checksum", "chown", "extract")
+	if err != nil {
+		return err
+	}
+	extract := true
+	if value, exists := flags["extract"]; exists {
+		if extract, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("Invalid --extract value %s", value)
+		}
+	}
+	return b.runContextCommand(args, flags, true, extract, "ADD")
+}
+
+// runContextCommand copies a file or directory of the context, or a remote
+// file if allowRemote is true, to the image. Local archives are extracted
+// if allowDecompression is true.
+func (b *buildFile) runContextCommand(args string, flags map[string]string, allowRemote, allowDecompression bool, cmdName string) error {
 	if b.context == nil {
-		return fmt.Errorf("No context given. Impossible to use ADD")
+		return fmt.Errorf("No context given. Impossible to use %s", cmdName)
 	}
 	tmp := strings.SplitN(args, " ", 2)
 	if len(tmp) != 2 {
-		return fmt.Errorf("Invalid ADD format")
+		return fmt.Errorf("Invalid %s format", cmdName)
 	}
 
 	orig, err := b.ReplaceEnvMatches(strings.Trim(tmp[0], " \t"))
@@ -493,7 +1081,7 @@ func (b *buildFile) CmdAdd(args string) error {
 	}
 
 	cmd := b.config.Cmd
-	b.config.Cmd = []string{"/bin/sh", "-c", fmt.Sprintf("#(nop) ADD %s in %s", orig, dest)}
+	b.config.Cmd = []string{"/bin/sh", "-c", fmt.Sprintf("#(nop) %s %s in %s", cmdName, orig, dest)}
 	defer func(cmd []string) { b.config.Cmd = cmd }(cmd)
 	b.config.Image = b.image
 
@@ -504,7 +1092,20 @@ func (b *buildFile) CmdAdd(args string) error {
 		isRemote   bool
 	)
 
+	checksum, hasChecksum := flags["checksum"]
+	if hasChecksum {
+		if !utils.IsURL(orig) {
+			return fmt.Errorf("--checksum can only be used with URLs")
+		}
+		if !strings.HasPrefix(checksum, "sha256:") {
+			return fmt.Errorf("Unsupported checksum %s, only sha256:<hex> is supported", checksum)
+		}
+	}
+
 	if utils.IsURL(orig) {
+		if !allowRemote {
+			return fmt.Errorf("Source can't be a URL for %s", cmdName)
+		}
 		// Initiate the download
 		isRemote = true
 		resp, err := utils.Download(orig)
@@ -527,12 +1128,17 @@ func (b *buildFile) CmdAdd(args string) error {
 		defer os.RemoveAll(tmpDirName)
 
 		// Download and dump result to tmp file
-		if _, err := io.Copy(tmpFile, resp.Body); err != nil {
+		h := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(tmpFile, h), resp.Body); err != nil {
 			tmpFile.Close()
 			return err
 		}
 		tmpFile.Close()
 
+		if sum := "sha256:" + hex.EncodeToString(h.Sum(nil)); hasChecksum && sum != strings.ToLower(checksum) {
+			return fmt.Errorf("Checksum mismatch for %s: expected %s, got %s", orig, checksum, sum)
+		}
+
 		// Remove the mtime of the newly created tmp file
 		if err := system.UtimesNano(tmpFileName, make([]syscall.Timespec, 2)); err != nil {
 			return err
@@ -571,44 +1177,29 @@ func (b *buildFile) CmdAdd(args string) error {
 		}
 	}
 
+	if !isRemote {
+		if excluded, err := utils.Matches(origPath, b.excludes); err != nil {
+			return err
+		} else if excluded {
+			return fmt.Errorf("%s is excluded by .dockerignore", orig)
+		}
+	}
+
 	if err := b.checkPathForAddition(origPath); err != nil {
 		return err
 	}
 
-	// Hash path and check the cache
-	if b.utilizeCache {
-		var (
-			hash string
-			sums = b.context.GetSums()
-		)
-
-		if remoteHash != "" {
-			hash = remoteHash
-		} else if fi, err := os.Stat(path.Join(b.contextPath, origPath)); err != nil {
+	// Hash path and check the cache. The hash is kept in the container
+	// config of the image even without cache, so that later builds can
+	// use it.
+	hash := remoteHash
+	if hash == "" {
+		if hash, err = b.contextHash(origPath); err != nil {
 			return err
-		} else if fi.IsDir() {
-			var subfiles []string
-			for file, sum := range sums {
-				absFile := path.Join(b.contextPath, file)
-				absOrigPath := path.Join(b.contextPath, origPath)
-				if strings.HasPrefix(absFile, absOrigPath) {
-					subfiles = append(subfiles, sum)
-				}
-			}
-			sort.Strings(subfiles)
-			hasher := sha256.New()
-			hasher.Write([]byte(strings.Join(subfiles, ",")))
-			hash = "dir:" + hex.EncodeToString(hasher.Sum(nil))
-		} else {
-			if origPath[0] == '/' && len(origPath) > 1 {
-				origPath = origPath[1:]
-			}
-			origPath = strings.TrimPrefix(origPath, "./")
-			if h, ok := sums[origPath]; ok {
-				hash = "file:" + h
-			}
 		}
-		b.config.Cmd = []string{"/bin/sh", "-c", fmt.Sprintf("#(nop) ADD %s in %s", hash, dest)}
+	}
+	b.config.Cmd = []string{"/bin/sh", "-c", fmt.Sprintf("#(nop) %s %s%s in %s", cmdName, cacheFlags(flags, "chown", "extract"), hash, dest)}
+	if b.utilizeCache {
 		hit, err := b.probeCache()
 		if err != nil {
 			return err
@@ -631,16 +1222,59 @@ func (b *buildFile) CmdAdd(args string) error {
 	}
 	defer container.Unmount()
 
-	if err := b.addContext(container, origPath, destPath, isRemote); err != nil {
+	uid, gid := 0, 0
+	if spec, exists := flags["chown"]; exists {
+		if uid, gid, err = parseChown(spec, container.RootfsPath()); err != nil {
+			return err
+		}
+	}
+	if err := b.addContext(container, b.contextPath, origPath, destPath, allowDecompression && !isRemote, uid, gid); err != nil {
 		return err
 	}
 
-	if err := b.commit(container.ID, cmd, fmt.Sprintf("ADD %s in %s", orig, dest)); err != nil {
+	if err := b.commit(container.ID, cmd, fmt.Sprintf("%s %s in %s", cmdName, orig, dest)); err != nil {
 		return err
 	}
 	return nil
 }
 
+// contextHash returns a checksum of the file or directory origPath of the
+// context. The context sums only depend on the names, modes and contents of
+// the files, so the checksum doesn't change with their times, nor from a
+// machine to another.
+func (b *buildFile) contextHash(origPath string) (string, error) {
+	fi, err := os.Stat(path.Join(b.contextPath, origPath))
+	if err != nil {
+		return "", err
+	}
+	var (
+		sums = b.context.GetSums()
+		name = strings.TrimPrefix(path.Clean("/"+origPath), "/")
+	)
+	if !fi.IsDir() {
+		if sum, exists := sums[name]; exists {
+			return "file:" + sum, nil
+		}
+		return "", nil
+	}
+
+	var subfiles []string
+	for file, sum := range sums {
+		if name != "" && file != name && !strings.HasPrefix(file, name+"/") {
+			continue
+		}
+		// Leave out the files removed from the context
+		if excluded, _ := utils.Matches(file, b.excludes); excluded {
+			continue
+		}
+		subfiles = append(subfiles, sum)
+	}
+	sort.Strings(subfiles)
+	hasher := sha256.New()
+	hasher.Write([]byte(strings.Join(subfiles, ",")))
+	return "dir:" + hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
 func (b *buildFile) create() (*daemon.Container, error) {
 	if b.image == "" {
 		return nil, fmt.Errorf("Please provide a source image with `from` prior to run")
@@ -746,6 +1380,45 @@ func (b *buildFile) commit(id string, autoCmd []string, comment string) error {
 	return nil
 }
 
+// removeExcluded removes the files excluded by .dockerignore from the
+// build context.
+func (b *buildFile) removeExcluded() error {
+	if len(b.excludes) == 0 {
+		return nil
+	}
+	// Excluded directories can only be removed as a whole if
+	// no pattern includes back some of their content
+	removeDirs := true
+	for _, exclude := range b.excludes {
+		if strings.HasPrefix(exclude, "!") {
+			removeDirs = false
+		}
+	}
+	return filepath.Walk(b.contextPath, func(filePath string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relFilePath, err := filepath.Rel(b.contextPath, filePath)
+		if err != nil {
+			return err
+		}
+		excluded, err := utils.Matches(relFilePath, b.excludes)
+		if err != nil || !excluded {
+			return err
+		}
+		if !f.IsDir() {
+			return os.Remove(filePath)
+		}
+		if !removeDirs {
+			return nil
+		}
+		if err := os.RemoveAll(filePath); err != nil {
+			return err
+		}
+		return filepath.SkipDir
+	})
+}
+
 // Long lines can be split with a backslash
 var lineContinuation = regexp.MustCompile(`\s*\\\s*\n`)
 
@@ -760,15 +1433,41 @@ func (b *buildFile) Build(context io.Reader) (string, error) {
 		return "", err
 	}
 
-	b.context = &utils.TarSum{Reader: decompressedStream, DisableCompression: true}
+	b.context = &utils.TarSum{Reader: decompressedStream, DisableCompression: true, ContentOnly: true}
 	if err := archive.Untar(b.context, tmpdirPath, nil); err != nil {
 		return "", err
 	}
 	defer os.RemoveAll(tmpdirPath)
 
 	b.contextPath = tmpdirPath
-	filename := path.Join(tmpdirPath, "Dockerfile")
+
+	// Contexts sent by the client are already filtered, but not
+	// the remote ones
+	if b.excludes, err = utils.ReadDockerignore(tmpdirPath); err != nil {
+		return "", err
+	}
+	if err := b.removeExcluded(); err != nil {
+		return "", err
+	}
+
+	if b.utilizeCache {
+		if err := b.loadCacheFrom(); err != nil {
+			return "", err
+		}
+	}
+
+	dockerfileName := b.dockerfileName
+	if dockerfileName == "" {
+		dockerfileName = "Dockerfile"
+	}
+	filename, err := symlink.FollowSymlinkInScope(path.Join(tmpdirPath, dockerfileName), tmpdirPath)
+	if err != nil {
+		return "", err
+	}
 	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		if b.dockerfileName != "" {
+			return "", fmt.Errorf("Can't find %s in the context", b.dockerfileName)
+		}
 		return "", fmt.Errorf("Can't build a directory with no Dockerfile")
 	}
 	fileBytes, err := ioutil.ReadFile(filename)
@@ -787,7 +1486,27 @@ func (b *buildFile) Build(context io.Reader) (string, error) {
 		if len(line) == 0 {
 			continue
 		}
-		if err := b.BuildStep(fmt.Sprintf("%d", stepN), line); err != nil {
+		// The target stage ends where the next one starts
+		if b.target != "" && b.stageName == b.target && strings.EqualFold(strings.SplitN(line, " ", 2)[0], "FROM") {
+			break
+		}
+		start := time.Now()
+		b.cached = false
+		err := b.BuildStep(fmt.Sprintf("%d", stepN), line)
+		if b.jsonSteps {
+			step := &utils.JSONBuildStep{
+				Index:       stepN,
+				Instruction: line,
+				Cached:      b.cached,
+				Duration:    time.Since(start),
+				ImageID:     b.image,
+			}
+			if err != nil {
+				step.Error = err.Error()
+			}
+			b.outOld.Write(b.sf.FormatBuildStep(step))
+		}
+		if err != nil {
 			if b.forceRm {
 				b.clearTmp(b.tmpContainers)
 			}
@@ -795,8 +1514,19 @@ func (b *buildFile) Build(context io.Reader) (string, error) {
 		} else if b.rm {
 			b.clearTmp(b.tmpContainers)
 		}
+		if !strings.EqualFold(strings.SplitN(line, " ", 2)[0], "FROM") {
+			b.stageSteps = append(b.stageSteps, line)
+		}
 		stepN += 1
 	}
+	if b.target != "" && b.stageName != b.target {
+		return "", fmt.Errorf("Target stage %s not found", b.target)
+	}
+	if b.squash && b.image != "" && b.image != b.stageBase {
+		if err := b.squashStage(); err != nil {
+			return "", err
+		}
+	}
 	if b.image != "" {
 		fmt.Fprintf(b.outStream, "Successfully built %s\n", utils.TruncateID(b.image))
 		return b.image, nil
@@ -804,6 +1534,22 @@ func (b *buildFile) Build(context io.Reader) (string, error) {
 	return "", fmt.Errorf("No image was generated. This may be because the Dockerfile does not, like, do anything.\n")
 }
 
+// squashStage replaces the image built by the last stage by an image with
+// a single layer on top of its FROM image. The intermediate images are
+// kept, for the cache.
+func (b *buildFile) squashStage() error {
+	config := *b.config
+	config.Cmd = []string{"/bin/sh", "-c", "#(nop) SQUASH " + strings.Join(b.stageSteps, " ; ")}
+	comment := fmt.Sprintf("Squashed %d steps", len(b.stageSteps))
+	img, err := b.daemon.Graph().Squash(b.image, b.stageBase, comment, &config)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(b.outStream, " ---> Squashed into %s\n", utils.TruncateID(img.ID))
+	b.image = img.ID
+	return nil
+}
+
 // BuildStep parses a single build step from `instruction` and executes it in the current context.
 func (b *buildFile) BuildStep(name, expression string) error {
 	fmt.Fprintf(b.outStream, "Step %s : %s\n", name, expression)
@@ -843,7 +1589,7 @@ func stripComments(raw []byte) string {
 	return strings.Join(out, "\n")
 }
 
-func copyAsDirectory(source, destination string, destinationExists bool) error {
+func copyAsDirectory(source, destination string, destinationExists bool, uid, gid int) error {
 	if err := archive.CopyWithTar(source, destination); err != nil {
 		return err
 	}
@@ -855,14 +1601,14 @@ func copyAsDirectory(source, destination string, destinationExists bool) error {
 		}
 
 		for _, file := range files {
-			if err := fixPermissions(filepath.Join(destination, file.Name()), 0, 0); err != nil {
+			if err := fixPermissions(filepath.Join(destination, file.Name()), uid, gid); err != nil {
 				return err
 			}
 		}
 		return nil
 	}
 
-	return fixPermissions(destination, 0, 0)
+	return fixPermissions(destination, uid, gid)
 }
 
 func fixPermissions(destination string, uid, gid int) error {
@@ -883,6 +1629,7 @@ func NewBuildFile(srv *Server, outStream, errStream io.Writer, verbose, utilizeC
 		errStream:     errStream,
 		tmpContainers: make(map[string]struct{}),
 		tmpImages:     make(map[string]struct{}),
+		stages:        make(map[string]string),
 		verbose:       verbose,
 		utilizeCache:  utilizeCache,
 		rm:            rm,
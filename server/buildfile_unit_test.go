@@ -0,0 +1,289 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/image"
+	"github.com/dotcloud/docker/runconfig"
+	"github.com/dotcloud/docker/utils"
+)
+
+func TestParseFrom(t *testing.T) {
+	for args, expected := range map[string][2]string{
+		"ubuntu":                 {"ubuntu", ""},
+		"ubuntu:12.04 AS Build":  {"ubuntu:12.04", "build"},
+		"  busybox   as   tools": {"busybox", "tools"},
+	} {
+		name, stageName, err := parseFrom(args)
+		if err != nil {
+			t.Fatalf("%q: %s", args, err)
+		}
+		if name != expected[0] || stageName != expected[1] {
+			t.Fatalf("%q: expected %v, got [%s %s]", args, expected, name, stageName)
+		}
+	}
+
+	for _, args := range []string{"", "ubuntu build", "ubuntu AS", "ubuntu AS 1", "ubuntu FOR build"} {
+		if _, _, err := parseFrom(args); err == nil {
+			t.Fatalf("%q: expected an error", args)
+		}
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	flags, args, err := parseFlags("--from=build  /src /dest", "from")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags["from"] != "build" || args != "/src /dest" {
+		t.Fatalf("Unexpected flags %v and args %q", flags, args)
+	}
+
+	flags, args, err = parseFlags("/src /dest", "from")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flags) != 0 || args != "/src /dest" {
+		t.Fatalf("Unexpected flags %v and args %q", flags, args)
+	}
+
+	if _, _, err := parseFlags("--from /src /dest", "from"); err == nil {
+		t.Fatal("Expected an error for a flag without value")
+	}
+	if _, _, err := parseFlags("--chown=1:1 /src /dest", "from"); err == nil {
+		t.Fatal("Expected an error for an unknown flag")
+	}
+}
+
+func TestBuildCmdFromJson(t *testing.T) {
+	b := &buildFile{config: &runconfig.Config{}}
+	for args, expected := range map[string]string{
+		`["echo", "foo"]`: "[echo foo]",
+		"echo foo":        "[/bin/sh -c echo foo]",
+	} {
+		if cmd := fmt.Sprint(b.buildCmdFromJson(args)); cmd != expected {
+			t.Fatalf("%q: expected %s, got %s", args, expected, cmd)
+		}
+	}
+
+	b.config.Shell = []string{"/bin/bash", "-o", "pipefail", "-c"}
+	if cmd := fmt.Sprint(b.buildCmdFromJson("echo foo | cat")); cmd != "[/bin/bash -o pipefail -c echo foo | cat]" {
+		t.Fatalf("Expected the SHELL prefix, got %s", cmd)
+	}
+	if len(b.config.Shell) != 4 {
+		t.Fatalf("The shell of the config was modified: %v", b.config.Shell)
+	}
+}
+
+func contextHashes(t *testing.T, dir string, paths ...string) []string {
+	context, err := archive.Tar(dir, archive.Uncompressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer context.Close()
+	b := &buildFile{
+		contextPath: dir,
+		context:     &utils.TarSum{Reader: context, DisableCompression: true, ContentOnly: true},
+	}
+	if _, err := io.Copy(ioutil.Discard, b.context); err != nil {
+		t.Fatal(err)
+	}
+
+	var hashes []string
+	for _, p := range paths {
+		hash, err := b.contextHash(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+func TestContextHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-test-context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"foo", "foobar"} {
+		if err := os.Mkdir(path.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(dir, name, "file"), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths := []string{"foo", "./foo/", "/foo/file", "foobar"}
+	before := contextHashes(t, dir, paths...)
+	if before[0] != before[1] {
+		t.Fatalf("Expected the same hash for foo and ./foo/, got %s and %s", before[0], before[1])
+	}
+	if before[0] == before[3] {
+		t.Fatal("Expected different hashes for foo and foobar")
+	}
+
+	// Times don't change the hashes, contents do
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path.Join(dir, "foo", "file"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	after := contextHashes(t, dir, paths...)
+	for i := range paths {
+		if before[i] != after[i] {
+			t.Fatalf("Expected the same hash for %s after touching it, got %s and %s", paths[i], before[i], after[i])
+		}
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "foo", "file"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	after = contextHashes(t, dir, paths...)
+	if before[0] == after[0] || before[2] == after[2] {
+		t.Fatal("Expected different hashes after changing foo/file")
+	}
+	if before[3] != after[3] {
+		t.Fatal("Expected the same hash for foobar after changing foo/file")
+	}
+}
+
+func TestParseChown(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "docker-test-rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+	if err := os.Mkdir(path.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(rootfs, "etc", "passwd"), []byte("root:x:0:0::/root:/bin/sh\napp:x:1000:1000::/app:/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(rootfs, "etc", "group"), []byte("root:x:0:\nstaff:x:50:app\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for spec, expected := range map[string][2]int{
+		"app":        {1000, 1000},
+		"app:staff":  {1000, 50},
+		"42:43":      {42, 43},
+		"root:1":     {0, 1},
+		"1001:staff": {1001, 50},
+	} {
+		uid, gid, err := parseChown(spec, rootfs)
+		if err != nil {
+			t.Fatalf("%q: %s", spec, err)
+		}
+		if uid != expected[0] || gid != expected[1] {
+			t.Fatalf("%q: expected %v, got [%d %d]", spec, expected, uid, gid)
+		}
+	}
+
+	for _, spec := range []string{"nobody", "app:nogroup", "-1"} {
+		if _, _, err := parseChown(spec, rootfs); err == nil {
+			t.Fatalf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestProxySSHAgent(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-build-ssh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// A fake agent answering each request in upper case
+	agent := path.Join(tmp, "agent.sock")
+	l, err := net.Listen("unix", agent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			data, _ := ioutil.ReadAll(conn)
+			conn.Write([]byte(strings.ToUpper(string(data))))
+			conn.Close()
+		}
+	}()
+
+	// The container side, as forwarded by forwardSSHAgent
+	proxy := path.Join(tmp, "proxy.sock")
+	pl, err := net.Listen("unix", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+	go func() {
+		conn, err := pl.Accept()
+		if err != nil {
+			return
+		}
+		proxySSHAgent(conn, agent)
+	}()
+
+	conn, err := net.Dial("unix", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.UnixConn).CloseWrite()
+	answer, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(answer) != "REQUEST" {
+		t.Fatalf("Expected the answer of the agent, got %q", answer)
+	}
+}
+
+func TestProbeCacheFrom(t *testing.T) {
+	var (
+		config = &runconfig.Config{Cmd: []string{"/bin/sh", "-c", "echo foo"}}
+		b      = &buildFile{
+			utilizeCache: true,
+			cacheFrom:    []string{"app"},
+			cacheFromImages: []*image.Image{
+				{ID: "top", Parent: "step", ContainerConfig: *config},
+				{ID: "step", Parent: "base", ContainerConfig: *config},
+				{ID: "base"},
+			},
+			image:     "base",
+			config:    config,
+			outStream: ioutil.Discard,
+		}
+	)
+
+	// Only the history of the --cache-from images is looked up, not the
+	// local images of the server
+	if cached, err := b.probeCache(); err != nil || !cached {
+		t.Fatalf("Expected a cache hit, got %v, %v", cached, err)
+	}
+	if b.image != "step" {
+		t.Fatalf("Expected the image step, got %s", b.image)
+	}
+
+	b.config = &runconfig.Config{Cmd: []string{"/bin/sh", "-c", "echo bar"}}
+	if cached, err := b.probeCache(); err != nil || cached {
+		t.Fatalf("Expected a cache miss, got %v, %v", cached, err)
+	}
+}
@@ -22,6 +22,7 @@
 package server
 
 import (
+	"crypto/ecdsa"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -75,6 +76,9 @@ func InitServer(job *engine.Job) engine.Status {
 	if err != nil {
 		return job.Error(err)
 	}
+	if err := registry.SetInsecureRegistries(srv.daemon.Config().InsecureRegistries); err != nil {
+		return job.Error(err)
+	}
 	if srv.daemon.Config().Pidfile != "" {
 		job.Logf("Creating pidfile")
 		if err := utils.CreatePidFile(srv.daemon.Config().Pidfile); err != nil {
@@ -437,6 +441,13 @@ func (srv *Server) Build(job *engine.Job) engine.Status {
 		noCache        = job.GetenvBool("nocache")
 		rm             = job.GetenvBool("rm")
 		forceRm        = job.GetenvBool("forcerm")
+		target         = job.Getenv("target")
+		cacheFrom      = job.GetenvList("cachefrom")
+		secrets        = make(map[string][]byte)
+		sshAgents      = make(map[string]string)
+		squash         = job.GetenvBool("squash")
+		jsonSteps      = job.GetenvBool("buildsteps")
+		dockerfileName = job.Getenv("dockerfile")
 		authConfig     = &registry.AuthConfig{}
 		configFile     = &registry.ConfigFile{}
 		tag            string
@@ -444,6 +455,8 @@ func (srv *Server) Build(job *engine.Job) engine.Status {
 	)
 	job.GetenvJson("authConfig", authConfig)
 	job.GetenvJson("configFile", configFile)
+	job.GetenvJson("secrets", &secrets)
+	job.GetenvJson("ssh", &sshAgents)
 	repoName, tag = utils.ParseRepositoryTag(repoName)
 
 	if remoteURL == "" {
@@ -458,11 +471,12 @@ func (srv *Server) Build(job *engine.Job) engine.Status {
 		}
 		defer os.RemoveAll(root)
 
-		if output, err := exec.Command("git", "clone", "--recursive", remoteURL, root).CombinedOutput(); err != nil {
-			return job.Errorf("Error trying to use git: %s (%s)", err, output)
+		contextDir, err := utils.GitClone(remoteURL, root)
+		if err != nil {
+			return job.Error(err)
 		}
 
-		c, err := archive.Tar(root, archive.Uncompressed)
+		c, err := archive.Tar(contextDir, archive.Uncompressed)
 		if err != nil {
 			return job.Error(err)
 		}
@@ -482,6 +496,8 @@ func (srv *Server) Build(job *engine.Job) engine.Status {
 			return job.Error(err)
 		}
 		context = c
+		// The downloaded file is the Dockerfile
+		dockerfileName = ""
 	}
 	defer context.Close()
 
@@ -495,7 +511,14 @@ func (srv *Server) Build(job *engine.Job) engine.Status {
 			Writer:          job.Stdout,
 			StreamFormatter: sf,
 		},
-		!suppressOutput, !noCache, rm, forceRm, job.Stdout, sf, authConfig, configFile)
+		!suppressOutput, !noCache, rm, forceRm, job.Stdout, sf, authConfig, configFile).(*buildFile)
+	b.target = strings.ToLower(target)
+	b.cacheFrom = cacheFrom
+	b.secrets = secrets
+	b.sshAgents = sshAgents
+	b.squash = squash
+	b.jsonSteps = jsonSteps && sf.Json()
+	b.dockerfileName = dockerfileName
 	id, err := b.Build(context)
 	if err != nil {
 		return job.Error(err)
@@ -712,6 +735,7 @@ func (srv *Server) Images(job *engine.Job) engine.Status {
 		return job.Error(err)
 	}
 	lookup := make(map[string]*engine.Env)
+	digests := srv.daemon.Repositories().DigestsByID()
 	for name, repository := range srv.daemon.Repositories().Repositories {
 		if job.Getenv("filter") != "" {
 			if match, _ := path.Match(job.Getenv("filter"), name); !match {
@@ -732,6 +756,7 @@ func (srv *Server) Images(job *engine.Job) engine.Status {
 				delete(allImages, id)
 				out.Set("ParentId", image.Parent)
 				out.SetList("RepoTags", []string{fmt.Sprintf("%s:%s", name, tag)})
+				out.SetList("RepoDigests", digests[id])
 				out.Set("Id", image.ID)
 				out.SetInt64("Created", image.Created.Unix())
 				out.SetInt64("Size", image.Size)
@@ -753,6 +778,7 @@ func (srv *Server) Images(job *engine.Job) engine.Status {
 			out := &engine.Env{}
 			out.Set("ParentId", image.Parent)
 			out.SetList("RepoTags", []string{"<none>:<none>"})
+			out.SetList("RepoDigests", digests[image.ID])
 			out.Set("Id", image.ID)
 			out.SetInt64("Created", image.Created.Unix())
 			out.SetInt64("Size", image.Size)
@@ -1098,59 +1124,166 @@ func (srv *Server) pullImage(r *registry.Registry, out io.Writer, imgID, endpoin
 		id := history[i]
 
 		// ensure no two downloads of the same layer happen at the same time
-		if c, err := srv.poolAdd("pull", "layer:"+id); err != nil {
-			utils.Errorf("Image (id: %s) pull is already running, skipping: %v", id, err)
-			<-c
+		err := srv.pullLayerOnce(out, id, sf, func() error {
+			if srv.daemon.Graph().Exists(id) {
+				return nil
+			}
+			return srv.pullLayer(r, out, id, endpoint, token, sf)
+		})
+		if err != nil {
+			return err
 		}
-		defer srv.poolRemove("pull", "layer:"+id)
+		out.Write(sf.FormatProgress(utils.TruncateID(id), "Download complete", nil))
+	}
+	return nil
+}
 
-		if !srv.daemon.Graph().Exists(id) {
-			out.Write(sf.FormatProgress(utils.TruncateID(id), "Pulling metadata", nil))
-			var (
-				imgJSON []byte
-				imgSize int
-				err     error
-				img     *image.Image
-			)
-			retries := 5
-			for j := 1; j <= retries; j++ {
-				imgJSON, imgSize, err = r.GetRemoteImageJSON(id, endpoint, token)
-				if err != nil && j == retries {
-					out.Write(sf.FormatProgress(utils.TruncateID(id), "Error pulling dependent layers", nil))
-					return err
-				} else if err != nil {
-					time.Sleep(time.Duration(j) * 500 * time.Millisecond)
-					continue
+// pullLayer downloads the image id and its layer, verifies the layer and
+// registers the image.
+func (srv *Server) pullLayer(r *registry.Registry, out io.Writer, id, endpoint string, token []string, sf *utils.StreamFormatter) error {
+	out.Write(sf.FormatProgress(utils.TruncateID(id), "Pulling metadata", nil))
+	var (
+		imgJSON  []byte
+		imgSize  int
+		checksum string
+		err      error
+		img      *image.Image
+	)
+	retries := 5
+	for j := 1; j <= retries; j++ {
+		imgJSON, imgSize, checksum, err = r.GetRemoteImageJSON(id, endpoint, token)
+		if err != nil && j == retries {
+			out.Write(sf.FormatProgress(utils.TruncateID(id), "Error pulling dependent layers", nil))
+			return err
+		} else if err != nil {
+			time.Sleep(time.Duration(j) * 500 * time.Millisecond)
+			continue
+		}
+		img, err = image.NewImgJSON(imgJSON)
+		if err != nil && j == retries {
+			out.Write(sf.FormatProgress(utils.TruncateID(id), "Error pulling dependent layers", nil))
+			return fmt.Errorf("Failed to parse json: %s", err)
+		} else if err != nil {
+			time.Sleep(time.Duration(j) * 500 * time.Millisecond)
+			continue
+		} else {
+			break
+		}
+	}
+
+	// Get the layer
+	out.Write(sf.FormatProgress(utils.TruncateID(id), "Pulling fs layer", nil))
+	tmp, err := srv.daemon.Graph().Mktemp("")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	srv.downloadSlots.acquire(out, id, sf)
+	layer, err := srv.downloadLayer(r, out, path.Join(tmp, "layer"), img.ID, endpoint, token, imgSize, sf)
+	srv.downloadSlots.release()
+	if err != nil {
+		out.Write(sf.FormatProgress(utils.TruncateID(id), "Error pulling dependent layers", nil))
+		return err
+	}
+	defer layer.Close()
+
+	if checksum != "" {
+		out.Write(sf.FormatProgress(utils.TruncateID(id), "Verifying checksum", nil))
+		if err := registry.VerifyLayerChecksum(layer, imgJSON, checksum); err != nil {
+			out.Write(sf.FormatProgress(utils.TruncateID(id), "Error verifying the layer", nil))
+			return fmt.Errorf("Error verifying the layer of %s: %s", id, err)
+		}
+		if _, err := layer.Seek(0, 0); err != nil {
+			return err
+		}
+	} else {
+		utils.Debugf("No checksum given for the layer of %s, not verifying it", id)
+	}
+
+	if err := srv.daemon.Graph().Register(imgJSON, utils.ProgressReader(layer, imgSize, out, sf, false, utils.TruncateID(id), "Extracting"), img); err != nil {
+		out.Write(sf.FormatProgress(utils.TruncateID(id), "Error downloading dependent layers", nil))
+		return err
+	}
+	return nil
+}
+
+// The number of times the download of a layer is resumed before giving up
+const layerDownloadRetries = 5
+
+// downloadLayer downloads the layer of the image imgID to the file
+// filename. When the download is interrupted, it is resumed where it
+// stopped, up to layerDownloadRetries times and waiting longer each time.
+// The client errors returned by the registry, e.g. a missing layer, are not
+// retried.
+func (srv *Server) downloadLayer(r *registry.Registry, out io.Writer, filename, imgID, endpoint string, token []string, size int, sf *utils.StreamFormatter) (*os.File, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var offset int64
+	for retry := 1; ; retry++ {
+		layer, start, err := r.GetRemoteImageLayer(imgID, endpoint, token, offset)
+		if err == nil {
+			if start != offset {
+				// The registry sends the whole layer again
+				if err := f.Truncate(0); err != nil {
+					f.Close()
+					return nil, err
 				}
-				img, err = image.NewImgJSON(imgJSON)
-				if err != nil && j == retries {
-					out.Write(sf.FormatProgress(utils.TruncateID(id), "Error pulling dependent layers", nil))
-					return fmt.Errorf("Failed to parse json: %s", err)
-				} else if err != nil {
-					time.Sleep(time.Duration(j) * 500 * time.Millisecond)
-					continue
-				} else {
-					break
+				if _, err := f.Seek(0, 0); err != nil {
+					f.Close()
+					return nil, err
 				}
+				offset = 0
 			}
-
-			// Get the layer
-			out.Write(sf.FormatProgress(utils.TruncateID(id), "Pulling fs layer", nil))
-			layer, err := r.GetRemoteImageLayer(img.ID, endpoint, token)
-			if err != nil {
-				out.Write(sf.FormatProgress(utils.TruncateID(id), "Error pulling dependent layers", nil))
-				return err
+			action, remaining := "Downloading", size
+			if offset > 0 {
+				action = "Resuming download"
+				if size > 0 {
+					remaining = size - int(offset)
+				}
 			}
-			defer layer.Close()
-			if err := srv.daemon.Graph().Register(imgJSON, utils.ProgressReader(layer, imgSize, out, sf, false, utils.TruncateID(id), "Downloading"), img); err != nil {
-				out.Write(sf.FormatProgress(utils.TruncateID(id), "Error downloading dependent layers", nil))
-				return err
+			var n int64
+			n, err = io.Copy(f, utils.ProgressReader(layer, remaining, out, sf, false, utils.TruncateID(imgID), action))
+			layer.Close()
+			offset += n
+			if err == nil && size > 0 && offset != int64(size) {
+				err = io.ErrUnexpectedEOF
 			}
+			if err == nil {
+				break
+			}
+		} else if isClientError(err) {
+			f.Close()
+			return nil, err
 		}
-		out.Write(sf.FormatProgress(utils.TruncateID(id), "Download complete", nil))
+		if retry > layerDownloadRetries {
+			f.Close()
+			return nil, fmt.Errorf("Error downloading the layer of %s after %d retries: %s", imgID, layerDownloadRetries, err)
+		}
+		delay := time.Duration(1<<uint(retry-1)) * time.Second
+		utils.Errorf("Error downloading the layer of %s at byte %d: %s", imgID, offset, err)
+		out.Write(sf.FormatProgress(utils.TruncateID(imgID), fmt.Sprintf("Download interrupted, retrying in %s (%d/%d)", delay, retry, layerDownloadRetries), nil))
+		time.Sleep(delay)
+	}
 
+	if _, err := f.Seek(0, 0); err != nil {
+		f.Close()
+		return nil, err
 	}
-	return nil
+	return f, nil
+}
+
+// isClientError returns whether err is an HTTP error caused by the request,
+// which fails the same way when retried. Timeouts and rate limiting are not
+// counted as such.
+func isClientError(err error) bool {
+	jerr, ok := err.(*utils.JSONError)
+	if !ok {
+		return false
+	}
+	return jerr.Code >= 400 && jerr.Code < 500 && jerr.Code != http.StatusRequestTimeout && jerr.Code != 429
 }
 
 func (srv *Server) pullRepository(r *registry.Registry, out io.Writer, localName, remoteName, askedTag string, sf *utils.StreamFormatter, parallel bool) error {
@@ -1210,22 +1343,8 @@ func (srv *Server) pullRepository(r *registry.Registry, out io.Writer, localName
 				return
 			}
 
-			// ensure no two downloads of the same image happen at the same time
-			if c, err := srv.poolAdd("pull", "img:"+img.ID); err != nil {
-				if c != nil {
-					out.Write(sf.FormatProgress(utils.TruncateID(img.ID), "Layer already being pulled by another client. Waiting.", nil))
-					<-c
-					out.Write(sf.FormatProgress(utils.TruncateID(img.ID), "Download complete", nil))
-				} else {
-					utils.Errorf("Image (id: %s) pull is already running, skipping: %v", img.ID, err)
-				}
-				if parallel {
-					errors <- nil
-				}
-				return
-			}
-			defer srv.poolRemove("pull", "img:"+img.ID)
-
+			// The layers pulled by another client at the same time are
+			// waited for by pullImage
 			out.Write(sf.FormatProgress(utils.TruncateID(img.ID), fmt.Sprintf("Pulling image (%s) from %s", img.Tag, localName), nil))
 			success := false
 			var lastErr error
@@ -1288,6 +1407,407 @@ func (srv *Server) pullRepository(r *registry.Registry, out io.Writer, localName
 	return nil
 }
 
+// v2Endpoint returns the v2 endpoint of the registry of endpoint, if it
+// supports the v2 protocol. The index only speaks v1.
+func v2Endpoint(r *registry.Registry, endpoint string) (string, bool) {
+	if endpoint == registry.IndexServerAddress() {
+		return "", false
+	}
+	v2Endpoint, err := registry.V2Endpoint(endpoint)
+	if err != nil {
+		return "", false
+	}
+	if err := r.PingV2(v2Endpoint); err != nil {
+		utils.Debugf("Using the v1 protocol with %s: %s", endpoint, err)
+		return "", false
+	}
+	return v2Endpoint, true
+}
+
+// pullV2Repository pulls the tag or digest askedTag, or all the tags, of
+// the repository remoteName with the registry v2 protocol. The digests the
+// tags resolve to are recorded.
+func (srv *Server) pullV2Repository(r *registry.Registry, out io.Writer, localName, remoteName, askedTag, endpoint string, sf *utils.StreamFormatter) error {
+	out.Write(sf.FormatStatus("", "Pulling repository %s", localName))
+
+	tags := []string{askedTag}
+	if askedTag == "" {
+		var err error
+		if tags, err = r.GetV2Tags(endpoint, remoteName); err != nil {
+			return err
+		}
+	}
+	for _, tag := range tags {
+		manifest, digest, err := r.GetV2Manifest(endpoint, remoteName, tag)
+		if err != nil {
+			return err
+		}
+		if srv.daemon.Config().Trust {
+			keyID, err := srv.verifyManifest(manifest, remoteName, tag)
+			if err != nil {
+				return fmt.Errorf("Refusing to pull %s:%s, its signature can't be verified: %s", localName, tag, err)
+			}
+			out.Write(sf.FormatStatus("", "%s:%s: signed by the trusted key %s", localName, tag, keyID))
+		}
+		id, err := srv.pullV2Image(r, out, remoteName, endpoint, manifest, sf)
+		if err != nil {
+			return err
+		}
+		if srv.daemon.Config().Trust {
+			// Keep the signed manifest for the runs of the image
+			if err := ioutil.WriteFile(path.Join(srv.daemon.Graph().Root, id, signedManifestFile), manifest.Raw, 0600); err != nil {
+				return err
+			}
+		}
+		if !utils.IsDigest(tag) {
+			if err := srv.daemon.Repositories().Set(localName, tag, id, true); err != nil {
+				return err
+			}
+		}
+		if err := srv.daemon.Repositories().SetDigest(localName, digest, id); err != nil {
+			return err
+		}
+		out.Write(sf.FormatStatus("", "%s:%s: digest: %s", localName, tag, digest))
+	}
+	return srv.daemon.Repositories().Save()
+}
+
+// The file of an image directory keeping the signed manifest the image was
+// pulled with, in trust mode.
+const signedManifestFile = "signed_manifest"
+
+// verifyManifest checks that manifest is the one of the tag of the
+// repository remoteName, and that it is signed by a trusted key, whose id
+// is returned.
+func (srv *Server) verifyManifest(manifest *registry.Manifest, remoteName, tag string) (string, error) {
+	if manifest.Name != remoteName || (!utils.IsDigest(tag) && manifest.Tag != tag) {
+		return "", fmt.Errorf("The manifest is the one of %s:%s", manifest.Name, manifest.Tag)
+	}
+	keys, err := registry.LoadTrustedKeys(srv.daemon.Config().TrustDir)
+	if err != nil {
+		return "", err
+	}
+	return registry.VerifyManifest(manifest.Raw, keys)
+}
+
+// verifyImage checks that the image name was pulled with a manifest signed
+// by a trusted key.
+func (srv *Server) verifyImage(name string) error {
+	img, err := srv.daemon.Repositories().LookupImage(name)
+	if err != nil || img == nil {
+		// The missing images are reported by daemon.Create
+		return nil
+	}
+	raw, err := ioutil.ReadFile(path.Join(srv.daemon.Graph().Root, img.ID, signedManifestFile))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("Refusing to run %s: the image was not pulled with a signed manifest", name)
+	} else if err != nil {
+		return err
+	}
+	keys, err := registry.LoadTrustedKeys(srv.daemon.Config().TrustDir)
+	if err != nil {
+		return err
+	}
+	if _, err := registry.VerifyManifest(raw, keys); err != nil {
+		return fmt.Errorf("Refusing to run %s, its signature can't be verified: %s", name, err)
+	}
+
+	// The topmost image of the manifest is the one which is run
+	payload, err := registry.ManifestPayload(raw)
+	if err != nil {
+		return err
+	}
+	manifest := &registry.Manifest{}
+	if err := json.Unmarshal(payload, manifest); err != nil {
+		return err
+	}
+	if len(manifest.History) == 0 {
+		return fmt.Errorf("Refusing to run %s: the signed manifest has no image", name)
+	}
+	top, err := image.NewImgJSON([]byte(manifest.History[0].V1Compatibility))
+	if err != nil {
+		return err
+	}
+	if top.ID != img.ID {
+		return fmt.Errorf("Refusing to run %s: the signed manifest is the one of the image %s", name, utils.TruncateID(top.ID))
+	}
+	return nil
+}
+
+// pullV2Image downloads the layers of manifest which are not in the graph
+// yet, from the base layer up, and returns the id of the topmost image.
+func (srv *Server) pullV2Image(r *registry.Registry, out io.Writer, remoteName, endpoint string, manifest *registry.Manifest, sf *utils.StreamFormatter) (string, error) {
+	var id string
+	for i := len(manifest.History) - 1; i >= 0; i-- {
+		imgJSON := []byte(manifest.History[i].V1Compatibility)
+		img, err := image.NewImgJSON(imgJSON)
+		if err != nil {
+			return "", fmt.Errorf("Failed to parse json: %s", err)
+		}
+		if img.Parent != id {
+			return "", fmt.Errorf("Invalid manifest: image %s is not the parent of %s", utils.TruncateID(id), utils.TruncateID(img.ID))
+		}
+		id = img.ID
+
+		// ensure no two downloads of the same layer happen at the same time
+		blobSum := manifest.FSLayers[i].BlobSum
+		exists := false
+		err = srv.pullLayerOnce(out, id, sf, func() error {
+			if exists = srv.daemon.Graph().Exists(id); exists {
+				return nil
+			}
+			if err := srv.pullV2Layer(r, out, remoteName, endpoint, blobSum, imgJSON, img, sf); err != nil {
+				out.Write(sf.FormatProgress(utils.TruncateID(id), "Error downloading dependent layers", nil))
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			out.Write(sf.FormatProgress(utils.TruncateID(id), "Already exists", nil))
+			continue
+		}
+		out.Write(sf.FormatProgress(utils.TruncateID(id), "Download complete", nil))
+	}
+	return id, nil
+}
+
+// pullV2Layer registers img with the layer blobSum. The image is removed
+// if the layer doesn't match its digest.
+func (srv *Server) pullV2Layer(r *registry.Registry, out io.Writer, remoteName, endpoint, blobSum string, imgJSON []byte, img *image.Image, sf *utils.StreamFormatter) error {
+	out.Write(sf.FormatProgress(utils.TruncateID(img.ID), "Pulling fs layer", nil))
+	srv.downloadSlots.acquire(out, img.ID, sf)
+	defer srv.downloadSlots.release()
+	layer, size, err := r.GetV2Blob(endpoint, remoteName, blobSum)
+	if err != nil {
+		return err
+	}
+	defer layer.Close()
+
+	// The digest of the layer is only checked once it was read entirely,
+	// so it is downloaded before being registered
+	tmp, err := srv.daemon.Graph().Mktemp("")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	f, err := os.Create(path.Join(tmp, "layer"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, utils.ProgressReader(layer, int(size), out, sf, false, utils.TruncateID(img.ID), "Downloading")); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	return srv.daemon.Graph().Register(imgJSON, utils.ProgressReader(f, int(size), out, sf, false, utils.TruncateID(img.ID), "Extracting"), img)
+}
+
+// pushV2Repository pushes the tag askedTag, or all the tags, of localRepo
+// with the registry v2 protocol. Layers which the registry already has
+// aren't sent again.
+func (srv *Server) pushV2Repository(r *registry.Registry, out io.Writer, localName, remoteName string, localRepo map[string]string, askedTag, endpoint string, sf *utils.StreamFormatter) error {
+	out = utils.NewWriteFlusher(out)
+	if _, exists := localRepo[askedTag]; askedTag != "" && !exists {
+		return fmt.Errorf("Tag %s not found in repository %s", askedTag, localName)
+	}
+
+	// Digests of the layers already pushed, by image
+	digests := make(map[string]string)
+	for tag, id := range localRepo {
+		if askedTag != "" && tag != askedTag {
+			continue
+		}
+		out.Write(sf.FormatStatus("", "Pushing tag %s of repository %s", tag, localName))
+
+		img, err := srv.daemon.Graph().Get(id)
+		if err != nil {
+			return err
+		}
+		manifest := &registry.Manifest{
+			SchemaVersion: 1,
+			Name:          remoteName,
+			Tag:           tag,
+			Architecture:  img.Architecture,
+		}
+		var images []*image.Image
+		for ; img != nil; img, err = img.GetParent() {
+			if err != nil {
+				return err
+			}
+			images = append(images, img)
+		}
+		if err := srv.pushV2Layers(r, out, remoteName, endpoint, images, digests, sf); err != nil {
+			return err
+		}
+		for _, img := range images {
+			jsonRaw, err := ioutil.ReadFile(path.Join(srv.daemon.Graph().Root, img.ID, "json"))
+			if err != nil {
+				return fmt.Errorf("Cannot retrieve the path for {%s}: %s", img.ID, err)
+			}
+			manifest.FSLayers = append(manifest.FSLayers, &registry.FSLayer{BlobSum: digests[img.ID]})
+			manifest.History = append(manifest.History, &registry.ManifestHistory{V1Compatibility: string(jsonRaw)})
+		}
+
+		digest, err := r.PutV2Manifest(endpoint, remoteName, tag, manifest, srv.trustKey)
+		if err != nil {
+			return err
+		}
+		if srv.trustKey != nil {
+			out.Write(sf.FormatStatus("", "%s: signed with the key %s", tag, registry.KeyID(&srv.trustKey.PublicKey)))
+		}
+		if err := srv.daemon.Repositories().SetDigest(localName, digest, id); err != nil {
+			return err
+		}
+		out.Write(sf.FormatStatus("", "%s: digest: %s", tag, digest))
+	}
+	return nil
+}
+
+// pushV2Layers uploads in parallel the layers of the images which aren't
+// in digests yet, and adds their digests to it.
+func (srv *Server) pushV2Layers(r *registry.Registry, out io.Writer, remoteName, endpoint string, images []*image.Image, digests map[string]string, sf *utils.StreamFormatter) error {
+	type pushed struct {
+		id, digest string
+		err        error
+	}
+	var (
+		results = make(chan pushed, len(images))
+		pending int
+	)
+	for _, img := range images {
+		if _, exists := digests[img.ID]; exists {
+			continue
+		}
+		pending++
+		go func(id string) {
+			digest, err := srv.pushV2Layer(r, out, remoteName, id, endpoint, sf)
+			results <- pushed{id, digest, err}
+		}(img.ID)
+	}
+
+	var lastErr error
+	for ; pending > 0; pending-- {
+		res := <-results
+		if res.err != nil {
+			lastErr = res.err
+			continue
+		}
+		digests[res.id] = res.digest
+	}
+	return lastErr
+}
+
+// pushV2Layer uploads the layer of the image imgID, unless the registry
+// already has it, and returns its digest.
+func (srv *Server) pushV2Layer(r *registry.Registry, out io.Writer, remoteName, imgID, endpoint string, sf *utils.StreamFormatter) (string, error) {
+	srv.uploadSlots.acquire(out, imgID, sf)
+	defer srv.uploadSlots.release()
+
+	layerData, err := srv.daemon.Graph().TempLayerArchive(imgID, archive.Uncompressed, sf, out)
+	if err != nil {
+		return "", fmt.Errorf("Failed to generate layer archive: %s", err)
+	}
+	defer os.RemoveAll(layerData.Name())
+	defer layerData.Close()
+
+	// Read the file itself, the temp archive removes it once read
+	digest, err := registry.DigestReader(layerData.File)
+	if err != nil {
+		return "", err
+	}
+	exists, err := r.V2BlobExists(endpoint, remoteName, digest)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		out.Write(sf.FormatProgress(utils.TruncateID(imgID), "Image already pushed, skipping", nil))
+		return digest, nil
+	}
+
+	out.Write(sf.FormatProgress(utils.TruncateID(imgID), "Pushing", nil))
+	if err := r.PutV2Blob(endpoint, remoteName, digest, layerData.File, layerData.Size); err != nil {
+		return "", err
+	}
+	out.Write(sf.FormatProgress(utils.TruncateID(imgID), "Image successfully pushed", nil))
+	return digest, nil
+}
+
+// transferSlots limits the number of layers downloaded or uploaded at the
+// same time by the daemon. A nil transferSlots doesn't limit them.
+type transferSlots chan struct{}
+
+func newTransferSlots(n int) transferSlots {
+	if n < 1 {
+		n = 1
+	}
+	return make(transferSlots, n)
+}
+
+// acquire waits for a free slot to transfer the layer of the image id.
+func (s transferSlots) acquire(out io.Writer, id string, sf *utils.StreamFormatter) {
+	if s == nil {
+		return
+	}
+	select {
+	case s <- struct{}{}:
+	default:
+		out.Write(sf.FormatProgress(utils.TruncateID(id), "Waiting", nil))
+		s <- struct{}{}
+	}
+}
+
+func (s transferSlots) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// layerPull is the pull of a layer, whose success is shared by the clients
+// pulling the same layer at the same time.
+type layerPull struct {
+	done    chan struct{}
+	err     error
+	waiters int
+}
+
+// pullLayerOnce runs pull for the layer of the image id, unless another
+// client is already pulling it: it then waits for that pull, and only runs
+// its own if that one failed, as it may have been from another registry or
+// with other credentials.
+func (srv *Server) pullLayerOnce(out io.Writer, id string, sf *utils.StreamFormatter, pull func() error) error {
+	srv.Lock()
+	for {
+		p, exists := srv.pullingLayers[id]
+		if !exists {
+			break
+		}
+		p.waiters++
+		srv.Unlock()
+		out.Write(sf.FormatProgress(utils.TruncateID(id), "Layer already being pulled by another client. Waiting.", nil))
+		<-p.done
+		if p.err == nil {
+			return nil
+		}
+		srv.Lock()
+	}
+	p := &layerPull{done: make(chan struct{})}
+	srv.pullingLayers[id] = p
+	srv.Unlock()
+
+	p.err = pull()
+
+	srv.Lock()
+	delete(srv.pullingLayers, id)
+	srv.Unlock()
+	close(p.done)
+	return p.err
+}
+
 func (srv *Server) poolAdd(kind, key string) (chan struct{}, error) {
 	srv.Lock()
 	defer srv.Unlock()
@@ -1380,15 +1900,54 @@ func (srv *Server) ImagePull(job *engine.Job) engine.Status {
 	if endpoint == registry.IndexServerAddress() {
 		// If pull "index.docker.io/foo/bar", it's stored locally under "foo/bar"
 		localName = remoteName
+
+		// The mirrors only speak the v1 protocol, without signatures
+		if len(srv.daemon.Config().Mirrors) > 0 && !utils.IsDigest(tag) && !srv.daemon.Config().Trust {
+			if err := srv.pullFromMirrors(job.Stdout, localName, remoteName, tag, metaHeaders, sf, job.GetenvBool("parallel")); err == nil {
+				return engine.StatusOK
+			}
+			job.Stdout.Write(sf.FormatStatus("", "Pulling repository %s from %s", localName, endpoint))
+		}
 	}
 
-	if err = srv.pullRepository(r, job.Stdout, localName, remoteName, tag, sf, job.GetenvBool("parallel")); err != nil {
+	if endpoint, ok := v2Endpoint(r, endpoint); ok {
+		err = srv.pullV2Repository(r, job.Stdout, localName, remoteName, tag, endpoint, sf)
+	} else if utils.IsDigest(tag) {
+		err = fmt.Errorf("Can't pull %s@%s, pulling by digest requires a registry supporting the v2 protocol", localName, tag)
+	} else if srv.daemon.Config().Trust {
+		err = fmt.Errorf("Refusing to pull %s, its signature can't be verified: %s", localName, registry.ErrV2NotSupported)
+	} else {
+		err = srv.pullRepository(r, job.Stdout, localName, remoteName, tag, sf, job.GetenvBool("parallel"))
+	}
+	if err != nil {
 		return job.Error(err)
 	}
 
 	return engine.StatusOK
 }
 
+// pullFromMirrors pulls the repository remoteName of the index from the
+// first registry mirror of the daemon which has it. An error is returned if
+// none of the mirrors could be used, the repository should then be pulled
+// from the index itself.
+func (srv *Server) pullFromMirrors(out io.Writer, localName, remoteName, tag string, metaHeaders map[string][]string, sf *utils.StreamFormatter, parallel bool) error {
+	var err error
+	for _, mirror := range srv.daemon.Config().Mirrors {
+		out.Write(sf.FormatStatus("", "Trying the registry mirror %s", mirror))
+
+		// The credentials for the index are never sent to the mirrors
+		var r *registry.Registry
+		if r, err = registry.NewRegistry(&registry.AuthConfig{}, registry.HTTPRequestFactory(metaHeaders), mirror); err == nil {
+			if err = srv.pullRepository(r, out, localName, remoteName, tag, sf, parallel); err == nil {
+				return nil
+			}
+		}
+		utils.Debugf("Error pulling %s from the registry mirror %s: %s", localName, mirror, err)
+		out.Write(sf.FormatStatus("", "Could not pull from the registry mirror %s: %s", mirror, err))
+	}
+	return err
+}
+
 // Retrieve the all the images to be uploaded in the correct order
 func (srv *Server) getImageList(localRepo map[string]string, requestedTag string) ([]string, map[string][]string, error) {
 	var (
@@ -1491,16 +2050,42 @@ func (srv *Server) pushRepository(r *registry.Registry, out io.Writer, localName
 	for _, ep := range repoData.Endpoints {
 		out.Write(sf.FormatStatus("", "Pushing repository %s (%d tags)", localName, nTag))
 
+		// The json of the images is sent in order, the registry needs the
+		// parent of an image first, while their layers are sent in parallel
+		var (
+			errors  = make(chan error, len(imgList))
+			pending int
+			lastErr error
+		)
 		for _, imgId := range imgList {
 			if r.LookupRemoteImage(imgId, ep, repoData.Tokens) {
 				out.Write(sf.FormatStatus("", "Image %s already pushed, skipping", utils.TruncateID(imgId)))
-			} else {
-				if _, err := srv.pushImage(r, out, remoteName, imgId, ep, repoData.Tokens, sf); err != nil {
-					// FIXME: Continue on error?
-					return err
-				}
+				continue
 			}
+			jsonRaw, err := srv.pushImageJSON(r, out, imgId, ep, repoData.Tokens, sf)
+			if err == registry.ErrAlreadyExists {
+				out.Write(sf.FormatProgress(utils.TruncateID(imgId), "Image already pushed, skipping", nil))
+				continue
+			} else if err != nil {
+				lastErr = err
+				break
+			}
+			pending++
+			go func(imgId string, jsonRaw []byte) {
+				_, err := srv.pushImageLayer(r, out, imgId, jsonRaw, ep, repoData.Tokens, sf)
+				errors <- err
+			}(imgId, jsonRaw)
+		}
+		for ; pending > 0; pending-- {
+			if err := <-errors; err != nil {
+				lastErr = err
+			}
+		}
+		if lastErr != nil {
+			return lastErr
+		}
 
+		for _, imgId := range imgList {
 			for _, tag := range tagsByImage[imgId] {
 				out.Write(sf.FormatStatus("", "Pushing tag for rev [%s] on {%s}", utils.TruncateID(imgId), ep+"repositories/"+remoteName+"/tags/"+tag))
 
@@ -1520,23 +2105,40 @@ func (srv *Server) pushRepository(r *registry.Registry, out io.Writer, localName
 
 func (srv *Server) pushImage(r *registry.Registry, out io.Writer, remote, imgID, ep string, token []string, sf *utils.StreamFormatter) (checksum string, err error) {
 	out = utils.NewWriteFlusher(out)
+	jsonRaw, err := srv.pushImageJSON(r, out, imgID, ep, token, sf)
+	if err != nil {
+		if err == registry.ErrAlreadyExists {
+			out.Write(sf.FormatProgress(utils.TruncateID(imgID), "Image already pushed, skipping", nil))
+			return "", nil
+		}
+		return "", err
+	}
+	return srv.pushImageLayer(r, out, imgID, jsonRaw, ep, token, sf)
+}
+
+// pushImageJSON sends the json of the image imgID, and returns it. The
+// error is registry.ErrAlreadyExists if the registry has the image.
+func (srv *Server) pushImageJSON(r *registry.Registry, out io.Writer, imgID, ep string, token []string, sf *utils.StreamFormatter) ([]byte, error) {
 	jsonRaw, err := ioutil.ReadFile(path.Join(srv.daemon.Graph().Root, imgID, "json"))
 	if err != nil {
-		return "", fmt.Errorf("Cannot retrieve the path for {%s}: %s", imgID, err)
+		return nil, fmt.Errorf("Cannot retrieve the path for {%s}: %s", imgID, err)
 	}
 	out.Write(sf.FormatProgress(utils.TruncateID(imgID), "Pushing", nil))
 
-	imgData := &registry.ImgData{
-		ID: imgID,
+	if err := r.PushImageJSONRegistry(&registry.ImgData{ID: imgID}, jsonRaw, ep, token); err != nil {
+		return nil, err
 	}
+	return jsonRaw, nil
+}
 
-	// Send the json
-	if err := r.PushImageJSONRegistry(imgData, jsonRaw, ep, token); err != nil {
-		if err == registry.ErrAlreadyExists {
-			out.Write(sf.FormatProgress(utils.TruncateID(imgData.ID), "Image already pushed, skipping", nil))
-			return "", nil
-		}
-		return "", err
+// pushImageLayer sends the layer of the image imgID, whose json was sent,
+// and its checksum.
+func (srv *Server) pushImageLayer(r *registry.Registry, out io.Writer, imgID string, jsonRaw []byte, ep string, token []string, sf *utils.StreamFormatter) (string, error) {
+	srv.uploadSlots.acquire(out, imgID, sf)
+	defer srv.uploadSlots.release()
+
+	imgData := &registry.ImgData{
+		ID: imgID,
 	}
 
 	layerData, err := srv.daemon.Graph().TempLayerArchive(imgID, archive.Uncompressed, sf, out)
@@ -1608,7 +2210,14 @@ func (srv *Server) ImagePush(job *engine.Job) engine.Status {
 		job.Stdout.Write(sf.FormatStatus("", "The push refers to a repository [%s] (len: %d)", localName, reposLen))
 		// If it fails, try to get the repository
 		if localRepo, exists := srv.daemon.Repositories().Repositories[localName]; exists {
-			if err := srv.pushRepository(r, job.Stdout, localName, remoteName, localRepo, tag, sf); err != nil {
+			if endpoint, ok := v2Endpoint(r, endpoint); ok {
+				err = srv.pushV2Repository(r, job.Stdout, localName, remoteName, localRepo, tag, endpoint, sf)
+			} else if srv.trustKey != nil {
+				err = fmt.Errorf("Can't sign the push of %s: %s", localName, registry.ErrV2NotSupported)
+			} else {
+				err = srv.pushRepository(r, job.Stdout, localName, remoteName, localRepo, tag, sf)
+			}
+			if err != nil {
 				return job.Error(err)
 			}
 			return engine.StatusOK
@@ -1696,6 +2305,11 @@ func (srv *Server) ContainerCreate(job *engine.Job) engine.Status {
 		job.Errorf("Your kernel does not support swap limit capabilities. Limitation discarded.\n")
 		config.MemorySwap = -1
 	}
+	if srv.daemon.Config().Trust {
+		if err := srv.verifyImage(config.Image); err != nil {
+			return job.Error(err)
+		}
+	}
 	container, buildWarnings, err := srv.daemon.Create(config, name)
 	if err != nil {
 		if srv.daemon.Graph().IsNotExist(err) {
@@ -2024,19 +2638,29 @@ func (srv *Server) ImageGetCached(imgID string, config *runconfig.Config) (*imag
 	}
 
 	// Loop on the children of the given image and check the config
-	var match *image.Image
+	var children []*image.Image
 	for elem := range imageMap[imgID] {
 		img, err := srv.daemon.Graph().Get(elem)
 		if err != nil {
 			return nil, err
 		}
+		children = append(children, img)
+	}
+	return getCachedChild(children, config), nil
+}
+
+// getCachedChild returns the most recent of the images which were committed
+// with config, or nil if there is none.
+func getCachedChild(images []*image.Image, config *runconfig.Config) *image.Image {
+	var match *image.Image
+	for _, img := range images {
 		if runconfig.Compare(&img.ContainerConfig, config) {
 			if match == nil || match.Created.Before(img.Created) {
 				match = img
 			}
 		}
 	}
-	return match, nil
+	return match
 }
 
 func (srv *Server) ContainerStart(job *engine.Job) engine.Status {
@@ -2371,13 +2995,24 @@ func NewServer(eng *engine.Engine, config *daemonconfig.Config) (*Server, error)
 	if err != nil {
 		return nil, err
 	}
+	var trustKey *ecdsa.PrivateKey
+	if config.Trust {
+		if trustKey, err = registry.LoadOrCreateTrustKey(config.TrustDir); err != nil {
+			return nil, err
+		}
+		log.Printf("Signing the pushed tags with the key %s of %s", registry.KeyID(&trustKey.PublicKey), config.TrustDir)
+	}
 	srv := &Server{
-		Eng:         eng,
-		daemon:      daemon,
-		pullingPool: make(map[string]chan struct{}),
-		pushingPool: make(map[string]chan struct{}),
-		events:      make([]utils.JSONMessage, 0, 64), //only keeps the 64 last events
-		listeners:   make(map[int64]chan utils.JSONMessage),
+		Eng:           eng,
+		daemon:        daemon,
+		pullingPool:   make(map[string]chan struct{}),
+		pushingPool:   make(map[string]chan struct{}),
+		pullingLayers: make(map[string]*layerPull),
+		downloadSlots: newTransferSlots(config.MaxConcurrentDownloads),
+		uploadSlots:   newTransferSlots(config.MaxConcurrentUploads),
+		trustKey:      trustKey,
+		events:        make([]utils.JSONMessage, 0, 64), //only keeps the 64 last events
+		listeners:     make(map[int64]chan utils.JSONMessage),
 	}
 	daemon.SetServer(srv)
 	return srv, nil
@@ -2444,12 +3079,16 @@ func (srv *Server) Close() error {
 
 type Server struct {
 	sync.RWMutex
-	daemon      *daemon.Daemon
-	pullingPool map[string]chan struct{}
-	pushingPool map[string]chan struct{}
-	events      []utils.JSONMessage
-	listeners   map[int64]chan utils.JSONMessage
-	Eng         *engine.Engine
-	running     bool
-	tasks       sync.WaitGroup
+	daemon        *daemon.Daemon
+	pullingPool   map[string]chan struct{}
+	pushingPool   map[string]chan struct{}
+	pullingLayers map[string]*layerPull
+	downloadSlots transferSlots
+	uploadSlots   transferSlots
+	trustKey      *ecdsa.PrivateKey
+	events        []utils.JSONMessage
+	listeners     map[int64]chan utils.JSONMessage
+	Eng           *engine.Engine
+	running       bool
+	tasks         sync.WaitGroup
 }
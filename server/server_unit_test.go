@@ -1,9 +1,17 @@
 package server
 
 import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
 	"testing"
 	"time"
 
+	"github.com/dotcloud/docker/image"
+	"github.com/dotcloud/docker/registry"
+	"github.com/dotcloud/docker/runconfig"
 	"github.com/dotcloud/docker/utils"
 )
 
@@ -45,6 +53,189 @@ func TestPools(t *testing.T) {
 	}
 }
 
+// waitLayerPullers waits until the pull of the layer id has n clients
+// waiting for it.
+func waitLayerPullers(t *testing.T, srv *Server, id string, n int) {
+	setTimeout(t, "Waiting for the clients to wait for the pull timed out", 2*time.Second, func() {
+		for {
+			srv.Lock()
+			p, exists := srv.pullingLayers[id]
+			waiters := exists && p.waiters == n
+			srv.Unlock()
+			if waiters {
+				return
+			}
+			runtime.Gosched()
+		}
+	})
+}
+
+func TestPullLayerOnce(t *testing.T) {
+	var (
+		srv     = &Server{pullingLayers: make(map[string]*layerPull)}
+		sf      = utils.NewStreamFormatter(false)
+		finish  = make(chan struct{})
+		results = make(chan error)
+	)
+
+	go func() {
+		results <- srv.pullLayerOnce(ioutil.Discard, "layer", sf, func() error {
+			<-finish
+			return nil
+		})
+	}()
+	waitLayerPullers(t, srv, "layer", 0)
+	go func() {
+		results <- srv.pullLayerOnce(ioutil.Discard, "layer", sf, func() error {
+			t.Errorf("Expected the second pull to wait for the first one")
+			return nil
+		})
+	}()
+	waitLayerPullers(t, srv, "layer", 1)
+	close(finish)
+
+	setTimeout(t, "Waiting for the pulls timed out", 2*time.Second, func() {
+		for i := 0; i < 2; i++ {
+			if err := <-results; err != nil {
+				t.Errorf("Expected the result of the first pull, got %v", err)
+			}
+		}
+	})
+
+	// The layer can be pulled again once done
+	if err := srv.pullLayerOnce(ioutil.Discard, "layer", sf, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPullLayerOnceFailed(t *testing.T) {
+	var (
+		srv    = &Server{pullingLayers: make(map[string]*layerPull)}
+		sf     = utils.NewStreamFormatter(false)
+		finish = make(chan struct{})
+		failed = errors.New("failed")
+		first  = make(chan error)
+		second = make(chan error)
+		pulled = false
+	)
+
+	go func() {
+		first <- srv.pullLayerOnce(ioutil.Discard, "layer", sf, func() error {
+			<-finish
+			return failed
+		})
+	}()
+	waitLayerPullers(t, srv, "layer", 0)
+	go func() {
+		second <- srv.pullLayerOnce(ioutil.Discard, "layer", sf, func() error {
+			pulled = true
+			return nil
+		})
+	}()
+	waitLayerPullers(t, srv, "layer", 1)
+	close(finish)
+
+	// The failure of the first pull, e.g. because of its credentials, isn't
+	// the one of the second
+	setTimeout(t, "Waiting for the pulls timed out", 2*time.Second, func() {
+		if err := <-first; err != failed {
+			t.Errorf("Expected the error of the first pull, got %v", err)
+		}
+		if err := <-second; err != nil {
+			t.Errorf("Expected the second pull to succeed, got %v", err)
+		}
+	})
+	if !pulled {
+		t.Fatal("Expected the second client to pull the layer itself")
+	}
+}
+
+func TestV2Endpoint(t *testing.T) {
+	handler := func(status int, version string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v2/" {
+				t.Errorf("Unexpected request %s", r.URL.Path)
+			}
+			if version != "" {
+				w.Header().Set("Docker-Distribution-API-Version", version)
+			}
+			w.WriteHeader(status)
+		})
+	}
+	for _, c := range []struct {
+		handler http.Handler
+		v2      bool
+	}{
+		{handler(200, "registry/2.0"), true},
+		{handler(401, "registry/2.0"), true},
+		// Registries which only speak v1 are pulled from and pushed to
+		// with the v1 protocol
+		{handler(404, ""), false},
+		{handler(401, ""), false},
+	} {
+		registryServer := httptest.NewServer(c.handler)
+		r, err := registry.NewRegistry(&registry.AuthConfig{}, registry.HTTPRequestFactory(nil), registryServer.URL+"/v1/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoint, v2 := v2Endpoint(r, registryServer.URL+"/v1/")
+		registryServer.Close()
+		if v2 != c.v2 {
+			t.Fatalf("Expected v2 to be %v, got %v", c.v2, v2)
+		}
+		if v2 && endpoint != registryServer.URL+"/v2/" {
+			t.Fatalf("Expected the endpoint %s/v2/, got %s", registryServer.URL, endpoint)
+		}
+	}
+
+	// The index only speaks v1
+	r, err := registry.NewRegistry(&registry.AuthConfig{}, registry.HTTPRequestFactory(nil), registry.IndexServerAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, v2 := v2Endpoint(r, registry.IndexServerAddress()); v2 {
+		t.Fatal("Expected the index not to be used with the v2 protocol")
+	}
+}
+
+func TestTransferSlots(t *testing.T) {
+	var (
+		slots = newTransferSlots(2)
+		sf    = utils.NewStreamFormatter(false)
+	)
+	slots.acquire(ioutil.Discard, "first", sf)
+	slots.acquire(ioutil.Discard, "second", sf)
+
+	acquired := make(chan struct{})
+	go func() {
+		slots.acquire(ioutil.Discard, "third", sf)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Expected the third transfer to wait for a slot")
+	case <-time.After(100 * time.Millisecond):
+	}
+	slots.release()
+	setTimeout(t, "Waiting for a slot timed out", 2*time.Second, func() { <-acquired })
+
+	// No limit without slots
+	var unlimited transferSlots
+	unlimited.acquire(ioutil.Discard, "first", sf)
+	unlimited.release()
+}
+
+func TestIsClientError(t *testing.T) {
+	for code, expected := range map[int]bool{404: true, 401: true, 408: false, 429: false, 500: false, 503: false} {
+		if isClientError(&utils.JSONError{Code: code}) != expected {
+			t.Fatalf("Expected isClientError of HTTP code %d to be %t", code, expected)
+		}
+	}
+	if isClientError(errors.New("connection reset by peer")) {
+		t.Fatal("Expected a network error not to be a client error")
+	}
+}
+
 func TestLogEvent(t *testing.T) {
 	srv := &Server{
 		events:    make([]utils.JSONMessage, 0, 64),
@@ -81,6 +272,25 @@ func TestLogEvent(t *testing.T) {
 	})
 }
 
+func TestGetCachedChild(t *testing.T) {
+	var (
+		now    = time.Now()
+		config = &runconfig.Config{Cmd: []string{"/bin/sh", "-c", "echo foo"}}
+		images = []*image.Image{
+			{ID: "other", Created: now.Add(time.Hour), ContainerConfig: runconfig.Config{Cmd: []string{"/bin/sh", "-c", "echo bar"}}},
+			{ID: "old", Created: now.Add(-time.Hour), ContainerConfig: *config},
+			{ID: "new", Created: now, ContainerConfig: *config},
+		}
+	)
+
+	if match := getCachedChild(images, config); match == nil || match.ID != "new" {
+		t.Fatalf("Expected the most recent matching image, got %v", match)
+	}
+	if match := getCachedChild(images[:1], config); match != nil {
+		t.Fatalf("Expected no match, got %s", match.ID)
+	}
+}
+
 // FIXME: this is duplicated from integration/commands_test.go
 func setTimeout(t *testing.T, msg string, d time.Duration, f func()) {
 	c := make(chan bool)
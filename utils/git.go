@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/dotcloud/docker/pkg/symlink"
+)
+
+// ParseGitURL splits a git URL of the form <repository>#<ref>:<subdir>
+// into the URL of the repository, the ref to check out and the
+// subdirectory to use as context. The ref and subdirectory are optional.
+func ParseGitURL(remoteURL string) (repository, ref, subdir string) {
+	repository = remoteURL
+	if i := strings.LastIndex(remoteURL, "#"); i != -1 {
+		repository = remoteURL[:i]
+		fragment := strings.SplitN(remoteURL[i+1:], ":", 2)
+		ref = fragment[0]
+		if len(fragment) == 2 {
+			subdir = fragment[1]
+		}
+	}
+	return repository, ref, subdir
+}
+
+// GitClone clones the repository of the git URL remoteURL into root, at
+// the ref given by its fragment, and returns the path of the context
+// directory within root. Branches and tags are cloned shallowly, other
+// refs, e.g. commits, need the full history.
+func GitClone(remoteURL, root string) (string, error) {
+	repository, ref, subdir := ParseGitURL(remoteURL)
+
+	args := []string{"clone", "--recursive", "--depth", "1"}
+	if ref != "" {
+		args = append(args, "--branch", ref)
+	}
+	if _, err := git("", append(args, repository, root)...); err != nil {
+		if ref == "" {
+			return "", err
+		}
+		if err := os.RemoveAll(root); err != nil {
+			return "", err
+		}
+		if _, err := git("", "clone", "--recursive", repository, root); err != nil {
+			return "", err
+		}
+		if _, err := git(root, "checkout", "-q", ref); err != nil {
+			return "", err
+		}
+		if _, err := git(root, "submodule", "update", "--init", "--recursive"); err != nil {
+			return "", err
+		}
+	}
+
+	if subdir == "" {
+		return root, nil
+	}
+	contextDir, err := symlink.FollowSymlinkInScope(filepath.Join(root, subdir), root)
+	if err != nil {
+		return "", fmt.Errorf("Error following the subdirectory %s of %s: %s", subdir, repository, err)
+	}
+	if fi, err := os.Stat(contextDir); err != nil {
+		return "", err
+	} else if !fi.IsDir() {
+		return "", fmt.Errorf("%s of %s is not a directory", subdir, repository)
+	}
+	return contextDir, nil
+}
+
+// git runs a git command in dir, or in the current directory if dir is
+// empty.
+func git(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("Error trying to use git: %s (%s)", err, output)
+	}
+	return output, nil
+}
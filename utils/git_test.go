@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+)
+
+func TestParseGitURL(t *testing.T) {
+	for remoteURL, expected := range map[string][3]string{
+		"git://github.com/docker/docker":                       {"git://github.com/docker/docker", "", ""},
+		"git://github.com/docker/docker#v1.0":                  {"git://github.com/docker/docker", "v1.0", ""},
+		"https://github.com/docker/docker.git#master:contrib":  {"https://github.com/docker/docker.git", "master", "contrib"},
+		"git@github.com:docker/docker.git#:docs/sources":       {"git@github.com:docker/docker.git", "", "docs/sources"},
+		"github.com/docker/docker#v1.0:contrib/desktop-integr": {"github.com/docker/docker", "v1.0", "contrib/desktop-integr"},
+	} {
+		repository, ref, subdir := ParseGitURL(remoteURL)
+		if repository != expected[0] || ref != expected[1] || subdir != expected[2] {
+			t.Fatalf("%s: expected %v, got [%s %s %s]", remoteURL, expected, repository, ref, subdir)
+		}
+	}
+
+	if !IsGIT("https://github.com/docker/docker.git#v1.0:contrib") {
+		t.Fatal("Expected a git URL with a fragment to be a git URL")
+	}
+}
+
+func TestGitClone(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	repo, err := ioutil.TempDir("", "docker-test-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repo)
+
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"config", "user.email", "test@docker.com"},
+		{"config", "user.name", "Docker"},
+	} {
+		if _, err := git(repo, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit := func(content string) {
+		if err := os.MkdirAll(path.Join(repo, "sub"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(repo, "sub", "Dockerfile"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := git(repo, "add", "-A"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := git(repo, "commit", "-q", "-m", content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit("FROM busybox\n")
+	if _, err := git(repo, "tag", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	output, err := git(repo, "rev-parse", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := string(output[:len(output)-1])
+	commit("FROM scratch\n")
+
+	for fragment, expected := range map[string]string{
+		"":          "FROM scratch\n",
+		"#v1:sub":   "FROM busybox\n",
+		"#" + first: "FROM busybox\n",
+	} {
+		root, err := ioutil.TempDir("", "docker-test-git-clone")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+
+		contextDir, err := GitClone("file://"+repo+fragment, root)
+		if err != nil {
+			t.Fatalf("%q: %s", fragment, err)
+		}
+		if content, err := ioutil.ReadFile(path.Join(root, "sub", "Dockerfile")); err != nil || string(content) != expected {
+			t.Fatalf("%q: expected %q, got %q (%v)", fragment, expected, content, err)
+		}
+		if fragment == "#v1:sub" && contextDir != path.Join(root, "sub") {
+			t.Fatalf("Expected the context to be the subdirectory, got %s", contextDir)
+		}
+	}
+
+	root, err := ioutil.TempDir("", "docker-test-git-clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if _, err := GitClone("file://"+repo+"#v1:sub/Dockerfile", root); err == nil {
+		t.Fatal("Expected an error for a subdirectory which is a file")
+	}
+}
@@ -67,16 +67,28 @@ func (p *JSONProgress) String() string {
 	return pbBox + numbersBox + timeLeftBox
 }
 
+// JSONBuildStep describes a step of a build once it is done, for the tools
+// which follow builds.
+type JSONBuildStep struct {
+	Index       int           `json:"index"`
+	Instruction string        `json:"instruction"`
+	Cached      bool          `json:"cached"`
+	Duration    time.Duration `json:"duration"` // In nanoseconds
+	ImageID     string        `json:"image,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
 type JSONMessage struct {
-	Stream          string        `json:"stream,omitempty"`
-	Status          string        `json:"status,omitempty"`
-	Progress        *JSONProgress `json:"progressDetail,omitempty"`
-	ProgressMessage string        `json:"progress,omitempty"` //deprecated
-	ID              string        `json:"id,omitempty"`
-	From            string        `json:"from,omitempty"`
-	Time            int64         `json:"time,omitempty"`
-	Error           *JSONError    `json:"errorDetail,omitempty"`
-	ErrorMessage    string        `json:"error,omitempty"` //deprecated
+	Stream          string         `json:"stream,omitempty"`
+	Status          string         `json:"status,omitempty"`
+	Progress        *JSONProgress  `json:"progressDetail,omitempty"`
+	ProgressMessage string         `json:"progress,omitempty"` //deprecated
+	ID              string         `json:"id,omitempty"`
+	From            string         `json:"from,omitempty"`
+	Time            int64          `json:"time,omitempty"`
+	Error           *JSONError     `json:"errorDetail,omitempty"`
+	ErrorMessage    string         `json:"error,omitempty"` //deprecated
+	BuildStep       *JSONBuildStep `json:"buildStep,omitempty"`
 }
 
 func (jm *JSONMessage) Display(out io.Writer, isTerminal bool) error {
@@ -86,6 +98,10 @@ func (jm *JSONMessage) Display(out io.Writer, isTerminal bool) error {
 		}
 		return jm.Error
 	}
+	// Build steps are already described by the stream
+	if jm.BuildStep != nil {
+		return nil
+	}
 	var endl string
 	if isTerminal && jm.Stream == "" {
 		// <ESC>[2K = erase entire current line
@@ -159,3 +175,28 @@ func DisplayJSONMessagesStream(in io.Reader, out io.Writer, terminalFd uintptr,
 	}
 	return nil
 }
+
+// CopyJSONMessagesStream copies the messages of in to out as JSON lines,
+// for tools rather than for humans. It returns the error of the first error
+// message.
+func CopyJSONMessagesStream(in io.Reader, out io.Writer) error {
+	var (
+		dec = json.NewDecoder(in)
+		enc = json.NewEncoder(out)
+	)
+	for {
+		var jm JSONMessage
+		if err := dec.Decode(&jm); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := enc.Encode(&jm); err != nil {
+			return err
+		}
+		if jm.Error != nil {
+			return jm.Error
+		}
+	}
+}
@@ -1,7 +1,11 @@
 package utils
 
 import (
+	"bytes"
+	"encoding/json"
+	"io"
 	"testing"
+	"time"
 )
 
 func TestError(t *testing.T) {
@@ -27,3 +31,49 @@ func TestProgress(t *testing.T) {
 		t.Fatalf("Expected '[=========================>                         ]     50 B/100 B', got '%s'", jp3.String())
 	}
 }
+
+func TestBuildStep(t *testing.T) {
+	sf := NewStreamFormatter(true)
+	stream := new(bytes.Buffer)
+	stream.Write(sf.FormatStream("Step 0 : FROM busybox\n"))
+	stream.Write(sf.FormatBuildStep(&JSONBuildStep{Index: 0, Instruction: "FROM busybox", Duration: time.Second, ImageID: "abc"}))
+	stream.Write(sf.FormatError(&JSONError{Message: "failed"}))
+	stream.Write(sf.FormatStream("not copied"))
+
+	// Build steps are left out of the text output
+	out := new(bytes.Buffer)
+	if err := DisplayJSONMessagesStream(bytes.NewReader(stream.Bytes()), out, 0, false); err == nil || err.Error() != "failed" {
+		t.Fatalf("Expected the error of the stream, got %v", err)
+	}
+	if out.String() != "Step 0 : FROM busybox\n" {
+		t.Fatalf("Unexpected output %q", out.String())
+	}
+
+	out.Reset()
+	if err := CopyJSONMessagesStream(bytes.NewReader(stream.Bytes()), out); err == nil || err.Error() != "failed" {
+		t.Fatalf("Expected the error of the stream, got %v", err)
+	}
+	var (
+		dec      = json.NewDecoder(out)
+		messages []JSONMessage
+	)
+	for {
+		var jm JSONMessage
+		if err := dec.Decode(&jm); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, jm)
+	}
+	if len(messages) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(messages))
+	}
+	if step := messages[1].BuildStep; step == nil || step.Instruction != "FROM busybox" || step.Duration != time.Second || step.ImageID != "abc" {
+		t.Fatalf("Unexpected build step %#v", messages[1])
+	}
+
+	if NewStreamFormatter(false).FormatBuildStep(&JSONBuildStep{}) != nil {
+		t.Fatal("Expected no build step in text streams")
+	}
+}
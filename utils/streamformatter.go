@@ -84,6 +84,20 @@ func (sf *StreamFormatter) FormatProgress(id, action string, progress *JSONProgr
 	return []byte(action + " " + progress.String() + endl)
 }
 
+// FormatBuildStep formats a build step. Build steps are only sent as JSON,
+// the text stream already describes them.
+func (sf *StreamFormatter) FormatBuildStep(step *JSONBuildStep) []byte {
+	if !sf.json {
+		return nil
+	}
+	sf.used = true
+	b, err := json.Marshal(&JSONMessage{BuildStep: step})
+	if err != nil {
+		return sf.FormatError(err)
+	}
+	return append(b, streamNewlineBytes...)
+}
+
 func (sf *StreamFormatter) Used() bool {
 	return sf.used
 }
@@ -26,6 +26,10 @@ type TarSum struct {
 	finished           bool
 	first              bool
 	DisableCompression bool
+	// Only hash the names, modes, types and contents of the files,
+	// leaving out the times and ownership, which depend on where the
+	// files come from
+	ContentOnly bool
 }
 
 type writeCloseFlusher interface {
@@ -46,6 +50,9 @@ func (n *nopCloseFlusher) Flush() error {
 }
 
 func (ts *TarSum) encodeHeader(h *tar.Header) error {
+	if ts.ContentOnly {
+		return ts.encodeContentHeader(h)
+	}
 	for _, elem := range [][2]string{
 		{"name", h.Name},
 		{"mode", strconv.Itoa(int(h.Mode))},
@@ -69,6 +76,23 @@ func (ts *TarSum) encodeHeader(h *tar.Header) error {
 	return nil
 }
 
+func (ts *TarSum) encodeContentHeader(h *tar.Header) error {
+	for _, elem := range [][2]string{
+		{"name", h.Name},
+		{"mode", strconv.Itoa(int(h.Mode))},
+		{"size", strconv.Itoa(int(h.Size))},
+		{"typeflag", string([]byte{h.Typeflag})},
+		{"linkname", h.Linkname},
+		{"devmajor", strconv.Itoa(int(h.Devmajor))},
+		{"devminor", strconv.Itoa(int(h.Devminor))},
+	} {
+		if _, err := ts.h.Write([]byte(elem[0] + elem[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (ts *TarSum) Read(buf []byte) (int, error) {
 	if ts.gz == nil {
 		ts.bufTar = bytes.NewBuffer([]byte{})
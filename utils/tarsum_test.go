@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 )
 
 type testLayer struct {
@@ -146,6 +147,41 @@ func TestTarSums(t *testing.T) {
 	}
 }
 
+func TestTarSumContentOnly(t *testing.T) {
+	sum := func(header *tar.Header, contentOnly bool) string {
+		buf := new(bytes.Buffer)
+		tarW := tar.NewWriter(buf)
+		header.Size = 5
+		if err := tarW.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarW.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		tarW.Close()
+
+		ts := &TarSum{Reader: buf, DisableCompression: true, ContentOnly: contentOnly}
+		if _, err := io.Copy(ioutil.Discard, ts); err != nil {
+			t.Fatal(err)
+		}
+		return ts.Sum(nil)
+	}
+
+	var (
+		a = &tar.Header{Name: "file", Mode: 0644, ModTime: time.Unix(1, 0)}
+		b = &tar.Header{Name: "file", Mode: 0644, ModTime: time.Unix(2, 0), Uid: 1000, Gid: 1000, Uname: "foo"}
+	)
+	if sum(a, false) == sum(b, false) {
+		t.Fatal("Expected different sums for different times and owners")
+	}
+	if sum(a, true) != sum(b, true) {
+		t.Fatal("Expected the same sums for the same contents")
+	}
+	if sum(a, true) == sum(&tar.Header{Name: "file", Mode: 0755}, true) {
+		t.Fatal("Expected different sums for different modes")
+	}
+}
+
 func Benchmark9kTar(b *testing.B) {
 	buf := bytes.NewBuffer([]byte{})
 	fh, err := os.Open("testdata/46af0962ab5afeb5ce6740d4d91652e69206fc991fd5328c1a94d364ad00e457/layer.tar")
@@ -723,6 +723,7 @@ func IsURL(str string) bool {
 }
 
 func IsGIT(str string) bool {
+	str, _, _ = ParseGitURL(str)
 	return strings.HasPrefix(str, "git://") || strings.HasPrefix(str, "github.com/") || strings.HasPrefix(str, "git@github.com:") || (strings.HasSuffix(str, ".git") && IsURL(str))
 }
 
@@ -821,10 +822,14 @@ func ParseHost(defaultHost string, defaultUnix, addr string) (string, error) {
 	return fmt.Sprintf("%s://%s:%d", proto, host, port), nil
 }
 
-// Get a repos name and returns the right reposName + tag
-// The tag can be confusing because of a port in a repository name.
-//     Ex: localhost.localdomain:5000/samalba/hipache:latest
+// ParseRepositoryTag splits a name into a repository and a tag, as in
+// repository:tag, or a digest, as in repository@sha256:<hex>. A port in the
+// repository name is not mistaken for a tag, as in
+// localhost.localdomain:5000/samalba/hipache:latest.
 func ParseRepositoryTag(repos string) (string, string) {
+	if n := strings.Index(repos, "@"); n >= 0 {
+		return repos[:n], repos[n+1:]
+	}
 	n := strings.LastIndex(repos, ":")
 	if n < 0 {
 		return repos, ""
@@ -835,6 +840,12 @@ func ParseRepositoryTag(repos string) (string, string) {
 	return repos, ""
 }
 
+// IsDigest returns whether reference, as returned by ParseRepositoryTag,
+// is a digest rather than a tag.
+func IsDigest(reference string) bool {
+	return strings.HasPrefix(reference, "sha256:")
+}
+
 // An StatusError reports an unsuccessful exit by a command.
 type StatusError struct {
 	Status     string
@@ -1088,3 +1099,55 @@ func ValidateContextDirectory(srcPath string) error {
 	})
 	return finalError
 }
+
+// ReadDockerignore returns the exclusion patterns of the .dockerignore file
+// at the root of a build context, or nil if there is none. Empty lines and
+// lines starting with # are skipped.
+func ReadDockerignore(root string) ([]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(root, ".dockerignore"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Error reading .dockerignore: %s", err)
+	}
+	var patterns []string
+	for _, line := range strings.Split(string(data), "\n") {
+		pattern := strings.TrimSpace(line)
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		if _, err := filepath.Match(strings.TrimPrefix(pattern, "!"), ""); err != nil {
+			return nil, fmt.Errorf("Invalid .dockerignore pattern %s: %s", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// Matches returns true if the file at the relative path file is excluded
+// by patterns, as read by ReadDockerignore. A pattern uses the syntax of
+// filepath.Match, and also excludes the content of the directories it
+// matches. A pattern starting with ! includes back the files it matches.
+// The last pattern matching a file wins.
+func Matches(file string, patterns []string) (bool, error) {
+	file = strings.TrimPrefix(filepath.Clean(file), "/")
+	excluded := false
+	for _, pattern := range patterns {
+		negative := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(filepath.Clean(strings.TrimPrefix(pattern, "!")), "/")
+
+		// Try the file, then each of its parent directories
+		for p := file; p != "." && p != ""; p = filepath.Dir(p) {
+			match, err := filepath.Match(pattern, p)
+			if err != nil {
+				return false, err
+			}
+			if match {
+				excluded = !negative
+				break
+			}
+		}
+	}
+	return excluded, nil
+}
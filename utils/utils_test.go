@@ -6,6 +6,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"testing"
 )
 
@@ -326,6 +327,9 @@ func TestParseRepositoryTag(t *testing.T) {
 	if repo, tag := ParseRepositoryTag("url:5000/repo:tag"); repo != "url:5000/repo" || tag != "tag" {
 		t.Errorf("Expected repo: '%s' and tag: '%s', got '%s' and '%s'", "url:5000/repo", "tag", repo, tag)
 	}
+	if repo, digest := ParseRepositoryTag("url:5000/repo@sha256:abcdef"); repo != "url:5000/repo" || digest != "sha256:abcdef" || !IsDigest(digest) {
+		t.Errorf("Expected repo: '%s' and digest: '%s', got '%s' and '%s'", "url:5000/repo", "sha256:abcdef", repo, digest)
+	}
 }
 
 func TestCheckLocalDns(t *testing.T) {
@@ -493,3 +497,60 @@ func TestReadSymlinkedDirectoryToFile(t *testing.T) {
 		t.Errorf("failed to remove symlink: %s", err)
 	}
 }
+
+func TestReadDockerignore(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-test-dockerignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if patterns, err := ReadDockerignore(tmp); err != nil || patterns != nil {
+		t.Fatalf("Expected no patterns without .dockerignore, got %v (%v)", patterns, err)
+	}
+
+	content := "# Dependencies\n\nnode_modules\n  *.log \n!important.log\n"
+	if err := ioutil.WriteFile(path.Join(tmp, ".dockerignore"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	patterns, err := ReadDockerignore(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patterns) != 3 || patterns[0] != "node_modules" || patterns[1] != "*.log" || patterns[2] != "!important.log" {
+		t.Fatalf("Unexpected patterns %v", patterns)
+	}
+
+	if err := ioutil.WriteFile(path.Join(tmp, ".dockerignore"), []byte("[-]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadDockerignore(tmp); err == nil {
+		t.Fatal("Expected an error for an invalid pattern")
+	}
+}
+
+func TestMatches(t *testing.T) {
+	patterns := []string{"node_modules", "*.log", "!important.log", "/.git", "docs/*.md", "!docs/README.md"}
+	for file, expected := range map[string]bool{
+		"node_modules":             true,
+		"node_modules/foo/bar.js":  true,
+		"src/node_modules":         false,
+		"debug.log":                true,
+		"important.log":            false,
+		"logs/debug.log":           false,
+		".git/HEAD":                true,
+		"docs/index.md":            true,
+		"docs/README.md":           false,
+		"docs/api/index.md":        false,
+		"Dockerfile":               false,
+		"/node_modules/foo/bar.js": true,
+	} {
+		excluded, err := Matches(file, patterns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if excluded != expected {
+			t.Errorf("Expected Matches(%s) to be %v", file, expected)
+		}
+	}
+}